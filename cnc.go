@@ -4,11 +4,13 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
-	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -16,86 +18,63 @@ import (
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sajal/mtrparser"
 	"github.com/turbobytes/geoipdb"
+	"github.com/turbobytes/pulse/metrics"
+	"github.com/turbobytes/pulse/pulsecnc"
 	"github.com/turbobytes/pulse/utils"
 	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
 )
 
 //type Resolver int
 var geo geoipdb.Handler
 var session *mgo.Session
-
-//AgentInfo is what we store in db...
-type AgentInfo struct {
-	Name           string
-	City           string
-	State          string
-	Country        string
-	SerialNumber   *big.Int
-	LocalResolvers []string
-	ASN            string
-	ASName         string
-	Host           string
-	//HostEmail       string
-	//HostWebsite     string
-	//HostDescription string
-	//HostCompanyLogo string
-	HostType    string // H = Home, O = Office, D = Datacenter
-	FirstOnline string
-	LatLng      string //TODO: make richer?
-}
-
-func (agent *AgentInfo) GetBSON() (interface{}, error) {
-	return bson.D{
-		{"Name", agent.Name},
-		{"City", agent.City},
-		{"State", agent.State},
-		{"Country", agent.Country},
-		{"LocalResolvers", strings.Join(agent.LocalResolvers, ",")},
-		{"_id", agent.SerialNumber.String()},
-		{"ASN", agent.ASN},
-		{"ASName", agent.ASName},
-		{"Host", agent.Host},
-		//{"HostWebsite", agent.HostWebsite},
-		//{"HostDescription", agent.HostDescription},
-		{"HostType", agent.HostType},
-		//{"HostCompanyLogo", agent.HostCompanyLogo},
-		{"FirstOnline", agent.FirstOnline},
-		{"LatLng", agent.LatLng},
-	}, nil
-}
-
-func (agent *AgentInfo) SetBSON(raw bson.Raw) error {
-	data := make(map[string]string)
-	err := raw.Unmarshal(data)
-	if err != nil {
-		return err
-	}
-	agent.Name = data["Name"]
-	agent.City = data["City"]
-	agent.State = data["State"]
-	agent.Country = data["Country"]
-	agent.LocalResolvers = strings.Split(data["LocalResolvers"], ",")
-	agent.SerialNumber = new(big.Int)
-	agent.SerialNumber.SetString(data["_id"], 10)
-	agent.ASN = data["ASN"]
-	agent.ASName = data["ASName"]
-	agent.Host = data["Host"]
-	//agent.HostWebsite = data["HostWebsite"]
-	//agent.HostDescription = data["HostDescription"]
-	//agent.HostCompanyLogo = data["HostCompanyLogo"]
-	agent.HostType = data["HostType"]
-	agent.FirstOnline = data["FirstOnline"]
-	agent.LatLng = data["LatLng"]
-	return nil
-}
+var agents pulsecnc.AgentStore
+var history pulsecnc.HistoryStore
+var config atomic.Value //Current *pulsecnc.Config
+var jobs *pulsecnc.JobManager
+var events = pulsecnc.NewEventBus()
+var docs pulsecnc.DocStore
+var scheduler *pulsecnc.Scheduler
+var alerts *pulsecnc.AlertManager
+var ca *pulsecnc.CA //nil without -cakey, then agents can neither be enrolled nor renewed
+var enroller *pulsecnc.Enroller
+var revocations *pulsecnc.RevocationList
+var serials *pulsecnc.SerialLinks //Agent ids of renewed certificates
+var tlsreloader *pulsecnc.TLSReloader
+var auth *pulsecnc.Authenticator //nil when no keys are configured, then anyone can do anything
+
+// CNC metrics, exposed at /metrics
+var (
+	registry = metrics.NewRegistry()
+	_        = registry.NewGaugeFunc("pulse_cnc_agents_connected", "Connected agents, by country and ASN.", []string{"country", "asn"}, func(emit func(float64, ...string)) {
+		tracker.collectConnected(emit)
+	})
+	_ = registry.NewGaugeFunc("pulse_cnc_agent_cert_expiry_timestamp_seconds", "Unix time the certificate of connected agents expires.", []string{"agent"}, func(emit func(float64, ...string)) {
+		tracker.collectCertExpiry(emit)
+	})
+	unregistrations   = registry.NewCounter("pulse_cnc_agent_unregistrations_total", "Agents dropped from the tracker, by reason.", "reason")
+	pingTimeouts      = registry.NewCounter("pulse_cnc_ping_timeouts_total", "Pings agents did not answer within the ping timeout.")
+	dispatches        = registry.NewCounter("pulse_cnc_dispatches_total", "Tests dispatched to the fleet, by test type.", "type")
+	agentTests        = registry.NewCounter("pulse_cnc_agent_tests_total", "Tests sent to individual agents, by test type and outcome.", "type", "outcome")
+	agentTestDuration = registry.NewHistogram("pulse_cnc_agent_test_duration_seconds", "Time agents took to answer a test, by test type.", nil, "type")
+	runDuration       = registry.NewHistogram("pulse_cnc_run_duration_seconds", "Time from dispatch until every agent answered or gave up, by test type.", nil, "type")
+	unanswered        = registry.NewCounter("pulse_cnc_agent_unanswered_total", "Tests an agent never answered, because it timed out or disconnected.", "agent")
+	asnLookupDuration = registry.NewHistogram("pulse_cnc_asn_lookup_duration_seconds", "ASN lookup latency.", []float64{.001, .005, .01, .05, .1, .5, 1, 5})
+	asnLookupFailures = registry.NewCounter("pulse_cnc_asn_lookup_failures_total", "ASN lookups that failed.")
+	tlsReloads        = registry.NewCounter("pulse_cnc_tls_reloads_total", "Reloads of the minion listener certificates, by outcome.", "outcome")
+	certRenewals      = registry.NewCounter("pulse_cnc_agent_cert_renewals_total", "Agent certificates renewed, by outcome.", "outcome")
+)
 
 type Worker struct {
 	Client *rpc.Client `json:"date"`
@@ -108,28 +87,35 @@ type Worker struct {
 	State     string
 	Country   string
 	City      string
-	Serial    *big.Int
+	Serial    *big.Int //Agent id, the serial of the certificate it enrolled with
 	//HostCompanyLogo string
 	//HostWebsite     string
 	//HostDescription string
 	HostType     string
 	Host         string
+	Version      string              //Minion version, as of its last answer
+	Capabilities *pulse.Capabilities //As told on connect, nil for minions from before capabilities
+	Protocol     string              //Wire protocol negotiated with the minion, empty for gob
+	Labels       map[string]string
 	LatLng       string //TODO: make richer?
 	FirstOnline  string
 	connectedat  time.Time
 	ConnectedFor string
 	Connected    bool
+	CertNotAfter time.Time //Expiry of the agent certificate, the renewed one once renewed
+	CertSerial   *big.Int  //Serial of the agent certificate, the renewed one once renewed
+	cert         *x509.Certificate
+	expiryWarned bool //EventCertExpiring was published for cert
 }
 
 func populatedata(w *Worker, insertfirst bool) {
-	c := session.DB("dnsdist").C("agents")
-	agent := new(AgentInfo)
-	err := c.Find(bson.M{"_id": w.Serial.String()}).One(agent)
-	if err == mgo.ErrNotFound && insertfirst {
+	agent, err := agents.Get(w.Serial)
+	if err == pulsecnc.ErrAgentNotFound && insertfirst {
+		agent = new(pulsecnc.AgentInfo)
 		agent.Name = w.Name
 		agent.SerialNumber = w.Serial
 		agent.FirstOnline = time.Now().UTC().String()
-		err1 := c.Insert(agent)
+		err1 := agents.Insert(agent)
 		if err1 != nil {
 			log.Fatal(err1)
 		}
@@ -137,6 +123,29 @@ func populatedata(w *Worker, insertfirst bool) {
 		log.Println(err)
 		return
 	}
+	fillworker(w, agent)
+	if insertfirst {
+		//Update DB with last known ASN data
+		if w.ASN != nil && w.ASName != nil {
+			agent.ASN = *w.ASN
+			agent.ASName = *w.ASName
+		}
+		if agent.FirstOnline == "" {
+			//The first time it actually came online...
+			log.Println("This is first time agent came online ", agent.SerialNumber)
+			agent.FirstOnline = time.Now().UTC().String()
+			w.FirstOnline = agent.FirstOnline
+		}
+		if err := agents.Update(agent); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// fillworker copies the stored metadata of an agent into w.
+// ASN data is only copied for workers that are not connected,
+// connected ones know better from their current IP.
+func fillworker(w *Worker, agent *pulsecnc.AgentInfo) {
 	w.Name = agent.Name
 	w.City = agent.City
 	w.State = agent.State
@@ -148,19 +157,12 @@ func populatedata(w *Worker, insertfirst bool) {
 	//w.HostWebsite = agent.HostWebsite
 	w.HostType = agent.HostType
 	w.Host = agent.Host
-	if !insertfirst {
+	w.Labels = agent.Labels
+	if !w.Connected {
 		//Populate is running cause of offline agent
-		w.ASN = &agent.ASN
-		w.ASName = &agent.ASName
-	} else {
-		//Update DB with last known ASN data
-		c.UpdateId(agent.SerialNumber.String(), bson.M{"$set": bson.M{"ASN": w.ASN, "ASName": w.ASName}})
-	}
-	if agent.FirstOnline == "" && insertfirst {
-		//The first time it actually came online...
-		log.Println("This is first time agent came online ", agent.SerialNumber)
-		agent.FirstOnline = time.Now().UTC().String()
-		c.UpdateId(agent.SerialNumber.String(), bson.M{"$set": bson.M{"FirstOnline": agent.FirstOnline}})
+		asn, asname := agent.ASN, agent.ASName
+		w.ASN = &asn
+		w.ASName = &asname
 	}
 	w.FirstOnline = agent.FirstOnline
 }
@@ -168,8 +170,11 @@ func populatedata(w *Worker, insertfirst bool) {
 // lookupAsn is a wrapper around LookupAsn
 // that returns results as pointers
 func lookupAsn(ip string) (*string, *string) {
+	st := time.Now()
 	asn, descr, err := LookupAsn(ip)
+	asnLookupDuration.Observe(time.Since(st).Seconds())
 	if err != nil {
+		asnLookupFailures.Inc()
 		log.Printf("warning: failed to lookup ASN for %s: %s\n", ip, err)
 	}
 	return &asn, &descr
@@ -187,9 +192,20 @@ func LookupAsn(ip string) (string, string, error) {
 
 func NewWorker(conn net.Conn) *Worker {
 	w := &Worker{}
-	w.Client = rpc.NewClient(conn)
+	if tlsconn, ok := conn.(*tls.Conn); ok {
+		//The protocol is only known once the handshake is done
+		tlsconn.SetDeadline(time.Now().Add(time.Duration(conf().PingTimeout)))
+		err := tlsconn.Handshake()
+		tlsconn.SetDeadline(time.Time{})
+		if err != nil {
+			log.Println("handshake", conn.RemoteAddr(), err)
+			conn.Close()
+			return nil
+		}
+	}
+	w.Protocol = pulse.NegotiatedProtocol(conn)
+	w.Client = pulse.NewRPCClient(conn)
 	w.IP = strings.Split(conn.RemoteAddr().String(), ":")[0]
-	//TODO: Authenticate and fetch capabilities
 	w.connectedat = time.Now()
 	w.Connected = true
 	tlsconn, ok := conn.(*tls.Conn)
@@ -203,10 +219,19 @@ func NewWorker(conn net.Conn) *Worker {
 			state := tlsconn.ConnectionState()
 			if len(state.PeerCertificates) > 0 {
 				w.Name = state.PeerCertificates[0].Subject.CommonName
-				serial := state.PeerCertificates[0].SerialNumber
-				log.Println(serial)
-				w.Serial = serial
+				w.cert = state.PeerCertificates[0]
+				w.CertNotAfter = w.cert.NotAfter
+				w.CertSerial = w.cert.SerialNumber
+				w.Serial = serials.Agent(w.CertSerial)
+				log.Println(w.Serial, w.CertSerial)
+				if rev := revokedworker(w); rev != nil {
+					log.Println("refusing revoked certificate", w.CertSerial, w.Name)
+					publishevent(pulsecnc.EventRefused, w, "certificate revoked")
+					w.Client.Close()
+					return nil
+				}
 				log.Println(w)
+				fetchcapabilities(w)
 				populatedata(w, true)
 				log.Println(w)
 				return w
@@ -226,6 +251,7 @@ func NewTracker() *Tracker {
 	t.workerlock = &sync.RWMutex{}
 	t.workers = make(map[string]*Worker)
 	go t.Pinger()
+	go t.Renewer()
 	return t
 }
 
@@ -235,44 +261,133 @@ func (tracker *Tracker) Register(conn net.Conn) {
 		tracker.workerlock.Lock()
 		tracker.workers[conn.RemoteAddr().String()] = worker
 		tracker.workerlock.Unlock()
+		publishevent(pulsecnc.EventConnected, worker, conn.RemoteAddr().String())
+		go tracker.checkcertificate(worker)
 	}
 }
 
-func (tracker *Tracker) UnRegister(worker *Worker) {
+func (tracker *Tracker) UnRegister(worker *Worker, reason string) {
 	tracker.workerlock.Lock()
 	defer tracker.workerlock.Unlock()
 	//Copy all except this one
 	for k, w := range tracker.workers {
 		if worker == w {
 			delete(tracker.workers, k)
+			unregistrations.Inc(reason)
+			publishevent(pulsecnc.EventDisconnected, worker, reason)
 		}
 	}
 	//tracker.workers = newworkers
 }
 
+// collectConnected reports connected workers by country and ASN.
+func (tracker *Tracker) collectConnected(emit func(float64, ...string)) {
+	if tracker == nil {
+		return
+	}
+	tracker.workerlock.RLock()
+	defer tracker.workerlock.RUnlock()
+	for _, worker := range tracker.workers {
+		asn := ""
+		if worker.ASN != nil {
+			asn = *worker.ASN
+		}
+		emit(1, worker.Country, asn)
+	}
+}
+
+// collectCertExpiry reports when the certificates of connected workers expire.
+func (tracker *Tracker) collectCertExpiry(emit func(float64, ...string)) {
+	if tracker == nil {
+		return
+	}
+	tracker.workerlock.RLock()
+	defer tracker.workerlock.RUnlock()
+	for _, worker := range tracker.workers {
+		if !worker.CertNotAfter.IsZero() {
+			emit(float64(worker.CertNotAfter.Unix()), worker.Name)
+		}
+	}
+}
+
+// publishevent tells event subscribers something happened to worker.
+func publishevent(typ string, worker *Worker, reason string) {
+	if worker.Serial == nil {
+		//Never made it through the handshake, nobody knows about it
+		return
+	}
+	events.Publish(pulsecnc.NewAgentEvent(typ, worker.Serial.String(), worker.Name, reason))
+}
+
 func pingworker(worker *Worker) (err error) {
 	var reply bool
 	c := make(chan error, 1)
-	//We use this channel trikery to implement a timeout. If pinger doesn't respond in 10 seconds we kill the connection.
+	//We use this channel trikery to implement a timeout. If pinger doesn't respond within the ping timeout we kill the connection.
 	go func() {
 		c <- worker.Client.Call("Pinger.Ping", true, &reply)
 	}()
 	select {
 	case err = <-c:
 		if err == rpc.ErrShutdown {
-			go tracker.UnRegister(worker) //Async cause of locking
+			go tracker.UnRegister(worker, "connection closed") //Async cause of locking
 			log.Println("Unregistering from tracker")
 		} else if err != nil {
 			log.Println("pinger", err)
 		}
-	case <-time.After(10 * time.Second):
-		go tracker.UnRegister(worker) //Did not respond to ping in 10 seconds
+	case <-time.After(time.Duration(conf().PingTimeout)):
+		pingTimeouts.Inc()
+		publishevent(pulsecnc.EventPingTimeout, worker, "no answer to ping in "+conf().PingTimeout.String())
+		go tracker.UnRegister(worker, "ping timeout") //Did not respond to ping in time
 		err = errors.New("Ping timeout")
 		log.Println(err)
 	}
 	return err
 }
 
+// fetchcapabilities asks the minion behind worker what it can do. Minions
+// from before capabilities only get their version probed.
+func fetchcapabilities(worker *Worker) {
+	caps := new(pulse.Capabilities)
+	err := callworker(worker, "Resolver.Capabilities", true, caps)
+	if err != nil && strings.HasPrefix(err.Error(), "rpc: can't find method") {
+		probeversion(worker)
+		return
+	}
+	if err != nil {
+		log.Println("capabilities", worker.Name, err)
+		return
+	}
+	worker.Capabilities = caps
+	worker.Version = caps.Version
+}
+
+// cancelworker asks the minion behind worker, named name, to stop the test
+// named id. Minions from before cancellation run it to the end.
+func cancelworker(worker *Worker, name, id string) {
+	var ok bool
+	err := callworker(worker, "Resolver.Cancel", id, &ok)
+	if err != nil && !strings.HasPrefix(err.Error(), "rpc: can't find method") {
+		log.Println("cancel", name, err)
+	}
+}
+
+// probeversion learns the version of the minion behind worker. Minions
+// answer every test with their version, even one of an unknown type.
+func probeversion(worker *Worker) {
+	var reply pulse.CombinedResult
+	call := worker.Client.Go("Resolver.Combined", &pulse.CombinedRequest{RequestedAt: time.Now()}, &reply, nil)
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			log.Println("version probe", call.Error)
+			return
+		}
+		worker.Version = reply.Version
+	case <-time.After(time.Duration(conf().PingTimeout)):
+		log.Println("version probe timed out for", worker.Name)
+	}
+}
+
 func (tracker *Tracker) SendPings() {
 	tracker.workerlock.RLock()
 	defer tracker.workerlock.RUnlock()
@@ -284,11 +399,106 @@ func (tracker *Tracker) SendPings() {
 
 func (tracker *Tracker) Pinger() {
 	for {
-		time.Sleep(time.Second * 20)
+		time.Sleep(time.Duration(conf().PingInterval))
 		tracker.SendPings()
 	}
 }
 
+// renewCheckInterval is how often connected agents are offered a new certificate.
+const renewCheckInterval = time.Hour
+
+// CheckCertificates offers connected workers a new certificate and reports
+// those whose certificate expires within the configured warning.
+func (tracker *Tracker) CheckCertificates() {
+	tracker.workerlock.RLock()
+	defer tracker.workerlock.RUnlock()
+	for _, worker := range tracker.workers {
+		go tracker.checkcertificate(worker)
+	}
+}
+
+func (tracker *Tracker) Renewer() {
+	for {
+		time.Sleep(renewCheckInterval)
+		tracker.CheckCertificates()
+	}
+}
+
+func (tracker *Tracker) checkcertificate(worker *Worker) {
+	if ca != nil {
+		if err := tracker.renewworker(worker); err != nil {
+			certRenewals.Inc("failed")
+			log.Println("certificate renewal of", worker.Name, err)
+		}
+	}
+	tracker.workerlock.Lock()
+	defer tracker.workerlock.Unlock()
+	if worker.expiryWarned || worker.CertNotAfter.Sub(time.Now()) > time.Duration(conf().CertWarning) {
+		return
+	}
+	worker.expiryWarned = true
+	log.Println("certificate of", worker.Name, "expires", worker.CertNotAfter)
+	publishevent(pulsecnc.EventCertExpiring, worker, "certificate expires "+worker.CertNotAfter.UTC().Format(time.RFC3339))
+}
+
+// renewworker asks the minion behind worker if it wants a new certificate,
+// and installs one signed for its new key if so. The minion keeps its
+// connection and uses the new certificate when it reconnects.
+func (tracker *Tracker) renewworker(worker *Worker) error {
+	var csrpem string
+	err := callworker(worker, "Renewer.Request", true, &csrpem)
+	if err != nil && strings.HasPrefix(err.Error(), "rpc: can't find service") {
+		//Minion predates renewal
+		return nil
+	}
+	if err != nil || csrpem == "" {
+		return err
+	}
+	csr, err := pulsecnc.ParseCertificateRequest(csrpem)
+	if err != nil {
+		return err
+	}
+	tracker.workerlock.RLock()
+	old := worker.cert
+	tracker.workerlock.RUnlock()
+	cert, err := ca.Renew(csr, old, time.Duration(conf().CertValidity))
+	if err != nil {
+		return err
+	}
+	//Linked first, the minion may connect with it as soon as it has it
+	if err := serials.Link(cert.SerialNumber, old.SerialNumber); err != nil {
+		return err
+	}
+	var ok bool
+	if err := callworker(worker, "Renewer.Install", pulsecnc.EncodeCertificate(cert), &ok); err != nil {
+		return err
+	}
+	if _, err := revocations.Supersede(old.SerialNumber); err != nil {
+		log.Println("failed to revoke superseded certificate", old.SerialNumber, err)
+	}
+	tracker.workerlock.Lock()
+	worker.cert = cert
+	worker.CertNotAfter = cert.NotAfter
+	worker.CertSerial = cert.SerialNumber
+	worker.expiryWarned = false
+	tracker.workerlock.Unlock()
+	certRenewals.Inc("ok")
+	log.Println("renewed certificate of", worker.Name, "until", cert.NotAfter)
+	publishevent(pulsecnc.EventRenewed, worker, "valid until "+cert.NotAfter.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// callworker calls method of the minion behind worker, giving up after the test timeout.
+func callworker(worker *Worker, method string, args, reply interface{}) error {
+	call := worker.Client.Go(method, args, reply, nil)
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(time.Duration(conf().TestTimeout)):
+		return errors.New(method + " timed out")
+	}
+}
+
 func addresolvers(args pulse.DNSRequest, resolvers []string) {
 
 }
@@ -305,17 +515,17 @@ func (tracker *Tracker) WorkerJson() []byte {
 		foundids = append(foundids, w.Serial.String())
 	}
 	//Append offline workers...
-	c := session.DB("dnsdist").C("agents")
-	var newids []string
-	c.Find(bson.M{"_id": bson.M{"$nin": foundids}}).Distinct("_id", &newids)
-	//log.Println(err)
-	//log.Println(foundids)
-	//log.Println(newids)
-	for _, newid := range newids {
+	stored, err := agents.List()
+	if err != nil {
+		log.Println(err)
+	}
+	for _, agent := range stored {
+		if slicecontainsstring(agent.SerialNumber.String(), foundids) {
+			continue
+		}
 		wrk := new(Worker)
-		wrk.Serial = new(big.Int)
-		wrk.Serial.SetString(newid, 10)
-		populatedata(wrk, false)
+		wrk.Serial = agent.SerialNumber
+		fillworker(wrk, agent)
 		workers = append(workers, wrk)
 	}
 	data, _ := json.MarshalIndent(workers, "", "  ")
@@ -349,7 +559,74 @@ func (tracker *Tracker) Repopulate() {
 	defer tracker.workerlock.Unlock()
 	for _, w := range tracker.workers {
 		populatedata(w, true)
+		publishevent(pulsecnc.EventRepopulated, w, "")
+	}
+}
+
+// Refresh applies the stored metadata of agent to its worker, if connected.
+func (tracker *Tracker) Refresh(agent *pulsecnc.AgentInfo) {
+	tracker.workerlock.Lock()
+	defer tracker.workerlock.Unlock()
+	for _, w := range tracker.workers {
+		if w.Serial.Cmp(agent.SerialNumber) == 0 {
+			fillworker(w, agent)
+			publishevent(pulsecnc.EventUpdated, w, "")
+		}
+	}
+}
+
+// Disconnect drops the connection of the agent with serial, if any.
+func (tracker *Tracker) Disconnect(serial *big.Int, reason string) {
+	tracker.workerlock.RLock()
+	var found []*Worker
+	for _, w := range tracker.workers {
+		if w.Serial.Cmp(serial) == 0 {
+			found = append(found, w)
+		}
 	}
+	tracker.workerlock.RUnlock()
+	for _, w := range found {
+		//UnRegister first so the reason is not "connection closed"
+		tracker.UnRegister(w, reason)
+		w.Client.Close()
+	}
+}
+
+// DisconnectRevoked drops the connections of agents with a revoked certificate.
+func (tracker *Tracker) DisconnectRevoked() {
+	tracker.workerlock.RLock()
+	var found []*big.Int
+	for _, w := range tracker.workers {
+		if revokedworker(w) != nil {
+			found = append(found, w.Serial)
+		}
+	}
+	tracker.workerlock.RUnlock()
+	for _, serial := range found {
+		tracker.Disconnect(serial, "certificate revoked")
+	}
+}
+
+// revokedworker answers the revocation keeping worker out, nil if there is
+// none. Its certificate may be revoked, or the agent through its id, unless
+// that certificate was merely superseded by a renewal.
+func revokedworker(w *Worker) *pulsecnc.Revocation {
+	if rev := revocations.Revoked(w.CertSerial); rev != nil {
+		return rev
+	}
+	if rev := revocations.Revoked(w.Serial); rev != nil && rev.Source != pulsecnc.RevokedByRenewal {
+		return rev
+	}
+	return nil
+}
+
+func slicecontainsstring(s string, arr []string) bool {
+	for _, item := range arr {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
 
 func slicecontainsbigint(num *big.Int, arr []*big.Int) bool {
@@ -389,21 +666,20 @@ func (tracker *Tracker) LookupIp(asn string) []string {
 	return answer
 }
 
-func (tracker *Tracker) Runner(reqorg *pulse.CombinedRequest) []*pulse.CombinedResult {
-	tracker.workerlock.RLock()
-	defer tracker.workerlock.RUnlock()
-	log.Println(reqorg.AgentFilter)
-	var tmpworker = make(map[string]*Worker)
-	for ip, worker := range tracker.workers {
-		if len(reqorg.AgentFilter) == 0 {
-			tmpworker[ip] = worker
-		} else if slicecontainsbigint(worker.Serial, reqorg.AgentFilter) {
-			tmpworker[ip] = worker
-		}
-	}
-	results := make([]*pulse.CombinedResult, 0)
+// Start sends reqorg to all selected workers. It answers a channel that yields
+// each result as soon as it comes in, and the number of workers the test was
+// sent to. The channel is closed once every worker answered or gave up, or ctx is done.
+func (tracker *Tracker) Start(ctx context.Context, reqorg *pulse.CombinedRequest) (<-chan *pulse.CombinedResult, int) {
+	log.Println(reqorg.AgentFilter, reqorg.Selector)
+	tmpworker := tracker.selectworkers(reqorg.AgentFilter, reqorg.Selector)
 	n := len(tmpworker)
+	testtype := pulsecnc.TestTypeName(reqorg.Type)
+	dispatches.Inc(testtype)
+	started := time.Now()
+	testid := pulsecnc.NewRunID() //Names the test to Resolver.Cancel
+	pacer := pulsecnc.NewPacer(reqorg.Pacing, n)
 	rchan := make(chan *pulse.CombinedResult, n)
+	results := make(chan *pulse.CombinedResult, n)
 	var originalargs pulse.DNSRequest
 	if reqorg.Type == pulse.TypeDNS {
 		args, ok := reqorg.Args.(pulse.DNSRequest)
@@ -412,18 +688,18 @@ func (tracker *Tracker) Runner(reqorg *pulse.CombinedRequest) []*pulse.CombinedR
 		}
 	}
 	for ip, worker := range tmpworker {
-		go func(worker *Worker, ip string) {
+		go func(worker *workerSnapshot, ip string) {
 			//Clone the request to avoid pointer mixup when issuing concurrent rpc calls
 			req := reqorg.Clone()
-			log.Println(ip, worker)
+			req.Id = testid
+			log.Println(ip, worker.Name)
 			var reply *pulse.CombinedResult
-			//TODO: Implement timeout
 			//If CombinedRequest is of type TypeDNS and taget is not specified... then insert defaults for worker...
 			if req.Type == pulse.TypeDNS {
 				args, ok := req.Args.(pulse.DNSRequest)
 				if ok {
 					if len(originalargs.Targets) == 0 {
-						args.Targets = []string{"8.8.8.8:53", "208.67.222.222:53"}
+						args.Targets = append([]string(nil), conf().DefaultResolvers...)
 						for _, resolver := range worker.Resolvers {
 							if resolver != "" {
 								args.Targets = append(args.Targets, resolver+":53")
@@ -433,53 +709,243 @@ func (tracker *Tracker) Runner(reqorg *pulse.CombinedRequest) []*pulse.CombinedR
 					}
 				}
 			}
-			call := worker.Client.Go("Resolver.Combined", req, &reply, nil)
+			if reason := worker.Capabilities.Unsupported(req); reason != "" {
+				//Would only come back as an error, don't bother the agent
+				agentTests.Inc(testtype, "unsupported")
+				reply = &pulse.CombinedResult{
+					Type:        req.Type,
+					CompletedAt: time.Now(),
+					Err:         "unsupported: " + reason,
+					Unsupported: true,
+					Version:     worker.Version,
+				}
+				fillresult(reply, ip, worker)
+				rchan <- reply
+				return
+			}
+			offset, err := pacer.Wait(ctx)
+			if err != nil {
+				//Given up before its turn came
+				agentTests.Inc(testtype, "cancelled")
+				rchan <- nil
+				return
+			}
+			defer pacer.Done()
+			sent := time.Now()
+			call := worker.worker.Client.Go("Resolver.Combined", req, &reply, nil)
 			select {
 			case replyCall := <-call.Done:
 				log.Println(ip)
 				if replyCall.Error == rpc.ErrShutdown {
-					go tracker.UnRegister(worker) //Async cause of locking
+					go tracker.UnRegister(worker.worker, "connection closed") //Async cause of locking
 					log.Println("Unregistering from tracker")
+					agentTests.Inc(testtype, "disconnected")
+					unanswered.Inc(worker.Name)
 					rchan <- nil
 				} else if replyCall.Error != nil {
 					log.Println(replyCall.Error)
+					agentTests.Inc(testtype, "error")
 					rchan <- nil
 				} else {
-					//reply.Name += " (" + strings.Split(ip, ":")[0] + ")"
-					iponly := strings.Split(ip, ":")[0]
-					splitted := strings.Split(iponly, ".")
-					splitted[3] = "0"
-					reply.Agent = strings.Join(splitted, ".")
-					reply.Name = worker.Name //Insert in this workers Common Name here
-					reply.ASN = worker.ASN
-					reply.ASName = worker.ASName
-					reply.City = worker.City
-					reply.State = worker.State
-					reply.Country = worker.Country
-					reply.Id = worker.Serial
+					if reply.Busy {
+						agentTests.Inc(testtype, "busy")
+					} else {
+						agentTests.Inc(testtype, "ok")
+					}
+					agentTestDuration.Observe(time.Since(sent).Seconds(), testtype)
+					fillresult(reply, ip, worker)
+					reply.StartOffset = offset
+					tracker.workerlock.Lock()
+					worker.worker.Version = reply.Version
+					tracker.workerlock.Unlock()
 					//log.Println(reply.Name)
+					enrichresult(reply)
 					rchan <- reply
 				}
 				return
-			case <-time.After(time.Minute):
-				go tracker.UnRegister(worker) //Nuke the turtle...
+			case <-time.After(testwait(worker, req)):
+				go tracker.UnRegister(worker.worker, "test timeout") //Nuke the turtle...
+				agentTests.Inc(testtype, "timeout")
+				unanswered.Inc(worker.Name)
+				rchan <- nil
+				return
+			case <-ctx.Done():
+				//Nobody is waiting for this result anymore, stop the agent too
+				go cancelworker(worker.worker, worker.Name, req.Id)
+				agentTests.Inc(testtype, "cancelled")
 				rchan <- nil
 				return
 			}
 		}(worker, ip)
 	}
 
-	for i := 0; i < n; i++ {
-		log.Println(i, "of", n)
-		reply := <-rchan
-		if reply != nil {
-			log.Println(reply.Name)
-			results = append(results, reply)
+	go func() {
+		defer close(results)
+		defer func() {
+			runDuration.Observe(time.Since(started).Seconds(), testtype)
+		}()
+		for i := 0; i < n; i++ {
+			log.Println(i, "of", n)
+			reply := <-rchan
+			if reply != nil {
+				log.Println(reply.Name)
+				results <- reply
+			}
+		}
+	}()
+	return results, n
+}
+
+// testGrace is how long past its total timeout a test may take to come back.
+const testGrace = time.Second * 10
+
+// testwait answers how long to wait for worker to answer req. Agents that
+// honor the total timeout of a request get that and testGrace, others the
+// configured test timeout.
+func testwait(worker *workerSnapshot, req *pulse.CombinedRequest) time.Duration {
+	if worker.Capabilities != nil && worker.Capabilities.Timeouts && req.Timeouts != nil && req.Timeouts.Total != 0 {
+		return req.Timeouts.Total + testGrace
+	}
+	return time.Duration(conf().TestTimeout)
+}
+
+// fillresult adds what the CNC knows about worker, connected from ip, to its result.
+func fillresult(reply *pulse.CombinedResult, ip string, worker *workerSnapshot) {
+	//reply.Name += " (" + strings.Split(ip, ":")[0] + ")"
+	iponly := strings.Split(ip, ":")[0]
+	splitted := strings.Split(iponly, ".")
+	splitted[3] = "0"
+	reply.Agent = strings.Join(splitted, ".")
+	reply.Name = worker.Name //Insert in this workers Common Name here
+	reply.ASN = worker.ASN
+	reply.ASName = worker.ASName
+	reply.City = worker.City
+	reply.State = worker.State
+	reply.Country = worker.Country
+	reply.Id = worker.Serial
+}
+
+// selectworkers answers snapshots of the connected workers in filter, or all
+// of them when filter is empty, narrowed down by selector. Keyed by address.
+func (tracker *Tracker) selectworkers(filter []*big.Int, selector string) map[string]*workerSnapshot {
+	sel, err := pulsecnc.ParseSelector(selector)
+	if err != nil {
+		//Requests are validated when parsed, so this should not happen
+		log.Println("selector", err)
+		return make(map[string]*workerSnapshot)
+	}
+	tracker.workerlock.RLock()
+	defer tracker.workerlock.RUnlock()
+	candidates := make([]*pulsecnc.SelectableAgent, 0, len(tracker.workers))
+	for ip, worker := range tracker.workers {
+		if len(filter) == 0 || slicecontainsbigint(worker.Serial, filter) {
+			candidates = append(candidates, selectable(ip, worker))
 		}
 	}
+	var tmpworker = make(map[string]*workerSnapshot)
+	for _, ip := range sel.Select(candidates, nil) {
+		tmpworker[ip] = snapshot(tracker.workers[ip])
+	}
+	return tmpworker
+}
+
+// workerSnapshot is what a run needs of a worker. It is copied while
+// holding the workerlock, so a run does not race with updates to the worker.
+type workerSnapshot struct {
+	worker       *Worker //For its Client and to unregister it, don't read its other fields
+	Name         string
+	ASN          *string
+	ASName       *string
+	City         string
+	State        string
+	Country      string
+	Serial       *big.Int
+	Resolvers    []string
+	Capabilities *pulse.Capabilities //Set before the worker is registered, never changed
+	Version      string
+}
+
+// snapshot copies what a run needs of w, the caller holds the workerlock.
+func snapshot(w *Worker) *workerSnapshot {
+	return &workerSnapshot{
+		worker:       w,
+		Name:         w.Name,
+		ASN:          w.ASN,
+		ASName:       w.ASName,
+		City:         w.City,
+		State:        w.State,
+		Country:      w.Country,
+		Serial:       w.Serial,
+		Resolvers:    append([]string(nil), w.Resolvers...),
+		Capabilities: w.Capabilities,
+		Version:      w.Version,
+	}
+}
+
+// selectable describes worker, connected from ip, to a selector.
+func selectable(ip string, worker *Worker) *pulsecnc.SelectableAgent {
+	a := &pulsecnc.SelectableAgent{
+		Key:      ip,
+		Name:     worker.Name,
+		Country:  worker.Country,
+		State:    worker.State,
+		City:     worker.City,
+		HostType: worker.HostType,
+		Version:  worker.Version,
+		Labels:   worker.Labels,
+	}
+	if worker.Serial != nil {
+		a.Serial = worker.Serial.String()
+	}
+	if worker.ASN != nil {
+		a.ASN = *worker.ASN
+	}
+	return a
+}
+
+// Count answers how many workers reqorg would be sent to.
+func (tracker *Tracker) Count(reqorg *pulse.CombinedRequest) int {
+	return len(tracker.selectworkers(reqorg.AgentFilter, reqorg.Selector))
+}
+
+// Runner sends reqorg to all selected workers and waits for all of them,
+// or until ctx is done. Workers still running are then told to stop.
+func (tracker *Tracker) Runner(ctx context.Context, reqorg *pulse.CombinedRequest) []*pulse.CombinedResult {
+	rchan, _ := tracker.Start(ctx, reqorg)
+	results := make([]*pulse.CombinedResult, 0)
+	for reply := range rchan {
+		results = append(results, reply)
+	}
 	return results
 }
 
+// enrichresult adds CNC side information to a result as it comes in from a worker.
+// DNS answers get parsed and their servers ASN looked up, mtr hops get ASN and
+// are summarized.
+func enrichresult(res *pulse.CombinedResult) {
+	switch res.Type {
+	case pulse.TypeDNS:
+		result, _ := res.Result.(pulse.DNSResult)
+		for j, item := range result.Results {
+			item.ASN, item.ASName = lookupAsn(item.Server)
+			msg := &dns.Msg{}
+			msg.Unpack(item.Raw)
+			item.Formated = msg.String()
+			item.Msg = msg
+			result.Results[j] = item
+		}
+		res.Result = result
+	case pulse.TypeMTR:
+		result, _ := res.Result.(pulse.MtrResult)
+		if result.Result != nil && result.Err == "" {
+			for _, hop := range result.Result.Hops {
+				ResolveASNMtr(hop)
+			}
+			result.Result.Summarize(10)
+		}
+	}
+}
+
 var tracker *Tracker
 
 //https://gist.github.com/the42/1956518
@@ -493,228 +959,1226 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Flush sends whatever is compressed so far to the client, for streaming responses.
+func (w gzipResponseWriter) Flush() {
+	if gz, ok := w.Writer.(*gzip.Writer); ok {
+		gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func makeGzipHandler(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if strings.Contains(r.Header.Get("Origin"), "https://my.turbobytes.com") {
-			w.Header().Set("Access-Control-Allow-Origin", "https://my.turbobytes.com")
-			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
+		if origin := r.Header.Get("Origin"); origin != "" && conf().AllowsOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, PATCH, DELETE, OPTIONS")
 			w.Header().Set("Access-Control-Max-Age", "3600")
-			w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+			w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, X-API-Key")
 		}
-		if strings.Contains(r.Header.Get("Origin"), "http://127.0.0.1:8000") {
-			w.Header().Set("Access-Control-Allow-Origin", "http://127.0.0.1:8000")
-			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-			w.Header().Set("Access-Control-Max-Age", "3600")
-			w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+		if r.Method == "OPTIONS" {
+			switch {
+			default:
+				// default OPTIONS method handling
+				return
+			case strings.Index(r.URL.Path, asndbEndpoint) == 0:
+				// Let asndb handler deal with OPTIONS
+			case strings.Index(r.URL.Path, asnlookupEndpoint) == 0:
+				// Let asnlookup handler deal with OPTIONS
+			case strings.Index(r.URL.Path, agentsEndpoint) == 0:
+				// Let agents handler deal with OPTIONS
+			case strings.Index(r.URL.Path, jobsEndpoint) == 0:
+				// Let jobs handler deal with OPTIONS
+			case strings.Index(r.URL.Path, schedulesEndpoint) == 0:
+				// Let schedules handler deal with OPTIONS
+			case strings.Index(r.URL.Path, alertsEndpoint) == 0:
+				// Let alerts handler deal with OPTIONS
+			case strings.Index(r.URL.Path, runsEndpoint) == 0:
+				// Let runs handler deal with OPTIONS
+			case strings.Index(r.URL.Path, eventsEndpoint) == 0:
+				// Let events handler deal with OPTIONS
+			case strings.Index(r.URL.Path, revocationsEndpoint) == 0:
+				// Let revocations handler deal with OPTIONS
+			case strings.Index(r.URL.Path, enrollEndpoint) == 0:
+				// Let enroll handler deal with OPTIONS
+			case strings.Index(r.URL.Path, enrollmentsEndpoint) == 0:
+				// Let enrollments handler deal with OPTIONS
+			}
+		}
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			fn(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		gzr := gzipResponseWriter{Writer: gz, ResponseWriter: w}
+		fn(gzr, r)
+	}
+}
+
+// apiKeyContext is the request context key holding the *pulsecnc.APIKey of the caller.
+type apiKeyContext struct{}
+
+// authorize wraps fn so that GET and HEAD need readRole and other methods
+// need writeRole. OPTIONS is left alone for CORS preflight requests.
+func authorize(readRole, writeRole string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth == nil || r.Method == http.MethodOptions {
+			fn(w, r)
+			return
+		}
+		key, err := auth.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pulse"`)
+			httpStatus(w, http.StatusUnauthorized, err)
+			return
+		}
+		role := writeRole
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			role = readRole
+		}
+		if !key.Allows(role) {
+			httpStatus(w, http.StatusForbidden, fmt.Errorf("key %q needs the %s role", key.Name, role))
+			return
+		}
+		fn(w, r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key)))
+	}
+}
+
+// chargeTest checks creq against the quotas of the key r was made with.
+// When over quota it sends 403 (too many agents) or 429 (too many tests)
+// and answers false.
+func chargeTest(w http.ResponseWriter, r *http.Request, creq *pulse.CombinedRequest) bool {
+	key, _ := r.Context().Value(apiKeyContext{}).(*pulsecnc.APIKey)
+	if auth == nil || key == nil {
+		return true
+	}
+	err := auth.Charge(key, tracker.Count(creq))
+	if qe, ok := err.(*pulsecnc.QuotaError); ok {
+		if qe.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(qe.RetryAfter.Seconds())+1))
+			httpStatus(w, http.StatusTooManyRequests, err)
+		} else {
+			httpStatus(w, http.StatusForbidden, err)
+		}
+		return false
+	}
+	return true
+}
+
+// parsecurl reads a CurlRequest from json.
+func parsecurl(data []byte) (*pulse.CombinedRequest, error) {
+	req := &pulse.CurlRequest{}
+	err := json.Unmarshal(data, req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pulsecnc.ParseSelector(req.Selector); err != nil {
+		return nil, err
+	}
+	if err := req.Timeouts.Validate(); err != nil {
+		return nil, err
+	}
+	if err := req.Pacing.Validate(); err != nil {
+		return nil, err
+	}
+	log.Println(req)
+	return &pulse.CombinedRequest{
+		Type:        pulse.TypeCurl,
+		Args:        req,
+		RequestedAt: time.Now(),
+		AgentFilter: req.AgentFilter,
+		Selector:    req.Selector,
+		Timeouts:    req.Timeouts,
+		Pacing:      req.Pacing,
+	}, nil
+}
+
+func runcurl(w http.ResponseWriter, r *http.Request) {
+	serverun(w, r, parsecurl)
+}
+
+// serverun reads a test from the request body using parse, runs it and
+// answers the results. Results are streamed as they come in if the client
+// asked for it, otherwise they are sent all at once when every agent answered.
+func serverun(w http.ResponseWriter, r *http.Request, parse func([]byte) (*pulse.CombinedRequest, error)) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Println(string(data))
+	creq, err := parse(data)
+	if err != nil {
+		log.Println(err)
+		httpBadRequest(w, err)
+		return
+	}
+	if !chargeTest(w, r, creq) {
+		return
+	}
+	if format := pulsecnc.StreamFormat(r); format != "" {
+		streamrun(w, r, creq, format)
+		return
+	}
+	results := tracker.Runner(r.Context(), creq)
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		log.Println(err)
+		log.Fatal(err)
+	}
+	w.Header().Set(runIdHeader, recordRun(creq, results))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// streamrun runs creq, writing each result as soon as it arrives
+// and a summary once the run is over. The run stops when the client goes.
+func streamrun(w http.ResponseWriter, r *http.Request, creq *pulse.CombinedRequest, format string) {
+	rchan, n := tracker.Start(r.Context(), creq)
+	//Headers go out with the first result, so pick the run id upfront
+	runid := pulsecnc.NewRunID()
+	w.Header().Set(runIdHeader, runid)
+	stream := pulsecnc.NewStreamWriter(w, format)
+	results := make([]*pulse.CombinedResult, 0, n)
+	for res := range rchan {
+		results = append(results, res)
+		err := stream.Write("result", res)
+		if err != nil {
+			log.Printf("error: failed to stream result: %s", err)
+		}
+	}
+	saveRun(pulsecnc.NewRun(creq, results, creq.RequestedAt), runid)
+	err := stream.WriteSummary(pulsecnc.NewStreamSummary(runid, n, len(results), creq.RequestedAt))
+	if err != nil {
+		log.Printf("error: failed to stream summary: %s", err)
+	}
+}
+
+func agentshandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	splitted := strings.Split(r.URL.Path, "/")
+	if len(splitted) == 4 || (len(splitted) == 3 && splitted[2] != "") {
+		// url: /agents/<id>/ or /agents/<id>
+		agentid := splitted[2]
+		allowedMethods := []string{http.MethodOptions, http.MethodGet, http.MethodPut, http.MethodPatch, http.MethodDelete}
+		switch r.Method {
+		case http.MethodOptions:
+			httpSetAllowHeader(w, allowedMethods)
+		case http.MethodGet:
+			agentsSend(w, agentid)
+		case http.MethodPut:
+			edit := new(pulsecnc.AgentEdit)
+			agentsEdit(w, r, agentid, edit, edit.Apply)
+		case http.MethodPatch:
+			patch := new(pulsecnc.AgentPatch)
+			agentsEdit(w, r, agentid, patch, patch.Apply)
+		case http.MethodDelete:
+			agentsDelete(w, agentid)
+		default:
+			httpMethodNotAllowed(w, allowedMethods)
+		}
+	} else {
+		// url: /agents/
+		allowedMethods := []string{http.MethodOptions, http.MethodGet}
+		switch r.Method {
+		case http.MethodOptions:
+			httpSetAllowHeader(w, allowedMethods)
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(tracker.WorkerJson())
+		default:
+			httpMethodNotAllowed(w, allowedMethods)
+		}
+	}
+}
+
+// agentsSend answers a connected agent, or what is stored about it when offline.
+func agentsSend(w http.ResponseWriter, agentid string) {
+	w.Header().Set("Content-Type", "application/json")
+	b, err := tracker.SingleWorkerJson(agentid)
+	if err != nil {
+		log.Println(err)
+		wrk := new(Worker)
+		wrk.Serial = new(big.Int)
+		wrk.Serial.SetString(agentid, 10)
+		populatedata(wrk, false)
+		if wrk.Name == "" {
+			w.WriteHeader(404)
+			return
+		} else {
+			b, err = json.MarshalIndent(wrk, "", "  ")
+		}
+	}
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	} else {
+		w.Write(b)
+	}
+}
+
+// agentsEdit decodes body from the request, changes the stored metadata of
+// agent agentid with apply and pushes it to the agent if it is connected.
+func agentsEdit(w http.ResponseWriter, r *http.Request, agentid string, body interface{}, apply func(*pulsecnc.AgentInfo) error) {
+	serial, ok := new(big.Int).SetString(agentid, 10)
+	if !ok {
+		httpNotFound(w)
+		return
+	}
+	agent, err := agents.Get(serial)
+	if err == pulsecnc.ErrAgentNotFound {
+		httpNotFound(w)
+		return
+	} else if err != nil {
+		httpInternalServerError(w, err)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		httpBadRequest(w, errors.New("malformed content: "+err.Error()))
+		return
+	}
+	if err := apply(agent); err != nil {
+		httpBadRequest(w, err)
+		return
+	}
+	err = agents.Update(agent)
+	if err == pulsecnc.ErrAgentNotFound {
+		httpNotFound(w)
+		return
+	} else if err != nil {
+		httpInternalServerError(w, err)
+		return
+	}
+	tracker.Refresh(agent)
+	agentsSend(w, agentid)
+}
+
+// agentsDelete decommissions agent agentid. It is revoked so it stays out,
+// forgotten, and dropped if connected.
+func agentsDelete(w http.ResponseWriter, agentid string) {
+	serial, ok := new(big.Int).SetString(agentid, 10)
+	if !ok {
+		httpNotFound(w)
+		return
+	}
+	_, err := agents.Get(serial)
+	if err == pulsecnc.ErrAgentNotFound {
+		httpNotFound(w)
+		return
+	} else if err != nil {
+		httpInternalServerError(w, err)
+		return
+	}
+	//Revoked first, otherwise it would come back as a new agent when it reconnects
+	if _, err := revocations.Revoke(serial, "decommissioned"); err != nil {
+		httpInternalServerError(w, err)
+		return
+	}
+	err = agents.Delete(serial)
+	if err != nil && err != pulsecnc.ErrAgentNotFound {
+		httpInternalServerError(w, err)
+		return
+	}
+	tracker.Disconnect(serial, "decommissioned")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getasnmtr(ip string) string {
+	asn, _, err := LookupAsn(ip)
+	if err != nil {
+		log.Printf("warning: asn lookup error for %s: %s\n", ip, err)
+		return ""
+	}
+	return asn
+}
+
+func repopulatehandler(w http.ResponseWriter, r *http.Request) {
+	//w.Header().Set("Content-Type", "application/json")
+	tracker.Repopulate()
+	w.Write([]byte("DONE"))
+}
+
+func ResolveASNMtr(hop *mtrparser.MtrHop) {
+	hop.ASN = make([]string, len(hop.IP))
+	for idx, ip := range hop.IP {
+		//TODO...
+		hop.ASN[idx] = getasnmtr(ip)
+	}
+}
+
+// parsemtr reads a MtrRequest from json.
+func parsemtr(data []byte) (*pulse.CombinedRequest, error) {
+	req := pulse.MtrRequest{}
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pulsecnc.ParseSelector(req.Selector); err != nil {
+		return nil, err
+	}
+	if err := req.Timeouts.Validate(); err != nil {
+		return nil, err
+	}
+	if err := req.Pacing.Validate(); err != nil {
+		return nil, err
+	}
+	log.Println(req)
+	return &pulse.CombinedRequest{
+		Type:        pulse.TypeMTR,
+		Args:        req,
+		RequestedAt: time.Now(),
+		AgentFilter: req.AgentFilter,
+		Selector:    req.Selector,
+		Timeouts:    req.Timeouts,
+		Pacing:      req.Pacing,
+	}, nil
+}
+
+func runmtr(w http.ResponseWriter, r *http.Request) {
+	serverun(w, r, parsemtr)
+}
+
+// parsedns reads a DNSRequest from json, making the host a FQDN
+// and adding the port to target nameservers.
+func parsedns(data []byte) (*pulse.CombinedRequest, error) {
+	req := pulse.DNSRequest{}
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pulsecnc.ParseSelector(req.Selector); err != nil {
+		return nil, err
+	}
+	if err := req.Timeouts.Validate(); err != nil {
+		return nil, err
+	}
+	if err := req.Pacing.Validate(); err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(req.Host, ".") {
+		//Make FQDN
+		req.Host = req.Host + "."
+	}
+	if req.Targets != nil {
+		if len(req.Targets) > 0 {
+			for i, t := range req.Targets {
+				req.Targets[i] = t + ":53"
+			}
+		}
+	}
+	log.Println(req)
+	return &pulse.CombinedRequest{
+		Type:        pulse.TypeDNS,
+		Args:        req,
+		RequestedAt: time.Now(),
+		AgentFilter: req.AgentFilter,
+		Selector:    req.Selector,
+		Timeouts:    req.Timeouts,
+		Pacing:      req.Pacing,
+	}, nil
+}
+
+func runtest(w http.ResponseWriter, r *http.Request) {
+	serverun(w, r, parsedns)
+}
+
+// parsetest reads a test request of the given type from json.
+func parsetest(testtype int, data []byte) (*pulse.CombinedRequest, error) {
+	switch testtype {
+	case pulse.TypeDNS:
+		return parsedns(data)
+	case pulse.TypeMTR:
+		return parsemtr(data)
+	case pulse.TypeCurl:
+		return parsecurl(data)
+	}
+	return nil, fmt.Errorf("unknown test type: %d", testtype)
+}
+
+// runIdHeader carries the history id of a run in test responses.
+const runIdHeader = "X-Pulse-Run-Id"
+
+// recordRun stores a completed run in history and answers its id.
+func recordRun(req *pulse.CombinedRequest, results []*pulse.CombinedResult) string {
+	run := pulsecnc.NewRun(req, results, req.RequestedAt)
+	saveRun(run, run.Id)
+	return run.Id
+}
+
+// saveRun stores run in history under id.
+func saveRun(run *pulsecnc.Run, id string) {
+	run.Id = id
+	err := history.Save(run)
+	if err != nil {
+		log.Printf("error: failed to save run %s: %s", run.Id, err)
+	}
+}
+
+// pruneHistory periodically drops runs that fall out of retention.
+func pruneHistory() {
+	for range time.Tick(time.Minute) {
+		removed, err := history.Prune(conf().Retention())
+		if err != nil {
+			log.Printf("error: failed to prune history: %s", err)
+		} else if removed > 0 {
+			log.Printf("pruned %d runs from history", removed)
+		}
+	}
+}
+
+// runsHandler manages the runs http endpoint
+func runsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	args := strings.Split(r.URL.Path, "/")
+	allowedMethods := []string{http.MethodOptions, http.MethodGet}
+	switch len(args) {
+	case 0, 1, 2:
+		// url: <nil> or '/' or '/runs'
+		// this should never happen with http.HandleFunc()
+		httpInternalServerError(w, errors.New("unexpected runs url"))
+	case 3:
+		switch r.Method {
+		case http.MethodOptions:
+			httpSetAllowHeader(w, allowedMethods)
+		case http.MethodGet:
+			if args[2] == "" {
+				// url: /runs/
+				runsList(w, r)
+			} else {
+				// url: /runs/<id>
+				runsGet(w, args[2])
+			}
+		default:
+			httpMethodNotAllowed(w, allowedMethods)
+		}
+	default:
+		httpBadRequest(w, errors.New("Too many arguments"))
+	}
+}
+
+// runsList answers runs matching the query string filters.
+func runsList(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseRunFilter(r)
+	if err != nil {
+		httpBadRequest(w, err)
+		return
+	}
+	runs, err := history.List(filter)
+	if err != nil {
+		httpInternalServerError(w, err)
+		return
+	}
+	err = httpSendJson(w, runs)
+	if err != nil {
+		log.Printf("error: failed to send runs list: %s", err)
+	}
+}
+
+// runsGet answers a single run with all its results.
+func runsGet(w http.ResponseWriter, id string) {
+	run, err := history.Get(id)
+	if err == pulsecnc.ErrRunNotFound {
+		httpNotFound(w)
+		return
+	}
+	if err != nil {
+		httpInternalServerError(w, err)
+		return
+	}
+	err = httpSendJson(w, run)
+	if err != nil {
+		log.Printf("error: failed to send run: %s", err)
+	}
+}
+
+// parseRunFilter reads a pulsecnc.RunFilter from query string parameters :-
+// type (dns, mtr, curl), target, agent (serial), since and until (RFC3339) and limit.
+func parseRunFilter(r *http.Request) (pulsecnc.RunFilter, error) {
+	q := r.URL.Query()
+	filter := pulsecnc.RunFilter{Target: q.Get("target"), Limit: 100}
+	var err error
+	if v := q.Get("type"); v != "" {
+		filter.Type, err = pulsecnc.ParseTestType(v)
+		if err != nil {
+			return filter, err
+		}
+	}
+	if v := q.Get("agent"); v != "" {
+		filter.Agent = new(big.Int)
+		if _, ok := filter.Agent.SetString(v, 10); !ok {
+			return filter, errors.New("malformed agent serial")
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		filter.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, errors.New("malformed since: " + err.Error())
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		filter.Until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return filter, errors.New("malformed until: " + err.Error())
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit < 0 {
+			return filter, errors.New("malformed limit")
+		}
+	}
+	return filter, nil
+}
+
+// eventsHandler streams agent events to the client until it goes away.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	allowedMethods := []string{http.MethodOptions, http.MethodGet}
+	switch r.Method {
+	case http.MethodOptions:
+		httpSetAllowHeader(w, allowedMethods)
+		return
+	case http.MethodGet:
+	default:
+		httpMethodNotAllowed(w, allowedMethods)
+		return
+	}
+	format := pulsecnc.StreamFormat(r)
+	if format == "" {
+		format = pulsecnc.StreamSSE
+	}
+	ch, unsubscribe := events.Subscribe(100)
+	defer unsubscribe()
+	stream := pulsecnc.NewStreamWriter(w, format)
+	stream.KeepAlive() //Get headers out so clients know they are connected
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case ev := <-ch:
+			err = stream.Write(ev.Type, ev)
+		case <-ticker.C:
+			err = stream.KeepAlive()
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// JobRequest is what clients POST to /jobs/.
+type JobRequest struct {
+	Type string          //dns, mtr or curl
+	Args json.RawMessage //Same payload as the synchronous endpoint of that type
+}
+
+// jobsHandler manages the jobs http endpoint
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	args := strings.Split(r.URL.Path, "/")
+	switch len(args) {
+	case 0, 1, 2:
+		// url: <nil> or '/' or '/jobs'
+		// this should never happen with http.HandleFunc()
+		httpInternalServerError(w, errors.New("unexpected jobs url"))
+	case 3:
+		id := args[2]
+		if id == "" {
+			// url: /jobs/
+			allowedMethods := []string{http.MethodOptions, http.MethodPost}
+			switch r.Method {
+			case http.MethodOptions:
+				httpSetAllowHeader(w, allowedMethods)
+			case http.MethodPost:
+				jobsPost(w, r)
+			default:
+				httpMethodNotAllowed(w, allowedMethods)
+			}
+		} else {
+			// url: /jobs/<id>
+			allowedMethods := []string{http.MethodOptions, http.MethodGet, http.MethodDelete}
+			switch r.Method {
+			case http.MethodOptions:
+				httpSetAllowHeader(w, allowedMethods)
+			case http.MethodGet:
+				jobsGet(w, id)
+			case http.MethodDelete:
+				jobsDelete(w, id)
+			default:
+				httpMethodNotAllowed(w, allowedMethods)
+			}
+		}
+	default:
+		httpBadRequest(w, errors.New("Too many arguments"))
+	}
+}
+
+// jobsPost starts a new job and answers it right away.
+func jobsPost(w http.ResponseWriter, r *http.Request) {
+	var jreq JobRequest
+	err := json.NewDecoder(r.Body).Decode(&jreq)
+	if err != nil {
+		httpBadRequest(w, errors.New("malformed content: "+err.Error()))
+		return
+	}
+	testtype, err := pulsecnc.ParseTestType(jreq.Type)
+	if err != nil {
+		httpBadRequest(w, err)
+		return
+	}
+	creq, err := parsetest(testtype, jreq.Args)
+	if err != nil {
+		httpBadRequest(w, errors.New("malformed args: "+err.Error()))
+		return
+	}
+	if !chargeTest(w, r, creq) {
+		return
+	}
+	job := jobs.Submit(creq)
+	w.Header().Set("Location", "/jobs/"+job.Id)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.Snapshot())
+}
+
+// jobsGet answers a job with the results received so far.
+func jobsGet(w http.ResponseWriter, id string) {
+	job, err := jobs.Get(id)
+	if err == pulsecnc.ErrJobNotFound {
+		httpNotFound(w)
+		return
+	}
+	err = httpSendJson(w, job.Snapshot())
+	if err != nil {
+		log.Printf("error: failed to send job: %s", err)
+	}
+}
+
+// jobsDelete cancels a job, answering it with the results received so far.
+func jobsDelete(w http.ResponseWriter, id string) {
+	job, err := jobs.Cancel(id)
+	if err == pulsecnc.ErrJobNotFound {
+		httpNotFound(w)
+		return
+	}
+	httpSendJson(w, job.Snapshot())
+}
+
+// testRunner runs scheduled tests through the tracker.
+type testRunner struct{}
+
+func (testRunner) Parse(testtype string, args json.RawMessage) (*pulse.CombinedRequest, error) {
+	typ, err := pulsecnc.ParseTestType(testtype)
+	if err != nil {
+		return nil, err
+	}
+	return parsetest(typ, args)
+}
+
+func (testRunner) Run(req *pulse.CombinedRequest) string {
+	return recordRun(req, tracker.Runner(context.Background(), req))
+}
+
+// schedulesHandler manages the schedules http endpoint
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	args := strings.Split(r.URL.Path, "/")
+	switch len(args) {
+	case 0, 1, 2:
+		// url: <nil> or '/' or '/schedules'
+		// this should never happen with http.HandleFunc()
+		httpInternalServerError(w, errors.New("unexpected schedules url"))
+	case 3:
+		id := args[2]
+		if id == "" {
+			// url: /schedules/
+			allowedMethods := []string{http.MethodOptions, http.MethodGet, http.MethodPost}
+			switch r.Method {
+			case http.MethodOptions:
+				httpSetAllowHeader(w, allowedMethods)
+			case http.MethodGet:
+				httpSendJson(w, scheduler.List())
+			case http.MethodPost:
+				schedulesPost(w, r)
+			default:
+				httpMethodNotAllowed(w, allowedMethods)
+			}
+		} else {
+			// url: /schedules/<id>
+			allowedMethods := []string{http.MethodOptions, http.MethodGet, http.MethodPut, http.MethodDelete}
+			switch r.Method {
+			case http.MethodOptions:
+				httpSetAllowHeader(w, allowedMethods)
+			case http.MethodGet:
+				sch, err := scheduler.Get(id)
+				schedulesSend(w, sch, err)
+			case http.MethodPut:
+				schedulesPut(w, r, id)
+			case http.MethodDelete:
+				err := scheduler.Delete(id)
+				if err == pulsecnc.ErrScheduleNotFound {
+					httpNotFound(w)
+				} else if err != nil {
+					httpInternalServerError(w, err)
+				} else {
+					w.WriteHeader(http.StatusNoContent)
+				}
+			default:
+				httpMethodNotAllowed(w, allowedMethods)
+			}
+		}
+	case 4:
+		// url: /schedules/<id>/pause or /schedules/<id>/resume
+		allowedMethods := []string{http.MethodOptions, http.MethodPost}
+		switch r.Method {
+		case http.MethodOptions:
+			httpSetAllowHeader(w, allowedMethods)
+		case http.MethodPost:
+			switch args[3] {
+			case "pause":
+				sch, err := scheduler.SetPaused(args[2], true)
+				schedulesSend(w, sch, err)
+			case "resume":
+				sch, err := scheduler.SetPaused(args[2], false)
+				schedulesSend(w, sch, err)
+			default:
+				httpNotFound(w)
+			}
+		default:
+			httpMethodNotAllowed(w, allowedMethods)
+		}
+	default:
+		httpBadRequest(w, errors.New("Too many arguments"))
+	}
+}
+
+// schedulesPost creates a schedule.
+func schedulesPost(w http.ResponseWriter, r *http.Request) {
+	var def pulsecnc.Schedule
+	err := json.NewDecoder(r.Body).Decode(&def)
+	if err != nil {
+		httpBadRequest(w, errors.New("malformed content: "+err.Error()))
+		return
+	}
+	sch, err := scheduler.Create(&def)
+	if err != nil {
+		httpBadRequest(w, err)
+		return
+	}
+	w.Header().Set("Location", "/schedules/"+sch.Id)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sch)
+}
+
+// schedulesPut replaces the definition of a schedule.
+func schedulesPut(w http.ResponseWriter, r *http.Request, id string) {
+	var def pulsecnc.Schedule
+	err := json.NewDecoder(r.Body).Decode(&def)
+	if err != nil {
+		httpBadRequest(w, errors.New("malformed content: "+err.Error()))
+		return
+	}
+	if _, err := scheduler.Get(id); err == pulsecnc.ErrScheduleNotFound {
+		httpNotFound(w)
+		return
+	}
+	sch, err := scheduler.Update(id, &def)
+	if err == pulsecnc.ErrScheduleNotFound {
+		httpNotFound(w)
+		return
+	}
+	if err != nil {
+		httpBadRequest(w, err)
+		return
+	}
+	httpSendJson(w, sch)
+}
+
+// schedulesSend answers a schedule returned by the scheduler.
+func schedulesSend(w http.ResponseWriter, sch *pulsecnc.Schedule, err error) {
+	if err == pulsecnc.ErrScheduleNotFound {
+		httpNotFound(w)
+		return
+	}
+	if err != nil {
+		httpInternalServerError(w, err)
+		return
+	}
+	err = httpSendJson(w, sch)
+	if err != nil {
+		log.Printf("error: failed to send schedule: %s", err)
+	}
+}
+
+// revocationsHandler manages the certificates agents may no longer connect with.
+func revocationsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	args := strings.Split(r.URL.Path, "/")
+	if len(args) != 3 {
+		httpNotFound(w)
+		return
+	}
+	id := args[2]
+	if id == "" {
+		// url: /revocations/
+		allowedMethods := []string{http.MethodOptions, http.MethodGet, http.MethodPost}
+		switch r.Method {
+		case http.MethodOptions:
+			httpSetAllowHeader(w, allowedMethods)
+		case http.MethodGet:
+			httpSendJson(w, revocations.List())
+		case http.MethodPost:
+			revocationsPost(w, r)
+		default:
+			httpMethodNotAllowed(w, allowedMethods)
+		}
+		return
+	}
+	// url: /revocations/<serial>
+	serial, ok := new(big.Int).SetString(id, 10)
+	if !ok {
+		httpNotFound(w)
+		return
+	}
+	allowedMethods := []string{http.MethodOptions, http.MethodGet, http.MethodDelete}
+	switch r.Method {
+	case http.MethodOptions:
+		httpSetAllowHeader(w, allowedMethods)
+	case http.MethodGet:
+		rev := revocations.Revoked(serial)
+		if rev == nil {
+			httpNotFound(w)
+			return
+		}
+		httpSendJson(w, rev)
+	case http.MethodDelete:
+		err := revocations.Unrevoke(serial)
+		switch err {
+		case nil:
+			log.Println("certificate", serial, "no longer revoked")
+			w.WriteHeader(http.StatusNoContent)
+		case pulsecnc.ErrNotRevoked:
+			httpNotFound(w)
+		case pulsecnc.ErrCRLListed, pulsecnc.ErrSuperseded:
+			httpStatus(w, http.StatusConflict, err)
+		default:
+			httpInternalServerError(w, err)
+		}
+	default:
+		httpMethodNotAllowed(w, allowedMethods)
+	}
+}
+
+// revocationsPost revokes a certificate and drops the agent using it.
+func revocationsPost(w http.ResponseWriter, r *http.Request) {
+	var def struct {
+		Serial string //Decimal, as in /agents/
+		Reason string
+	}
+	err := json.NewDecoder(r.Body).Decode(&def)
+	if err != nil {
+		httpBadRequest(w, errors.New("malformed content: "+err.Error()))
+		return
+	}
+	serial, ok := new(big.Int).SetString(def.Serial, 10)
+	if !ok {
+		httpBadRequest(w, errors.New("invalid serial number "+def.Serial))
+		return
+	}
+	rev, err := revocations.Revoke(serial, def.Reason)
+	if err != nil {
+		httpBadRequest(w, err)
+		return
+	}
+	log.Println("certificate", serial, "revoked:", def.Reason)
+	tracker.DisconnectRevoked()
+	w.Header().Set("Location", "/revocations/"+rev.Serial)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rev)
+}
+
+// enrollHandler is where minions without a certificate ask for one.
+// Anyone can submit, only admins decide through /enrollments/.
+func enrollHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	args := strings.Split(r.URL.Path, "/")
+	if len(args) != 3 {
+		httpNotFound(w)
+		return
+	}
+	id := args[2]
+	if id == "" {
+		// url: /enroll/
+		allowedMethods := []string{http.MethodOptions, http.MethodPost}
+		switch r.Method {
+		case http.MethodOptions:
+			httpSetAllowHeader(w, allowedMethods)
+		case http.MethodPost:
+			enrollPost(w, r)
+		default:
+			httpMethodNotAllowed(w, allowedMethods)
 		}
-		if r.Method == "OPTIONS" {
-			switch {
-			default:
-				// default OPTIONS method handling
+	} else {
+		// url: /enroll/<id>
+		allowedMethods := []string{http.MethodOptions, http.MethodGet}
+		switch r.Method {
+		case http.MethodOptions:
+			httpSetAllowHeader(w, allowedMethods)
+		case http.MethodGet:
+			en, err := enroller.Get(id)
+			if err != nil {
+				enrollmentsSend(w, nil, err)
 				return
-			case strings.Index(r.URL.Path, asndbEndpoint) == 0:
-				// Let asndb handler deal with OPTIONS
-			case strings.Index(r.URL.Path, asnlookupEndpoint) == 0:
-				// Let asnlookup handler deal with OPTIONS
 			}
+			//Minions only get to see the outcome
+			httpSendJson(w, en.EnrollStatus)
+		default:
+			httpMethodNotAllowed(w, allowedMethods)
 		}
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			fn(w, r)
-			return
-		}
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-		gzr := gzipResponseWriter{Writer: gz, ResponseWriter: w}
-		fn(gzr, r)
 	}
 }
 
-func runcurl(w http.ResponseWriter, r *http.Request) {
-	data, err := ioutil.ReadAll(r.Body)
+// enrollPost records the enrollment of a minion.
+func enrollPost(w http.ResponseWriter, r *http.Request) {
+	var req pulse.EnrollRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req)
 	if err != nil {
-		log.Println(err)
+		httpBadRequest(w, errors.New("malformed content: "+err.Error()))
 		return
 	}
-	log.Println(string(data))
-	req := &pulse.CurlRequest{}
-	err = json.Unmarshal(data, req)
-	if err != nil {
-		log.Println(err)
+	en, err := enroller.Submit(&req, r.RemoteAddr)
+	if err == pulsecnc.ErrTooManyEnrollments {
+		httpStatus(w, http.StatusServiceUnavailable, err)
 		return
 	}
-	log.Println(req)
-	creq := &pulse.CombinedRequest{
-		Type:        pulse.TypeCurl,
-		Args:        req,
-		RequestedAt: time.Now(),
-		AgentFilter: req.AgentFilter,
-	}
-	results := tracker.Runner(creq)
-	b, err := json.MarshalIndent(results, "", "  ")
 	if err != nil {
-		log.Println(err)
-		log.Fatal(err)
+		httpBadRequest(w, err)
+		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(b)
+	log.Println("enrollment", en.Id, "from", r.RemoteAddr, "for", en.Name)
+	w.Header().Set("Location", "/enroll/"+en.Id)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(en.EnrollStatus)
 }
 
-func agentshandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	splitted := strings.Split(r.URL.Path, "/")
-	if len(splitted) == 4 {
-		agentid := splitted[2]
-		b, err := tracker.SingleWorkerJson(agentid)
-		if err != nil {
-			log.Println(err)
-			wrk := new(Worker)
-			wrk.Serial = new(big.Int)
-			wrk.Serial.SetString(agentid, 10)
-			populatedata(wrk, false)
-			if wrk.Name == "" {
-				w.WriteHeader(404)
-				return
+// enrollmentsHandler lets admins review, approve and reject enrollments.
+func enrollmentsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	args := strings.Split(r.URL.Path, "/")
+	switch len(args) {
+	case 0, 1, 2:
+		// url: <nil> or '/' or '/enrollments'
+		// this should never happen with http.HandleFunc()
+		httpInternalServerError(w, errors.New("unexpected enrollments url"))
+	case 3:
+		id := args[2]
+		allowedMethods := []string{http.MethodOptions, http.MethodGet}
+		switch r.Method {
+		case http.MethodOptions:
+			httpSetAllowHeader(w, allowedMethods)
+		case http.MethodGet:
+			if id == "" {
+				// url: /enrollments/?status=pending
+				list, err := enroller.List(r.URL.Query().Get("status"))
+				if err != nil {
+					httpInternalServerError(w, err)
+					return
+				}
+				httpSendJson(w, list)
 			} else {
-				b, err = json.MarshalIndent(wrk, "", "  ")
+				// url: /enrollments/<id>
+				en, err := enroller.Get(id)
+				enrollmentsSend(w, en, err)
 			}
+		default:
+			httpMethodNotAllowed(w, allowedMethods)
 		}
-		if err != nil {
-			w.WriteHeader(404)
-			return
-		} else {
-			w.Write(b)
+	case 4:
+		// url: /enrollments/<id>/approve or /enrollments/<id>/reject
+		allowedMethods := []string{http.MethodOptions, http.MethodPost}
+		switch r.Method {
+		case http.MethodOptions:
+			httpSetAllowHeader(w, allowedMethods)
+		case http.MethodPost:
+			switch args[3] {
+			case "approve":
+				en, err := enroller.Approve(args[2], time.Duration(conf().CertValidity))
+				if err == nil {
+					log.Println("enrollment", en.Id, "approved, agent", en.Serial)
+				}
+				enrollmentsSend(w, en, err)
+			case "reject":
+				var body struct {
+					Reason string
+				}
+				//The body is optional
+				json.NewDecoder(r.Body).Decode(&body)
+				en, err := enroller.Reject(args[2], body.Reason)
+				enrollmentsSend(w, en, err)
+			default:
+				httpNotFound(w)
+			}
+		default:
+			httpMethodNotAllowed(w, allowedMethods)
 		}
-	} else {
-		w.Write(tracker.WorkerJson())
+	default:
+		httpBadRequest(w, errors.New("Too many arguments"))
 	}
 }
 
-func getasnmtr(ip string) string {
-	asn, _, err := LookupAsn(ip)
-	if err != nil {
-		log.Printf("warning: asn lookup error for %s: %s\n", ip, err)
-		return ""
+// enrollmentsSend answers an enrollment returned by the enroller.
+func enrollmentsSend(w http.ResponseWriter, en *pulsecnc.Enrollment, err error) {
+	switch err {
+	case nil:
+		httpSendJson(w, en)
+	case pulsecnc.ErrEnrollmentNotFound:
+		httpNotFound(w)
+	case pulsecnc.ErrEnrollmentDecided:
+		httpStatus(w, http.StatusConflict, err)
+	case pulsecnc.ErrNoCA:
+		httpStatus(w, http.StatusNotImplemented, err)
+	default:
+		httpInternalServerError(w, err)
 	}
-	return asn
-}
-
-func repopulatehandler(w http.ResponseWriter, r *http.Request) {
-	//w.Header().Set("Content-Type", "application/json")
-	tracker.Repopulate()
-	w.Write([]byte("DONE"))
 }
 
-func ResolveASNMtr(hop *mtrparser.MtrHop) {
-	hop.ASN = make([]string, len(hop.IP))
-	for idx, ip := range hop.IP {
-		//TODO...
-		hop.ASN[idx] = getasnmtr(ip)
+// alertsHandler manages the alerts http endpoint
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	args := strings.Split(r.URL.Path, "/")
+	switch len(args) {
+	case 0, 1, 2:
+		// url: <nil> or '/' or '/alerts'
+		// this should never happen with http.HandleFunc()
+		httpInternalServerError(w, errors.New("unexpected alerts url"))
+	case 3:
+		if args[2] != "" {
+			httpNotFound(w)
+			return
+		}
+		// url: /alerts/
+		allowedMethods := []string{http.MethodOptions, http.MethodGet}
+		switch r.Method {
+		case http.MethodOptions:
+			httpSetAllowHeader(w, allowedMethods)
+		case http.MethodGet:
+			httpSendJson(w, alerts.Active())
+		default:
+			httpMethodNotAllowed(w, allowedMethods)
+		}
+	case 4:
+		if args[2] != "rules" {
+			httpNotFound(w)
+			return
+		}
+		id := args[3]
+		if id == "" {
+			// url: /alerts/rules/
+			allowedMethods := []string{http.MethodOptions, http.MethodGet, http.MethodPost}
+			switch r.Method {
+			case http.MethodOptions:
+				httpSetAllowHeader(w, allowedMethods)
+			case http.MethodGet:
+				httpSendJson(w, alerts.Rules())
+			case http.MethodPost:
+				alertRulesPost(w, r)
+			default:
+				httpMethodNotAllowed(w, allowedMethods)
+			}
+		} else {
+			// url: /alerts/rules/<id>
+			allowedMethods := []string{http.MethodOptions, http.MethodGet, http.MethodPut, http.MethodDelete}
+			switch r.Method {
+			case http.MethodOptions:
+				httpSetAllowHeader(w, allowedMethods)
+			case http.MethodGet:
+				rule, err := alerts.Rule(id)
+				alertRulesSend(w, rule, err)
+			case http.MethodPut:
+				alertRulesPut(w, r, id)
+			case http.MethodDelete:
+				err := alerts.DeleteRule(id)
+				if err == pulsecnc.ErrRuleNotFound {
+					httpNotFound(w)
+				} else if err != nil {
+					httpInternalServerError(w, err)
+				} else {
+					w.WriteHeader(http.StatusNoContent)
+				}
+			default:
+				httpMethodNotAllowed(w, allowedMethods)
+			}
+		}
+	default:
+		httpBadRequest(w, errors.New("Too many arguments"))
 	}
 }
 
-func runmtr(w http.ResponseWriter, r *http.Request) {
-	data, err := ioutil.ReadAll(r.Body)
+// alertRulesPost creates an alert rule.
+func alertRulesPost(w http.ResponseWriter, r *http.Request) {
+	var def pulsecnc.AlertRule
+	err := json.NewDecoder(r.Body).Decode(&def)
 	if err != nil {
-		log.Println(err)
+		httpBadRequest(w, errors.New("malformed content: "+err.Error()))
 		return
 	}
-	log.Println(string(data))
-	req := pulse.MtrRequest{}
-	err = json.Unmarshal(data, &req)
+	rule, err := alerts.CreateRule(&def)
 	if err != nil {
-		log.Println(err)
+		httpBadRequest(w, err)
 		return
 	}
-	creq := &pulse.CombinedRequest{
-		Type:        pulse.TypeMTR,
-		Args:        req,
-		RequestedAt: time.Now(),
-		AgentFilter: req.AgentFilter,
-	}
-	log.Println(req)
-	results := tracker.Runner(creq)
-	log.Println("Got results")
-	var wg sync.WaitGroup
-	for _, res := range results {
-		result, _ := res.Result.(pulse.MtrResult)
-		if result.Result != nil {
-			if result.Err == "" {
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					for _, hop := range result.Result.Hops {
-						ResolveASNMtr(hop)
-					}
-					result.Result.Summarize(10)
-				}()
-			}
-		}
-	}
-	wg.Wait()
-	log.Println("Populated hostnames")
-	b, err := json.MarshalIndent(results, "", "  ")
-	if err != nil {
-		log.Println(err)
-		log.Fatal(err)
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(b)
+	w.Header().Set("Location", "/alerts/rules/"+rule.Id)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
 }
 
-func runtest(w http.ResponseWriter, r *http.Request) {
-	data, err := ioutil.ReadAll(r.Body)
+// alertRulesPut replaces an alert rule.
+func alertRulesPut(w http.ResponseWriter, r *http.Request, id string) {
+	var def pulsecnc.AlertRule
+	err := json.NewDecoder(r.Body).Decode(&def)
 	if err != nil {
-		log.Println(err)
+		httpBadRequest(w, errors.New("malformed content: "+err.Error()))
 		return
 	}
-	log.Println(string(data))
-	req := pulse.DNSRequest{}
-	err = json.Unmarshal(data, &req)
-	if err != nil {
-		log.Println(err)
+	if _, err := alerts.Rule(id); err == pulsecnc.ErrRuleNotFound {
+		httpNotFound(w)
 		return
 	}
-	if !strings.HasSuffix(req.Host, ".") {
-		//Make FQDN
-		req.Host = req.Host + "."
-	}
-	if req.Targets != nil {
-		if len(req.Targets) > 0 {
-			for i, t := range req.Targets {
-				req.Targets[i] = t + ":53"
-			}
-		}
+	rule, err := alerts.UpdateRule(id, &def)
+	if err == pulsecnc.ErrRuleNotFound {
+		httpNotFound(w)
+		return
 	}
-	creq := &pulse.CombinedRequest{
-		Type:        pulse.TypeDNS,
-		Args:        req,
-		RequestedAt: time.Now(),
-		AgentFilter: req.AgentFilter,
+	if err != nil {
+		httpBadRequest(w, err)
+		return
 	}
-	log.Println(req)
-	results := tracker.Runner(creq)
-
-	//newresult := make(&pulse.CombinedResult, len(results))
+	httpSendJson(w, rule)
+}
 
-	for i, res := range results {
-		result, _ := res.Result.(pulse.DNSResult)
-		for j, item := range result.Results {
-			item.ASN, item.ASName = lookupAsn(item.Server)
-			msg := &dns.Msg{}
-			msg.Unpack(item.Raw)
-			item.Formated = msg.String()
-			item.Msg = msg
-			result.Results[j] = item
-		}
-		results[i].Result = result
+// alertRulesSend answers an alert rule.
+func alertRulesSend(w http.ResponseWriter, rule *pulsecnc.AlertRule, err error) {
+	if err == pulsecnc.ErrRuleNotFound {
+		httpNotFound(w)
+		return
 	}
-	b, err := json.MarshalIndent(results, "", "  ")
 	if err != nil {
-		log.Fatal(err)
+		httpInternalServerError(w, err)
+		return
+	}
+	err = httpSendJson(w, rule)
+	if err != nil {
+		log.Printf("error: failed to send alert rule: %s", err)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(b)
 }
 
 // asndbHandler manages the asndb http endpoint
@@ -1148,9 +2612,81 @@ func httpSetAllowHeader(w http.ResponseWriter, allowed []string) {
 	w.Header().Set("Allow", strings.Join(allowed, ", "))
 }
 
+// conf answers the current config.
+func conf() *pulsecnc.Config {
+	return config.Load().(*pulsecnc.Config)
+}
+
+// reloadconfig reloads the config on SIGHUP. Settings only read at
+// startup are left alone with a warning.
+func reloadconfig() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		log.Println("reloading config")
+		next, err := pulsecnc.LoadConfig(os.Args[0], os.Args[1:])
+		if err != nil {
+			log.Printf("error: config not reloaded: %s", err)
+			continue
+		}
+		for _, name := range conf().RestartNeeded(next) {
+			log.Printf("warning: %s changed, restart the CNC to apply it", name)
+		}
+		if auth != nil && next.Keys != "" {
+			if err := auth.Reload(next.Keys); err != nil {
+				log.Printf("error: API keys not reloaded: %s", err)
+			}
+		}
+		if tlsreloader != nil {
+			reloadtls("SIGHUP")
+		}
+		if revocations != nil {
+			if err := revocations.LoadCRL(next.CRL, next.CA); err != nil {
+				log.Printf("error: CRL not reloaded: %s", err)
+			} else {
+				tracker.DisconnectRevoked()
+			}
+		}
+		config.Store(next)
+	}
+}
+
+// tlsWatchInterval is how often the minion listener certificate files are checked for changes.
+const tlsWatchInterval = time.Second * 10
+
+// watchtls reloads the minion listener certificates when their files change.
+func watchtls() {
+	for range time.Tick(tlsWatchInterval) {
+		if tlsreloader.Changed() {
+			reloadtls("file change")
+		}
+	}
+}
+
+// reloadtls reads the minion listener certificates again. Agents already
+// connected keep their connection.
+func reloadtls(why string) {
+	if err := tlsreloader.Reload(); err != nil {
+		tlsReloads.Inc("failed")
+		log.Printf("error: certificates not reloaded on %s: %s", why, err)
+		return
+	}
+	tlsReloads.Inc("ok")
+	log.Println("certificates reloaded on", why)
+}
+
 const (
-	asndbEndpoint     = "/asndb/"
-	asnlookupEndpoint = "/asnlookup/"
+	asndbEndpoint       = "/asndb/"
+	asnlookupEndpoint   = "/asnlookup/"
+	agentsEndpoint      = "/agents/"
+	jobsEndpoint        = "/jobs/"
+	schedulesEndpoint   = "/schedules/"
+	alertsEndpoint      = "/alerts/"
+	runsEndpoint        = "/runs/"
+	eventsEndpoint      = "/events/"
+	revocationsEndpoint = "/revocations/"
+	enrollEndpoint      = "/enroll/"
+	enrollmentsEndpoint = "/enrollments/"
 )
 
 func main() {
@@ -1160,30 +2696,121 @@ func main() {
 	gob.RegisterName("github.com/turbobytes/pulse/utils.CurlResult", pulse.CurlResult{})
 	gob.RegisterName("github.com/turbobytes/pulse/utils.DNSRequest", pulse.DNSRequest{})
 	gob.RegisterName("github.com/turbobytes/pulse/utils.DNSResult", pulse.DNSResult{})
+	if len(os.Args) > 1 && os.Args[1] == "pki" {
+		//Certificate management, no CNC is started
+		if err := pulsecnc.RunPKI(os.Args[0], os.Args[2:], os.Stdout); err != nil {
+			log.Fatal("pki ", err)
+		}
+		return
+	}
+	cfg, err := pulsecnc.LoadConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatal("config ", err)
+	}
+	config.Store(cfg)
+	go reloadconfig()
+
+	if cfg.Keys != "" {
+		auth, err = pulsecnc.LoadKeys(cfg.Keys)
+		if err != nil {
+			log.Fatal("keys ", err)
+		}
+	} else {
+		log.Println("warning: no -keys file, the http API is open to anyone who can reach it")
+	}
+	var geocollection *mgo.Collection
+	switch cfg.Store {
+	case "mongo":
+		session, err = mgo.Dial(cfg.Mongo)
+		if err != nil {
+			log.Fatal("mongo ", err)
+		}
+		defer session.Close()
+		agents = pulsecnc.NewMgoAgentStore(session.DB("dnsdist").C("agents"))
+		history, err = pulsecnc.NewMgoHistoryStore(session.DB("dnsdist").C("runs"))
+		if err != nil {
+			log.Fatal("mongo ", err)
+		}
+		docs = pulsecnc.NewMgoDocStore(session.DB("dnsdist"))
+		geocollection = session.DB("dnsdist").C("geoipdb")
+	case "bolt":
+		db, err := pulsecnc.OpenBolt(cfg.DB)
+		if err != nil {
+			log.Fatal("bolt ", err)
+		}
+		defer db.Close()
+		agents, err = pulsecnc.NewBoltAgentStore(db)
+		if err != nil {
+			log.Fatal("bolt ", err)
+		}
+		history, err = pulsecnc.NewBoltHistoryStore(db)
+		if err != nil {
+			log.Fatal("bolt ", err)
+		}
+		docs, err = pulsecnc.NewBoltDocStore(db)
+		if err != nil {
+			log.Fatal("bolt ", err)
+		}
+	case "memory":
+		log.Println("warning: agent metadata is kept in memory and lost on restart")
+		agents = pulsecnc.NewMemoryAgentStore()
+		history = pulsecnc.NewMemoryHistoryStore()
+		docs = pulsecnc.NewMemoryDocStore()
+	default:
+		log.Fatalf("unknown store %q, expected mongo, bolt or memory", cfg.Store)
+	}
+	alerts, err = pulsecnc.NewAlertManager(docs)
+	if err != nil {
+		log.Fatal("failed to load alert rules ", err)
+	}
+	//Every run that makes it to history gets its alert rules evaluated
+	history = alerts.History(history)
+	if cfg.CAKey != "" {
+		ca, err = pulsecnc.LoadCA(cfg.CA, cfg.CAKey)
+		if err != nil {
+			log.Fatal("ca ", err)
+		}
+	} else {
+		log.Println("warning: no -cakey, enrollments can not be approved nor certificates renewed")
+	}
+	enroller = pulsecnc.NewEnroller(docs, agents, ca)
+	revocations, err = pulsecnc.NewRevocationList(docs)
+	if err != nil {
+		log.Fatal("failed to load revocations ", err)
+	}
+	if err := revocations.LoadCRL(cfg.CRL, cfg.CA); err != nil {
+		log.Fatal("crl ", err)
+	}
+	serials, err = pulsecnc.NewSerialLinks(docs)
+	if err != nil {
+		log.Fatal("failed to load certificate serials ", err)
+	}
 	tracker = NewTracker()
-	var err error
-	session, err = mgo.Dial("127.0.0.1")
+	jobs = pulsecnc.NewJobManager(tracker.Start, history, time.Hour)
+	go pruneHistory()
+	scheduler, err = pulsecnc.NewScheduler(docs, testRunner{})
 	if err != nil {
-		log.Fatal("mongo ", err)
+		log.Fatal("failed to load schedules ", err)
 	}
-	defer session.Close()
+	scheduler.Start()
 
+	//Without mongo there is no asndb, geoipdb reports it as disabled
 	geo, err = geoipdb.NewHandler(
-		session.DB("dnsdist").C("geoipdb"),
+		geocollection,
 		time.Second*5,
 	)
 	if err != nil {
 		log.Fatalf("failed to get a geoipdb handler: %s", err)
 	}
 
-	var caFile, certificateFile, privateKeyFile string
-	flag.StringVar(&caFile, "ca", "ca.crt", "Path to CA")
-	flag.StringVar(&certificateFile, "crt", "server.crt", "Path to Server Certificate")
-	flag.StringVar(&privateKeyFile, "key", "server.key", "Path to Private key")
-	flag.Parse()
-	cfg := pulse.GetTLSConfig(caFile, certificateFile, privateKeyFile)
+	tlsreloader, err = pulsecnc.NewTLSReloader(cfg.CA, cfg.Cert, cfg.Key, cfg.TLSLegacy)
+	if err != nil {
+		log.Fatal("tls ", err)
+	}
+	go watchtls()
+	tlsconfig := tlsreloader.Config()
 
-	listener, err := tls.Listen("tcp4", ":7777", cfg)
+	listener, err := tls.Listen(cfg.MinionNetwork, cfg.MinionListen, tlsconfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1192,15 +2819,24 @@ func main() {
 		http.HandleFunc("/", makeGzipHandler(func(w http.ResponseWriter, r *http.Request) {
 			http.ServeFile(w, r, "index-dist.html")
 		}))
-		http.HandleFunc("/dns/", makeGzipHandler(runtest))
-		http.HandleFunc("/curl/", makeGzipHandler(runcurl))
-		http.HandleFunc("/mtr/", makeGzipHandler(runmtr))
-		http.HandleFunc("/agents/", makeGzipHandler(agentshandler))
-		http.HandleFunc("/repopulate/", makeGzipHandler(repopulatehandler))
-		http.HandleFunc(asndbEndpoint, makeGzipHandler(asndbHandler))
-		http.HandleFunc(asnlookupEndpoint, makeGzipHandler(asnlookupHandler))
-
-		log.Fatal(http.ListenAndServe(":7778", nil))
+		http.HandleFunc("/dns/", makeGzipHandler(authorize(pulsecnc.RoleTester, pulsecnc.RoleTester, runtest)))
+		http.HandleFunc("/curl/", makeGzipHandler(authorize(pulsecnc.RoleTester, pulsecnc.RoleTester, runcurl)))
+		http.HandleFunc("/mtr/", makeGzipHandler(authorize(pulsecnc.RoleTester, pulsecnc.RoleTester, runmtr)))
+		http.HandleFunc(agentsEndpoint, makeGzipHandler(authorize(pulsecnc.RoleRead, pulsecnc.RoleAdmin, agentshandler)))
+		http.HandleFunc("/repopulate/", makeGzipHandler(authorize(pulsecnc.RoleAdmin, pulsecnc.RoleAdmin, repopulatehandler)))
+		http.HandleFunc(runsEndpoint, makeGzipHandler(authorize(pulsecnc.RoleRead, pulsecnc.RoleRead, runsHandler)))
+		http.HandleFunc(jobsEndpoint, makeGzipHandler(authorize(pulsecnc.RoleRead, pulsecnc.RoleTester, jobsHandler)))
+		http.HandleFunc(eventsEndpoint, makeGzipHandler(authorize(pulsecnc.RoleRead, pulsecnc.RoleRead, eventsHandler)))
+		http.HandleFunc(schedulesEndpoint, makeGzipHandler(authorize(pulsecnc.RoleRead, pulsecnc.RoleAdmin, schedulesHandler)))
+		http.HandleFunc(alertsEndpoint, makeGzipHandler(authorize(pulsecnc.RoleRead, pulsecnc.RoleAdmin, alertsHandler)))
+		http.HandleFunc(revocationsEndpoint, makeGzipHandler(authorize(pulsecnc.RoleRead, pulsecnc.RoleAdmin, revocationsHandler)))
+		http.HandleFunc(enrollEndpoint, makeGzipHandler(enrollHandler)) //Open, minions have no API key
+		http.HandleFunc(enrollmentsEndpoint, makeGzipHandler(authorize(pulsecnc.RoleAdmin, pulsecnc.RoleAdmin, enrollmentsHandler)))
+		http.HandleFunc("/metrics", makeGzipHandler(authorize(pulsecnc.RoleRead, pulsecnc.RoleRead, registry.ServeHTTP)))
+		http.HandleFunc(asndbEndpoint, makeGzipHandler(authorize(pulsecnc.RoleRead, pulsecnc.RoleAdmin, asndbHandler)))
+		http.HandleFunc(asnlookupEndpoint, makeGzipHandler(authorize(pulsecnc.RoleRead, pulsecnc.RoleAdmin, asnlookupHandler)))
+
+		log.Fatal(http.ListenAndServe(cfg.APIListen, nil))
 
 	}()
 	log.Println("monitoring")
@@ -0,0 +1,340 @@
+// Package metrics is a small, dependency free, implementation of counters,
+// gauges and histograms exposed in the Prometheus text format.
+// It is shared by the CNC and the minion.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are histogram buckets, in seconds, suited to network tests.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// metric is anything a Registry can write out.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds metrics and writes them out in registration order.
+type Registry struct {
+	metrics []metric
+	names   map[string]bool
+	lock    sync.Mutex
+}
+
+// NewRegistry answers an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all metrics in the Prometheus text format.
+func (r *Registry) Write(out io.Writer) error {
+	r.lock.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.lock.Unlock()
+	w := bufio.NewWriter(out)
+	for _, m := range metrics {
+		m.write(w)
+	}
+	return w.Flush()
+}
+
+// ServeHTTP answers the metrics, so a Registry can be used as an http.Handler.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// desc is the part shared by all metric kinds.
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// key joins label values into a map key.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// series formats a sample line name{labels} value, extra is an additional label pair.
+func (d *desc) series(w *bufio.Writer, suffix, key, extra string, value float64) {
+	w.WriteString(d.name)
+	w.WriteString(suffix)
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escapeLabel(v)+`"`)
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+// Counter is a value that only goes up, optionally split by labels.
+type Counter struct {
+	desc
+	values map[string]float64
+	lock   sync.Mutex
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, "counter", labels}, values: make(map[string]float64)}
+	r.register(name, c)
+	return c
+}
+
+// Inc adds 1 to the counter for the given label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v, which must not be negative, to the counter for the given label values.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: counters can not go down")
+	}
+	key := c.key(values)
+	c.lock.Lock()
+	c.values[key] += v
+	c.lock.Unlock()
+}
+
+// Value answers the current value for the given label values.
+func (c *Counter) Value(values ...string) float64 {
+	key := c.key(values)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header(w)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		c.series(w, "", key, "", c.values[key])
+	}
+}
+
+// Gauge is a value that goes up and down, optionally split by labels.
+type Gauge struct {
+	desc
+	values map[string]float64
+	lock   sync.Mutex
+}
+
+// NewGauge registers a gauge with the given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{name, help, "gauge", labels}, values: make(map[string]float64)}
+	r.register(name, g)
+	return g
+}
+
+// Set sets the gauge for the given label values.
+func (g *Gauge) Set(v float64, values ...string) {
+	key := g.key(values)
+	g.lock.Lock()
+	g.values[key] = v
+	g.lock.Unlock()
+}
+
+// Add adds v, which may be negative, to the gauge for the given label values.
+func (g *Gauge) Add(v float64, values ...string) {
+	key := g.key(values)
+	g.lock.Lock()
+	g.values[key] += v
+	g.lock.Unlock()
+}
+
+// Value answers the current value for the given label values.
+func (g *Gauge) Value(values ...string) float64 {
+	key := g.key(values)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.values[key]
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.header(w)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, key := range sortedKeys(g.values) {
+		g.series(w, "", key, "", g.values[key])
+	}
+}
+
+// GaugeFunc is a gauge whose values are computed when metrics are written.
+type GaugeFunc struct {
+	desc
+	collect func(emit func(v float64, values ...string))
+}
+
+// NewGaugeFunc registers a gauge computed by collect. collect calls emit once
+// per set of label values.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit func(v float64, values ...string))) *GaugeFunc {
+	g := &GaugeFunc{desc: desc{name, help, "gauge", labels}, collect: collect}
+	r.register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.header(w)
+	values := make(map[string]float64)
+	g.collect(func(v float64, labels ...string) {
+		values[g.key(labels)] += v
+	})
+	for _, key := range sortedKeys(values) {
+		g.series(w, "", key, "", values[key])
+	}
+}
+
+// Histogram counts observations in buckets, optionally split by labels.
+type Histogram struct {
+	desc
+	buckets []float64
+	values  map[string]*histogramValue
+	lock    sync.Mutex
+}
+
+type histogramValue struct {
+	counts []uint64 //Per bucket, not cumulative. The last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds
+// and label names. buckets nil means DefBuckets.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	r.register(name, h)
+	return h
+}
+
+// Observe records v for the given label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := h.key(values)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hv
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	hv.counts[i]++
+	hv.sum += v
+	hv.count++
+}
+
+// Count answers the number of observations for the given label values.
+func (h *Histogram) Count(values ...string) uint64 {
+	key := h.key(values)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if hv, ok := h.values[key]; ok {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		var cumulative uint64
+		for i, count := range hv.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			h.series(w, "_bucket", key, `le="`+formatFloat(le)+`"`, float64(cumulative))
+		}
+		h.series(w, "_sum", key, "", hv.sum)
+		h.series(w, "_count", key, "", float64(hv.count))
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
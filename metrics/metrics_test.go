@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	tests := r.NewCounter("tests_total", "Tests run.", "type")
+	tests.Inc("dns")
+	tests.Inc("dns")
+	tests.Add(3, "curl")
+	up := r.NewGauge("up", "Is it up.")
+	up.Set(1)
+	r.NewGaugeFunc("agents", "Connected agents.", []string{"country"}, func(emit func(float64, ...string)) {
+		emit(1, "IN")
+		emit(1, `say "hi"`)
+		emit(1, "IN")
+	})
+	latency := r.NewHistogram("latency_seconds", "Latency.\nIn seconds.", []float64{1, 0.1}, "type")
+	latency.Observe(0.05, "dns")
+	latency.Observe(0.1, "dns")
+	latency.Observe(5, "dns")
+
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP tests_total Tests run.
+# TYPE tests_total counter
+tests_total{type="curl"} 3
+tests_total{type="dns"} 2
+# HELP up Is it up.
+# TYPE up gauge
+up 1
+# HELP agents Connected agents.
+# TYPE agents gauge
+agents{country="IN"} 2
+agents{country="say \"hi\""} 1
+# HELP latency_seconds Latency.\nIn seconds.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{type="dns",le="0.1"} 2
+latency_seconds_bucket{type="dns",le="1"} 2
+latency_seconds_bucket{type="dns",le="+Inf"} 3
+latency_seconds_sum{type="dns"} 5.15
+latency_seconds_count{type="dns"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+	if tests.Value("dns") != 2 || latency.Count("dns") != 3 || latency.Count("curl") != 0 {
+		t.Errorf("unexpected values")
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") || rec.Body.String() != expected {
+		t.Errorf("unexpected http answer %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestRegistryPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("c", "", "a")
+	for name, f := range map[string]func(){
+		"duplicate":    func() { r.NewGauge("c", "") },
+		"label values": func() { c.Inc() },
+		"negative":     func() { c.Add(-1, "x") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s should panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
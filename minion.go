@@ -5,6 +5,8 @@ package main
 import (
 	"flag"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/turbobytes/pulse/utils"
 )
@@ -12,14 +14,40 @@ import (
 var version string //This variable is populated during build of production binaries.
 
 func main() {
-	var cnc, caFile, certificateFile, privateKeyFile, reqFile, servers string
-	flag.StringVar(&caFile, "ca", "ca.crt", "Path to CA")
-	flag.StringVar(&certificateFile, "crt", "minion.crt", "Path to Server Certificate")
-	flag.StringVar(&privateKeyFile, "key", "minion.key", "Path to Private key")
-	flag.StringVar(&reqFile, "req", "minion.crt.request", "Path to request file")
-	flag.StringVar(&cnc, "cnc", "localhost:7777", "Location of command and control?")
+	var servers, statusAddr, resolvers string
+	var maxdns, maxmtr, maxcurl int
+	mc := &pulse.MinionConfig{Enroll: new(pulse.EnrollRequest)}
+	flag.StringVar(&mc.CAFile, "ca", "ca.crt", "Path to CA")
+	flag.StringVar(&mc.CertificateFile, "crt", "minion.crt", "Path to Server Certificate")
+	flag.StringVar(&mc.PrivateKeyFile, "key", "minion.key", "Path to Private key")
+	flag.StringVar(&mc.ReqFile, "req", "minion.crt.request", "Path to request file")
+	flag.StringVar(&mc.CNC, "cnc", "localhost:7777", "Location of command and control?")
 	flag.StringVar(&servers, "servers", "", "Legacy, this arg is ignored. It is here because old deployments might still set it")
+	flag.StringVar(&statusAddr, "status", "", "Serve local status on this address, e.g. :7779. Binds to localhost unless a host is given. Off by default")
+	flag.StringVar(&mc.EnrollURL, "enroll", "", "URL of the CNC http API, e.g. http://cnc.host.name:7778. Without a certificate, enroll there instead of printing a certificate request")
+	flag.StringVar(&mc.Enroll.Name, "name", "", "Agent name, for enrollment")
+	flag.StringVar(&mc.Enroll.Country, "country", "", "Two letter country code of the agent, for enrollment")
+	flag.StringVar(&mc.Enroll.State, "state", "", "State of the agent, for enrollment")
+	flag.StringVar(&mc.Enroll.City, "city", "", "City of the agent, for enrollment")
+	flag.StringVar(&resolvers, "resolvers", "", "Comma separated ISP resolver IPs, for enrollment")
+	flag.DurationVar(&mc.RenewBefore, "renewbefore", time.Hour*24*30, "Ask the CNC for a new certificate when the current one expires within this")
+	flag.StringVar(&mc.KeyType, "keytype", pulse.KeyECDSA, "Type of new private keys, ecdsa, ed25519 or rsa")
+	flag.BoolVar(&mc.TLSLegacy, "tlslegacy", false, "Only use TLS 1.2 with the cipher suites of older releases")
+	flag.IntVar(&maxdns, "maxdns", pulse.DefaultMaxDNS, "DNS tests running at once, 0 for no limit")
+	flag.IntVar(&maxmtr, "maxmtr", pulse.DefaultMaxMTR, "mtr tests running at once, 0 for no limit")
+	flag.IntVar(&maxcurl, "maxcurl", pulse.DefaultMaxCurl, "HTTP tests running at once, 0 for no limit")
+	flag.IntVar(&mc.MaxQueue, "maxqueue", pulse.DefaultMaxQueue, "Tests of each type waiting for their turn, more are refused as busy")
 	flag.Parse()
+	if resolvers != "" {
+		mc.Enroll.Resolvers = strings.Split(resolvers, ",")
+	}
+	mc.MaxTests = map[int]int{pulse.TypeDNS: maxdns, pulse.TypeMTR: maxmtr, pulse.TypeCurl: maxcurl}
+	mc.Version = version
 	log.Println("servers", servers)
-	log.Fatal(pulse.Runminion(cnc, caFile, certificateFile, privateKeyFile, reqFile, version))
+	if statusAddr != "" {
+		go func() {
+			log.Fatal(pulse.ServeStatus(statusAddr))
+		}()
+	}
+	log.Fatal(pulse.Runminion(mc))
 }
@@ -0,0 +1,199 @@
+package pulsecnc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MaxLabels is how many labels an agent can have.
+const MaxLabels = 32
+
+var (
+	labelKeyRe   = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,62}$`)
+	labelValueRe = regexp.MustCompile(`^[A-Za-z0-9_.:/-]{1,63}$`)
+	countryRe    = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// AgentEdit is the metadata of an agent that can be changed through
+// the API. It replaces all of it, missing fields are cleared.
+type AgentEdit struct {
+	Name           string
+	City           string
+	State          string
+	Country        string //ISO 3166 two letter code
+	LocalResolvers []string
+	HostType       string //H, O, D or home, office, datacenter
+	Host           string
+	LatLng         string //"lat,lng"
+	Labels         map[string]string
+}
+
+// Apply replaces the editable metadata of agent with e. agent is left
+// untouched if the result does not validate.
+func (e *AgentEdit) Apply(agent *AgentInfo) error {
+	c := agent.clone()
+	c.Name = e.Name
+	c.City = e.City
+	c.State = e.State
+	c.Country = e.Country
+	c.LocalResolvers = e.LocalResolvers
+	c.HostType = e.HostType
+	c.Host = e.Host
+	c.LatLng = e.LatLng
+	c.Labels = e.Labels
+	return commitAgent(agent, c)
+}
+
+// AgentPatch changes some of the metadata of an agent. Fields left
+// out (or null) are kept, labels set to null are removed.
+type AgentPatch struct {
+	Name           *string
+	City           *string
+	State          *string
+	Country        *string
+	LocalResolvers *[]string
+	HostType       *string
+	Host           *string
+	LatLng         *string
+	Labels         map[string]*string
+}
+
+// Apply changes agent as described by p. agent is left untouched if
+// the result does not validate.
+func (p *AgentPatch) Apply(agent *AgentInfo) error {
+	c := agent.clone()
+	for _, f := range []struct {
+		from *string
+		to   *string
+	}{
+		{p.Name, &c.Name},
+		{p.City, &c.City},
+		{p.State, &c.State},
+		{p.Country, &c.Country},
+		{p.HostType, &c.HostType},
+		{p.Host, &c.Host},
+		{p.LatLng, &c.LatLng},
+	} {
+		if f.from != nil {
+			*f.to = *f.from
+		}
+	}
+	if p.LocalResolvers != nil {
+		c.LocalResolvers = *p.LocalResolvers
+	}
+	for k, v := range p.Labels {
+		if v == nil {
+			delete(c.Labels, k)
+			continue
+		}
+		if c.Labels == nil {
+			c.Labels = make(map[string]string)
+		}
+		c.Labels[k] = *v
+	}
+	return commitAgent(agent, c)
+}
+
+// commitAgent copies edited into agent if it validates.
+func commitAgent(agent, edited *AgentInfo) error {
+	if err := ValidateAgent(edited); err != nil {
+		return err
+	}
+	*agent = *edited
+	return nil
+}
+
+// ValidateAgent checks the editable metadata of agent, bringing the
+// country, host type and resolvers into their stored form.
+func ValidateAgent(agent *AgentInfo) error {
+	agent.Name = strings.TrimSpace(agent.Name)
+	if agent.Name == "" {
+		return errors.New("Name can not be empty")
+	}
+	agent.Country = strings.ToUpper(strings.TrimSpace(agent.Country))
+	if agent.Country != "" && !countryRe.MatchString(agent.Country) {
+		return fmt.Errorf("invalid Country %q, expected a two letter code", agent.Country)
+	}
+	if agent.HostType != "" {
+		ht, ok := hostTypes[strings.ToLower(agent.HostType)]
+		if !ok {
+			return fmt.Errorf("invalid HostType %q, expected home, office or datacenter", agent.HostType)
+		}
+		agent.HostType = ht
+	}
+	if err := validateLatLng(agent.LatLng); err != nil {
+		return err
+	}
+	resolvers := make([]string, 0, len(agent.LocalResolvers))
+	for _, r := range agent.LocalResolvers {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		if net.ParseIP(r) == nil {
+			return fmt.Errorf("invalid LocalResolvers entry %q, expected an IP address", r)
+		}
+		resolvers = append(resolvers, r)
+	}
+	agent.LocalResolvers = resolvers
+	return validateLabels(agent.Labels)
+}
+
+func validateLatLng(latlng string) error {
+	if latlng == "" {
+		return nil
+	}
+	parts := strings.Split(latlng, ",")
+	if len(parts) == 2 {
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		lng, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err1 == nil && err2 == nil && lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180 {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid LatLng %q, expected \"lat,lng\"", latlng)
+}
+
+func validateLabels(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("too many labels, at most %d are allowed", MaxLabels)
+	}
+	for k, v := range labels {
+		if !labelKeyRe.MatchString(k) {
+			return fmt.Errorf("invalid label %q, use lower case letters, digits, '_', '.' and '-'", k)
+		}
+		if !labelValueRe.MatchString(v) {
+			return fmt.Errorf("invalid value %q for label %q, use letters, digits, '_', '.', ':', '/' and '-'", v, k)
+		}
+	}
+	return nil
+}
+
+// formatLabels answers labels as "k1=v1,k2=v2", sorted by key.
+// Validated labels never contain ',' or '='.
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// parseLabels is the reverse of formatLabels.
+func parseLabels(s string) map[string]string {
+	if s == "" {
+		return nil
+	}
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if i := strings.Index(pair, "="); i > 0 {
+			labels[pair[:i]] = pair[i+1:]
+		}
+	}
+	return labels
+}
@@ -0,0 +1,194 @@
+// Package pulsecnc holds the building blocks of the command and control
+// server that do not need access to connected workers.
+package pulsecnc
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrAgentNotFound is returned by an AgentStore when no agent matches a serial.
+var ErrAgentNotFound = errors.New("agent not found")
+
+//AgentInfo is what we store in db...
+type AgentInfo struct {
+	Name           string
+	City           string
+	State          string
+	Country        string
+	SerialNumber   *big.Int
+	LocalResolvers []string
+	ASN            string
+	ASName         string
+	Host           string
+	//HostEmail       string
+	//HostWebsite     string
+	//HostDescription string
+	//HostCompanyLogo string
+	HostType    string // H = Home, O = Office, D = Datacenter
+	FirstOnline string
+	LatLng      string            //TODO: make richer?
+	Labels      map[string]string //Free form, e.g. pool=canary
+}
+
+func (agent *AgentInfo) GetBSON() (interface{}, error) {
+	return bson.D{
+		{"Name", agent.Name},
+		{"City", agent.City},
+		{"State", agent.State},
+		{"Country", agent.Country},
+		{"LocalResolvers", strings.Join(agent.LocalResolvers, ",")},
+		{"_id", agent.SerialNumber.String()},
+		{"ASN", agent.ASN},
+		{"ASName", agent.ASName},
+		{"Host", agent.Host},
+		//{"HostWebsite", agent.HostWebsite},
+		//{"HostDescription", agent.HostDescription},
+		{"HostType", agent.HostType},
+		//{"HostCompanyLogo", agent.HostCompanyLogo},
+		{"FirstOnline", agent.FirstOnline},
+		{"LatLng", agent.LatLng},
+		{"Labels", formatLabels(agent.Labels)},
+	}, nil
+}
+
+func (agent *AgentInfo) SetBSON(raw bson.Raw) error {
+	data := make(map[string]string)
+	err := raw.Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	agent.Name = data["Name"]
+	agent.City = data["City"]
+	agent.State = data["State"]
+	agent.Country = data["Country"]
+	agent.LocalResolvers = strings.Split(data["LocalResolvers"], ",")
+	agent.SerialNumber = new(big.Int)
+	agent.SerialNumber.SetString(data["_id"], 10)
+	agent.ASN = data["ASN"]
+	agent.ASName = data["ASName"]
+	agent.Host = data["Host"]
+	//agent.HostWebsite = data["HostWebsite"]
+	//agent.HostDescription = data["HostDescription"]
+	//agent.HostCompanyLogo = data["HostCompanyLogo"]
+	agent.HostType = data["HostType"]
+	agent.FirstOnline = data["FirstOnline"]
+	agent.LatLng = data["LatLng"]
+	agent.Labels = parseLabels(data["Labels"])
+	return nil
+}
+
+// clone answers a copy of agent that shares no mutable state with it.
+func (agent *AgentInfo) clone() *AgentInfo {
+	c := *agent
+	if agent.SerialNumber != nil {
+		c.SerialNumber = new(big.Int).Set(agent.SerialNumber)
+	}
+	if agent.LocalResolvers != nil {
+		c.LocalResolvers = append([]string(nil), agent.LocalResolvers...)
+	}
+	if agent.Labels != nil {
+		c.Labels = make(map[string]string, len(agent.Labels))
+		for k, v := range agent.Labels {
+			c.Labels[k] = v
+		}
+	}
+	return &c
+}
+
+// AgentStore keeps metadata about agents, keyed by agent id, the serial
+// number of the certificate the agent enrolled with.
+type AgentStore interface {
+	// Get answers the agent with the given serial, or ErrAgentNotFound.
+	Get(serial *big.Int) (*AgentInfo, error)
+	// Insert adds a new agent.
+	Insert(agent *AgentInfo) error
+	// Update overwrites the stored fields of an existing agent.
+	Update(agent *AgentInfo) error
+	// List answers all known agents.
+	List() ([]*AgentInfo, error)
+	// Delete removes an agent, or answers ErrAgentNotFound.
+	Delete(serial *big.Int) error
+}
+
+// MemoryAgentStore is an AgentStore that lives in process memory only.
+// Everything is lost on restart, which makes it handy for tests and demos.
+type MemoryAgentStore struct {
+	agents map[string]*AgentInfo
+	lock   sync.RWMutex
+}
+
+// NewMemoryAgentStore answers an empty MemoryAgentStore.
+func NewMemoryAgentStore() *MemoryAgentStore {
+	return &MemoryAgentStore{agents: make(map[string]*AgentInfo)}
+}
+
+func (s *MemoryAgentStore) Get(serial *big.Int) (*AgentInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	agent, ok := s.agents[serial.String()]
+	if !ok {
+		return nil, ErrAgentNotFound
+	}
+	return agent.clone(), nil
+}
+
+func (s *MemoryAgentStore) Insert(agent *AgentInfo) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := agent.SerialNumber.String()
+	if _, ok := s.agents[id]; ok {
+		return errors.New("agent already exists: " + id)
+	}
+	s.agents[id] = agent.clone()
+	return nil
+}
+
+func (s *MemoryAgentStore) Update(agent *AgentInfo) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := agent.SerialNumber.String()
+	if _, ok := s.agents[id]; !ok {
+		return ErrAgentNotFound
+	}
+	s.agents[id] = agent.clone()
+	return nil
+}
+
+func (s *MemoryAgentStore) Delete(serial *big.Int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := serial.String()
+	if _, ok := s.agents[id]; !ok {
+		return ErrAgentNotFound
+	}
+	delete(s.agents, id)
+	return nil
+}
+
+func (s *MemoryAgentStore) List() ([]*AgentInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	agents := make([]*AgentInfo, 0, len(s.agents))
+	for _, agent := range s.agents {
+		agents = append(agents, agent.clone())
+	}
+	sortAgents(agents)
+	return agents, nil
+}
+
+// sortAgents orders agents by serial number so listings are stable.
+func sortAgents(agents []*AgentInfo) {
+	sort.Sort(agentsBySerial(agents))
+}
+
+type agentsBySerial []*AgentInfo
+
+func (a agentsBySerial) Len() int           { return len(a) }
+func (a agentsBySerial) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a agentsBySerial) Less(i, j int) bool { return a[i].SerialNumber.Cmp(a[j].SerialNumber) < 0 }
@@ -0,0 +1,184 @@
+package pulsecnc
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tempBolt answers a bolt backed file in a temporary directory and a cleanup function.
+func tempBolt(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pulsecnc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "pulse.db"), func() { os.RemoveAll(dir) }
+}
+
+func testAgentStore(t *testing.T, store AgentStore) {
+	serial := big.NewInt(42)
+	if _, err := store.Get(serial); err != ErrAgentNotFound {
+		t.Fatalf("expected ErrAgentNotFound, got %v", err)
+	}
+	if err := store.Update(&AgentInfo{SerialNumber: serial}); err != ErrAgentNotFound {
+		t.Fatalf("update of missing agent should fail with ErrAgentNotFound, got %v", err)
+	}
+	agent := &AgentInfo{
+		Name:           "client0",
+		SerialNumber:   serial,
+		LocalResolvers: []string{"10.0.0.1"},
+	}
+	if err := store.Insert(agent); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Insert(agent); err == nil {
+		t.Error("inserting the same agent twice should fail")
+	}
+	// Mutating our copy must not leak into the store
+	agent.Name = "changed"
+	got, err := store.Get(big.NewInt(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "client0" || got.SerialNumber.Cmp(serial) != 0 || len(got.LocalResolvers) != 1 {
+		t.Errorf("unexpected agent %+v", got)
+	}
+	got.ASN = "AS15169"
+	if err := store.Update(got); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Insert(&AgentInfo{Name: "client1", SerialNumber: big.NewInt(7)}); err != nil {
+		t.Fatal(err)
+	}
+	agents, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 2 {
+		t.Fatalf("expected 2 agents, got %d", len(agents))
+	}
+	if agents[0].Name != "client1" || agents[1].ASN != "AS15169" {
+		t.Errorf("unexpected listing %+v %+v", agents[0], agents[1])
+	}
+	gone := &AgentInfo{Name: "client2", SerialNumber: big.NewInt(99), Labels: map[string]string{"pool": "canary"}}
+	if err := store.Insert(gone); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get(gone.SerialNumber); err != nil || got.Labels["pool"] != "canary" {
+		t.Errorf("labels not stored: %+v %v", got, err)
+	}
+	if err := store.Delete(gone.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(gone.SerialNumber); err != ErrAgentNotFound {
+		t.Errorf("second delete should fail with ErrAgentNotFound, got %v", err)
+	}
+	if _, err := store.Get(gone.SerialNumber); err != ErrAgentNotFound {
+		t.Errorf("deleted agent still there: %v", err)
+	}
+}
+
+func TestMemoryAgentStore(t *testing.T) {
+	testAgentStore(t, NewMemoryAgentStore())
+}
+
+func TestBoltAgentStore(t *testing.T) {
+	path, cleanup := tempBolt(t)
+	defer cleanup()
+	db, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewBoltAgentStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAgentStore(t, store)
+	db.Close()
+	// Data must survive reopening the file
+	db, err = OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err = NewBoltAgentStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agents, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 2 {
+		t.Errorf("expected 2 agents after reopening, got %d", len(agents))
+	}
+}
+
+func TestAgentEdit(t *testing.T) {
+	agent := &AgentInfo{Name: "client0", SerialNumber: big.NewInt(1), Country: "IN", ASN: "AS9829", FirstOnline: "yesterday"}
+	edit := &AgentEdit{
+		Name:           "client0",
+		Country:        "us",
+		HostType:       "datacenter",
+		LatLng:         "39.04, -77.48",
+		LocalResolvers: []string{"10.0.0.1", ""},
+		Labels:         map[string]string{"pool": "canary", "isp": "comcast"},
+	}
+	if err := edit.Apply(agent); err != nil {
+		t.Fatal(err)
+	}
+	if agent.Country != "US" || agent.HostType != "D" || len(agent.LocalResolvers) != 1 || agent.Labels["isp"] != "comcast" {
+		t.Errorf("unexpected agent after edit %+v", agent)
+	}
+	if agent.ASN != "AS9829" || agent.FirstOnline != "yesterday" {
+		t.Errorf("edit changed fields it does not own %+v", agent)
+	}
+
+	city := "Ashburn"
+	stable := "stable"
+	patch := &AgentPatch{City: &city, Labels: map[string]*string{"pool": &stable, "isp": nil}}
+	if err := patch.Apply(agent); err != nil {
+		t.Fatal(err)
+	}
+	if agent.City != "Ashburn" || agent.Country != "US" || len(agent.Labels) != 1 || agent.Labels["pool"] != "stable" {
+		t.Errorf("unexpected agent after patch %+v", agent)
+	}
+
+	bad := []string{"", "USA", "1,2,3", "91,0", "castle", "10.0.0", "Pool", "canary pool"}
+	setters := []func(p *AgentPatch, v *string){
+		func(p *AgentPatch, v *string) { p.Name = v },
+		func(p *AgentPatch, v *string) { p.Country = v },
+		func(p *AgentPatch, v *string) { p.LatLng = v },
+		func(p *AgentPatch, v *string) { p.LatLng = v },
+		func(p *AgentPatch, v *string) { p.HostType = v },
+		func(p *AgentPatch, v *string) { p.LocalResolvers = &[]string{*v} },
+		func(p *AgentPatch, v *string) { p.Labels = map[string]*string{*v: &stable} },
+		func(p *AgentPatch, v *string) { p.Labels = map[string]*string{"pool": v} },
+	}
+	for i, v := range bad {
+		p := new(AgentPatch)
+		setters[i](p, &bad[i])
+		if err := p.Apply(agent); err == nil {
+			t.Errorf("%q should not validate", v)
+		}
+	}
+	if agent.City != "Ashburn" || agent.Labels["pool"] != "stable" {
+		t.Errorf("failed patch changed the agent %+v", agent)
+	}
+}
+
+func TestLabelsBSON(t *testing.T) {
+	labels := map[string]string{"pool": "canary", "isp": "comcast"}
+	s := formatLabels(labels)
+	if s != "isp=comcast,pool=canary" {
+		t.Errorf("unexpected labels %q", s)
+	}
+	if got := parseLabels(s); len(got) != 2 || got["pool"] != "canary" {
+		t.Errorf("unexpected labels %v", got)
+	}
+	if parseLabels("") != nil {
+		t.Error("expected no labels")
+	}
+}
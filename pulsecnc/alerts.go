@@ -0,0 +1,540 @@
+package pulsecnc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+// ErrRuleNotFound is returned by AlertManager when no rule matches an id.
+var ErrRuleNotFound = errors.New("alert rule not found")
+
+// Alert states
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+const (
+	alertRulesCollection = "alertrules"
+	alertsCollection     = "alerts"
+)
+
+// alertMetrics lists the metrics rules can look at and the test types
+// they apply to. A type of 0 means any test.
+var alertMetrics = map[string]int{
+	"error":       0,              //1 when the agent answered with an error, 0 otherwise
+	"status":      pulse.TypeCurl, //HTTP status
+	"ttfb":        pulse.TypeCurl, //Milliseconds
+	"dialtime":    pulse.TypeCurl, //Milliseconds
+	"dnstime":     pulse.TypeCurl, //Milliseconds
+	"connecttime": pulse.TypeCurl, //Milliseconds
+	"tlstime":     pulse.TypeCurl, //Milliseconds
+	"rcode":       pulse.TypeDNS,  //Response code of each server queried, 0 is NOERROR
+	"rtt":         pulse.TypeDNS,  //Milliseconds, for each server queried
+	"loss":        pulse.TypeMTR,  //Packet loss percentage at the last hop
+}
+
+// AlertRule is a condition evaluated against the results of every run.
+// The rule matches an agent when any value of Metric in its result
+// compares to Value with Op, and fires when at least MinAgents agents match.
+type AlertRule struct {
+	Id        string
+	Name      string
+	Type      string //dns, mtr or curl, empty for any
+	Target    string //Only runs aimed at this target, empty for any
+	Metric    string //One of alertMetrics
+	Op        string //>, >=, <, <=, == or !=. Defaults to > which, with Value 0, means "error is set" for the error metric
+	Value     float64
+	MinAgents int      //Defaults to 1
+	Webhooks  []string //URLs notifications are POSTed to
+	Disabled  bool
+}
+
+// validate checks a rule and fills in defaults.
+func (rule *AlertRule) validate() error {
+	applies, ok := alertMetrics[rule.Metric]
+	if !ok {
+		return errors.New("unknown metric: " + rule.Metric)
+	}
+	if rule.Type != "" {
+		typ, err := ParseTestType(rule.Type)
+		if err != nil {
+			return err
+		}
+		if applies != 0 && applies != typ {
+			return fmt.Errorf("metric %s does not apply to %s tests", rule.Metric, rule.Type)
+		}
+	}
+	if rule.Op == "" {
+		rule.Op = ">"
+	}
+	if _, err := compare(rule.Op, 0, 0); err != nil {
+		return err
+	}
+	if rule.MinAgents < 0 {
+		return errors.New("MinAgents can not be negative")
+	}
+	if rule.MinAgents == 0 {
+		rule.MinAgents = 1
+	}
+	if len(rule.Webhooks) == 0 {
+		return errors.New("at least one webhook is needed")
+	}
+	for _, hook := range rule.Webhooks {
+		u, err := url.Parse(hook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("invalid webhook url: " + hook)
+		}
+	}
+	return nil
+}
+
+// appliesTo answers if the rule looks at run.
+func (rule *AlertRule) appliesTo(run *Run) bool {
+	if rule.Disabled {
+		return false
+	}
+	if rule.Type != "" {
+		if typ, _ := ParseTestType(rule.Type); typ != run.Type {
+			return false
+		}
+	}
+	if applies := alertMetrics[rule.Metric]; applies != 0 && applies != run.Type {
+		return false
+	}
+	return rule.Target == "" || normalizeTarget(rule.Target) == normalizeTarget(run.Target)
+}
+
+func compare(op string, a, b float64) (bool, error) {
+	switch op {
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case "==":
+		return a == b, nil
+	case "!=":
+		return a != b, nil
+	}
+	return false, errors.New("unknown operator: " + op)
+}
+
+// Alert is the state of a rule for one target.
+type Alert struct {
+	Key        string //Rule id and target, alerts are deduplicated on it
+	RuleId     string
+	RuleName   string
+	Target     string
+	State      string
+	Agents     []string //Agents that matched in the last run
+	Matched    int      //Number of agents that matched in the last run
+	Total      int      //Number of agents the rule could be evaluated on in the last run
+	RunId      string   //Last run evaluated
+	FiredAt    time.Time
+	UpdatedAt  time.Time
+	ResolvedAt time.Time
+}
+
+// AlertNotification is the json payload POSTed to webhooks when an
+// alert starts firing or gets resolved.
+type AlertNotification struct {
+	Status string //firing or resolved
+	Alert  *Alert
+	Rule   *AlertRule
+}
+
+// AlertManager evaluates alert rules against runs and notifies webhooks
+// when alerts change state. Rules and firing alerts are kept in a DocStore
+// so alerts are not sent again after a restart.
+type AlertManager struct {
+	docs   DocStore
+	rules  map[string]*AlertRule
+	active map[string]*Alert
+	client *http.Client
+	retry  time.Duration //Delay before retrying a failed delivery, doubled every attempt
+	lock   sync.Mutex
+}
+
+// NewAlertManager answers an AlertManager using the rules and alerts saved in docs.
+func NewAlertManager(docs DocStore) (*AlertManager, error) {
+	m := &AlertManager{
+		docs:   docs,
+		rules:  make(map[string]*AlertRule),
+		active: make(map[string]*Alert),
+		client: &http.Client{Timeout: time.Second * 10},
+		retry:  time.Second * 5,
+	}
+	raw, err := docs.List(alertRulesCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, data := range raw {
+		rule := new(AlertRule)
+		if err := json.Unmarshal(data, rule); err != nil {
+			return nil, err
+		}
+		m.rules[rule.Id] = rule
+	}
+	raw, err = docs.List(alertsCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, data := range raw {
+		alert := new(Alert)
+		if err := json.Unmarshal(data, alert); err != nil {
+			return nil, err
+		}
+		m.active[alert.Key] = alert
+	}
+	return m, nil
+}
+
+// History answers a HistoryStore that evaluates every run saved into store.
+func (m *AlertManager) History(store HistoryStore) HistoryStore {
+	return &alertingHistory{store, m}
+}
+
+type alertingHistory struct {
+	HistoryStore
+	alerts *AlertManager
+}
+
+func (h *alertingHistory) Save(run *Run) error {
+	h.alerts.Evaluate(run)
+	return h.HistoryStore.Save(run)
+}
+
+// Evaluate runs every rule against run, firing and resolving alerts.
+func (m *AlertManager) Evaluate(run *Run) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	target := normalizeTarget(run.Target)
+	for _, rule := range m.rules {
+		if !rule.appliesTo(run) {
+			continue
+		}
+		matched := make([]string, 0)
+		total := 0
+		for _, res := range run.Results {
+			values := metricValues(rule.Metric, res)
+			if len(values) == 0 {
+				continue
+			}
+			total++
+			for _, v := range values {
+				if ok, _ := compare(rule.Op, v, rule.Value); ok {
+					matched = append(matched, agentName(res))
+					break
+				}
+			}
+		}
+		if total == 0 {
+			//Nothing to judge on, leave the alert as it is
+			continue
+		}
+		key := rule.Id + "/" + target
+		alert, firing := m.active[key]
+		if len(matched) >= rule.MinAgents {
+			if !firing {
+				alert = &Alert{
+					Key:      key,
+					RuleId:   rule.Id,
+					RuleName: rule.Name,
+					Target:   target,
+					State:    AlertFiring,
+					FiredAt:  now,
+				}
+				m.active[key] = alert
+			}
+			alert.Agents = matched
+			alert.Matched = len(matched)
+			alert.Total = total
+			alert.RunId = run.Id
+			alert.UpdatedAt = now
+			if err := m.docs.Put(alertsCollection, key, alert); err != nil {
+				log.Printf("error: failed to save alert %s: %s", key, err)
+			}
+			if !firing {
+				m.notify(rule, alert)
+			}
+		} else if firing {
+			alert.State = AlertResolved
+			alert.Agents = matched
+			alert.Matched = len(matched)
+			alert.Total = total
+			alert.RunId = run.Id
+			alert.UpdatedAt = now
+			alert.ResolvedAt = now
+			delete(m.active, key)
+			if err := m.docs.Delete(alertsCollection, key); err != nil && err != ErrDocNotFound {
+				log.Printf("error: failed to delete alert %s: %s", key, err)
+			}
+			m.notify(rule, alert)
+		}
+	}
+}
+
+// notify delivers a copy of alert to the webhooks of rule in the background.
+// Caller must hold m.lock.
+func (m *AlertManager) notify(rule *AlertRule, alert *Alert) {
+	a := *alert
+	r := *rule
+	payload, err := json.Marshal(&AlertNotification{Status: a.State, Alert: &a, Rule: &r})
+	if err != nil {
+		log.Printf("error: failed to encode alert %s: %s", a.Key, err)
+		return
+	}
+	log.Printf("alert %s is %s", a.Key, a.State)
+	for _, hook := range r.Webhooks {
+		go m.deliver(hook, payload)
+	}
+}
+
+// deliver POSTs payload to hook, retrying a few times on failure.
+func (m *AlertManager) deliver(hook string, payload []byte) {
+	wait := m.retry
+	for attempt := 1; ; attempt++ {
+		resp, err := m.client.Post(hook, "application/json", bytes.NewReader(payload))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = errors.New(resp.Status)
+		}
+		if attempt == 3 {
+			log.Printf("error: giving up delivering alert to %s: %s", hook, err)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// metricValues answers the values of metric found in res. Results the
+// metric does not apply to, that lack it, or of tests the agent could not
+// run, answer nothing.
+func metricValues(metric string, res *pulse.CombinedResult) []float64 {
+	if res == nil || res.Unsupported || res.Busy {
+		//Not run at all, neither a failure nor a measurement
+		return nil
+	}
+	if metric == "error" {
+		if res.Err != "" || resultErr(res.Result) {
+			return []float64{1}
+		}
+		return []float64{0}
+	}
+	if res.Err != "" {
+		//Failed tests have no measurements
+		return nil
+	}
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	switch r := asResult(res.Result).(type) {
+	case *pulse.CurlResult:
+		if r.Err != "" {
+			return nil
+		}
+		switch metric {
+		case "status":
+			return []float64{float64(r.Status)}
+		case "ttfb":
+			return []float64{ms(r.Ttfb)}
+		case "dialtime":
+			return []float64{ms(r.DialTime)}
+		case "dnstime":
+			return []float64{ms(r.DNSTime)}
+		case "connecttime":
+			return []float64{ms(r.ConnectTime)}
+		case "tlstime":
+			return []float64{ms(r.TLSTime)}
+		}
+	case *pulse.DNSResult:
+		values := make([]float64, 0, len(r.Results))
+		for _, ind := range r.Results {
+			if ind.Err != "" {
+				continue
+			}
+			switch metric {
+			case "rcode":
+				if ind.Msg != nil {
+					values = append(values, float64(ind.Msg.Rcode))
+				}
+			case "rtt":
+				values = append(values, ms(ind.Rtt))
+			}
+		}
+		return values
+	case *pulse.MtrResult:
+		if metric == "loss" && r.Result != nil && len(r.Result.Hops) > 0 {
+			hop := r.Result.Hops[len(r.Result.Hops)-1]
+			return []float64{float64(hop.Loss)}
+		}
+	}
+	return nil
+}
+
+// asResult answers a pointer to the test specific result, which arrives
+// as a value from agents.
+func asResult(result interface{}) interface{} {
+	switch r := result.(type) {
+	case pulse.CurlResult:
+		return &r
+	case pulse.DNSResult:
+		return &r
+	case pulse.MtrResult:
+		return &r
+	}
+	return result
+}
+
+// resultErr answers if a test specific result reports an error.
+func resultErr(result interface{}) bool {
+	switch r := asResult(result).(type) {
+	case *pulse.CurlResult:
+		return r.Err != ""
+	case *pulse.DNSResult:
+		if r.Err != "" {
+			return true
+		}
+		for _, ind := range r.Results {
+			if ind.Err != "" {
+				return true
+			}
+		}
+	case *pulse.MtrResult:
+		return r.Err != ""
+	}
+	return false
+}
+
+func agentName(res *pulse.CombinedResult) string {
+	if res.Name != "" {
+		return res.Name
+	}
+	if res.Id != nil {
+		return res.Id.String()
+	}
+	return res.Agent
+}
+
+// Active answers copies of the firing alerts, ordered by key.
+func (m *AlertManager) Active() []*Alert {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	list := make([]*Alert, 0, len(m.active))
+	for _, alert := range m.active {
+		a := *alert
+		list = append(list, &a)
+	}
+	sort.Sort(alertsByKey(list))
+	return list
+}
+
+// Rules answers copies of all rules, ordered by id.
+func (m *AlertManager) Rules() []*AlertRule {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	list := make([]*AlertRule, 0, len(m.rules))
+	for _, rule := range m.rules {
+		r := *rule
+		list = append(list, &r)
+	}
+	sort.Sort(rulesById(list))
+	return list
+}
+
+// Rule answers a copy of the rule with the given id.
+func (m *AlertManager) Rule(id string) (*AlertRule, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rule, ok := m.rules[id]
+	if !ok {
+		return nil, ErrRuleNotFound
+	}
+	r := *rule
+	return &r, nil
+}
+
+// CreateRule validates and saves a new rule.
+func (m *AlertManager) CreateRule(rule *AlertRule) (*AlertRule, error) {
+	r := *rule
+	r.Id = NewRunID()
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	return m.saveRule(&r)
+}
+
+// UpdateRule replaces a rule. Alerts already firing for it are kept.
+func (m *AlertManager) UpdateRule(id string, rule *AlertRule) (*AlertRule, error) {
+	r := *rule
+	r.Id = id
+	if err := r.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := m.Rule(id); err != nil {
+		return nil, err
+	}
+	return m.saveRule(&r)
+}
+
+func (m *AlertManager) saveRule(rule *AlertRule) (*AlertRule, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.docs.Put(alertRulesCollection, rule.Id, rule); err != nil {
+		return nil, err
+	}
+	m.rules[rule.Id] = rule
+	r := *rule
+	return &r, nil
+}
+
+// DeleteRule removes a rule and forgets its alerts without notifying.
+func (m *AlertManager) DeleteRule(id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.rules[id]; !ok {
+		return ErrRuleNotFound
+	}
+	if err := m.docs.Delete(alertRulesCollection, id); err != nil && err != ErrDocNotFound {
+		return err
+	}
+	delete(m.rules, id)
+	for key, alert := range m.active {
+		if alert.RuleId == id {
+			delete(m.active, key)
+			m.docs.Delete(alertsCollection, key)
+		}
+	}
+	return nil
+}
+
+type alertsByKey []*Alert
+
+func (a alertsByKey) Len() int           { return len(a) }
+func (a alertsByKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a alertsByKey) Less(i, j int) bool { return a[i].Key < a[j].Key }
+
+type rulesById []*AlertRule
+
+func (a rulesById) Len() int           { return len(a) }
+func (a rulesById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a rulesById) Less(i, j int) bool { return a[i].Id < a[j].Id }
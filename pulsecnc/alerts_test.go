@@ -0,0 +1,184 @@
+package pulsecnc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+func curlRun(target string, ttfbs ...time.Duration) *Run {
+	req := &pulse.CombinedRequest{Type: pulse.TypeCurl, Args: pulse.CurlRequest{Endpoint: target}}
+	results := make([]*pulse.CombinedResult, 0, len(ttfbs))
+	for i, ttfb := range ttfbs {
+		results = append(results, &pulse.CombinedResult{
+			Type:   pulse.TypeCurl,
+			Name:   string('a' + rune(i)),
+			Result: pulse.CurlResult{Status: 200, Ttfb: ttfb},
+		})
+	}
+	return NewRun(req, results, time.Now())
+}
+
+func TestAlertMetrics(t *testing.T) {
+	curl := &pulse.CombinedResult{Result: pulse.CurlResult{Status: 503, Ttfb: time.Millisecond * 250}}
+	if v := metricValues("ttfb", curl); len(v) != 1 || v[0] != 250 {
+		t.Errorf("ttfb: %v", v)
+	}
+	if v := metricValues("status", curl); len(v) != 1 || v[0] != 503 {
+		t.Errorf("status: %v", v)
+	}
+	if v := metricValues("error", curl); len(v) != 1 || v[0] != 0 {
+		t.Errorf("error: %v", v)
+	}
+	if v := metricValues("rcode", curl); len(v) != 0 {
+		t.Errorf("rcode on curl result: %v", v)
+	}
+	failed := &pulse.CombinedResult{Err: "timeout"}
+	if v := metricValues("error", failed); len(v) != 1 || v[0] != 1 {
+		t.Errorf("error on failed result: %v", v)
+	}
+	if v := metricValues("ttfb", failed); len(v) != 0 {
+		t.Errorf("ttfb on failed result: %v", v)
+	}
+	unsupported := &pulse.CombinedResult{Err: "unsupported: mtr not usable", Unsupported: true}
+	if v := metricValues("error", unsupported); len(v) != 0 {
+		t.Errorf("error on unsupported result: %v", v)
+	}
+	dns := &pulse.CombinedResult{Result: pulse.DNSResult{Results: []pulse.IndividualDNSResult{
+		{Rtt: time.Millisecond * 10},
+		{Err: "i/o timeout"},
+	}}}
+	if v := metricValues("rtt", dns); len(v) != 1 || v[0] != 10 {
+		t.Errorf("rtt: %v", v)
+	}
+	if v := metricValues("error", dns); len(v) != 1 || v[0] != 1 {
+		t.Errorf("error on partly failed dns: %v", v)
+	}
+}
+
+func TestAlertRuleValidate(t *testing.T) {
+	m, err := NewAlertManager(NewMemoryDocStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks := []string{"http://example.com/hook"}
+	bad := []*AlertRule{
+		{Metric: "nope", Webhooks: hooks},
+		{Metric: "ttfb", Type: "dns", Webhooks: hooks},
+		{Metric: "ttfb", Op: "=~", Webhooks: hooks},
+		{Metric: "ttfb", MinAgents: -1, Webhooks: hooks},
+		{Metric: "ttfb"},
+		{Metric: "ttfb", Webhooks: []string{"ftp://example.com"}},
+	}
+	for i, rule := range bad {
+		if _, err := m.CreateRule(rule); err == nil {
+			t.Errorf("rule %d should not validate", i)
+		}
+	}
+	rule, err := m.CreateRule(&AlertRule{Metric: "error", Webhooks: hooks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Op != ">" || rule.MinAgents != 1 || rule.Id == "" {
+		t.Errorf("defaults not applied: %+v", rule)
+	}
+}
+
+func TestAlertManager(t *testing.T) {
+	notifications := make(chan AlertNotification, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n AlertNotification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		notifications <- n
+	}))
+	defer hook.Close()
+	expect := func(status string) {
+		select {
+		case n := <-notifications:
+			if n.Status != status || n.Alert.State != status || n.Rule == nil {
+				t.Errorf("expected %s notification, got %+v", status, n)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("no %s notification", status)
+		}
+	}
+	expectNone := func() {
+		select {
+		case n := <-notifications:
+			t.Errorf("unexpected notification %+v", n)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	store := NewMemoryDocStore()
+	m, err := NewAlertManager(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, err := m.CreateRule(&AlertRule{
+		Name:      "slow",
+		Type:      "curl",
+		Metric:    "ttfb",
+		Op:        ">",
+		Value:     500,
+		MinAgents: 2,
+		Webhooks:  []string{hook.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := m.History(NewMemoryHistoryStore())
+
+	//One slow agent is not enough
+	history.Save(curlRun("example.com", time.Second, time.Millisecond))
+	expectNone()
+
+	history.Save(curlRun("example.com", time.Second, time.Second, time.Millisecond))
+	expect(AlertFiring)
+	active := m.Active()
+	if len(active) != 1 || active[0].Matched != 2 || active[0].Total != 3 || active[0].RuleId != rule.Id {
+		t.Fatalf("unexpected active alerts %+v", active)
+	}
+
+	//Still firing, deduplicated
+	history.Save(curlRun("EXAMPLE.com.", time.Second, time.Second))
+	expectNone()
+
+	//Other targets are tracked separately
+	history.Save(curlRun("example.net", time.Second, time.Second))
+	expect(AlertFiring)
+	if len(m.Active()) != 2 {
+		t.Errorf("expected 2 active alerts, got %d", len(m.Active()))
+	}
+
+	//Firing alerts survive a restart
+	m2, err := NewAlertManager(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m2.Active()) != 2 || len(m2.Rules()) != 1 {
+		t.Errorf("state not restored: %d alerts, %d rules", len(m2.Active()), len(m2.Rules()))
+	}
+
+	history.Save(curlRun("example.com", time.Millisecond, time.Millisecond))
+	expect(AlertResolved)
+	if len(m.Active()) != 1 {
+		t.Errorf("expected 1 active alert, got %d", len(m.Active()))
+	}
+
+	if err := m.DeleteRule(rule.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Active()) != 0 {
+		t.Errorf("alerts of deleted rule kept")
+	}
+	if err := m.DeleteRule(rule.Id); err != ErrRuleNotFound {
+		t.Errorf("expected ErrRuleNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package pulsecnc
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles an API key can have. Each role can do everything the ones before it can.
+const (
+	RoleRead   = "read"   //List agents, read results, runs and events
+	RoleTester = "tester" //Run dns, curl and mtr tests
+	RoleAdmin  = "admin"  //Edit asndb, repopulate, manage agents, schedules and alert rules
+)
+
+var roleRanks = map[string]int{
+	RoleRead:   1,
+	RoleTester: 2,
+	RoleAdmin:  3,
+}
+
+// ErrUnauthorized is answered for requests with a missing or unknown API key.
+var ErrUnauthorized = errors.New("missing or invalid API key")
+
+// APIKey is a client of the http API.
+type APIKey struct {
+	Name         string //Shown in logs
+	Key          string //The secret, sent as "Authorization: Bearer <key>" or "X-API-Key: <key>"
+	Role         string
+	TestsPerHour int //Tests this key may run per hour, 0 for no limit
+	MaxAgents    int //Agents a single test may be sent to, 0 for no limit
+}
+
+// Allows answers if the key has role, or a role above it.
+func (k *APIKey) Allows(role string) bool {
+	return roleRanks[k.Role] >= roleRanks[role]
+}
+
+// KeyFile is the json file API keys are read from.
+type KeyFile struct {
+	Anonymous *APIKey //Optional, what requests without a key may do. Key is ignored
+	Keys      []*APIKey
+}
+
+// QuotaError is answered by Authenticator.Charge when a key is over its quota.
+type QuotaError struct {
+	Msg        string
+	RetryAfter time.Duration //Zero when waiting will not help
+}
+
+func (e *QuotaError) Error() string {
+	return e.Msg
+}
+
+// Authenticator checks API keys and keeps track of their quotas.
+type Authenticator struct {
+	keys      map[[sha256.Size]byte]*APIKey
+	anonymous *APIKey
+	usage     map[string][]time.Time //Test start times in the last hour, by key name
+	lock      sync.Mutex
+}
+
+// LoadKeys reads a KeyFile from path and answers an Authenticator for it.
+func LoadKeys(path string) (*Authenticator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kf := new(KeyFile)
+	if err := json.Unmarshal(data, kf); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return NewAuthenticator(kf)
+}
+
+// NewAuthenticator answers an Authenticator for the keys in kf.
+func NewAuthenticator(kf *KeyFile) (*Authenticator, error) {
+	a := &Authenticator{
+		keys:  make(map[[sha256.Size]byte]*APIKey),
+		usage: make(map[string][]time.Time),
+	}
+	names := make(map[string]bool)
+	for i, key := range kf.Keys {
+		if key.Name == "" {
+			return nil, fmt.Errorf("key %d has no Name", i)
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("duplicate key name %q", key.Name)
+		}
+		names[key.Name] = true
+		if len(key.Key) < 16 {
+			return nil, fmt.Errorf("key %q is shorter than 16 characters", key.Name)
+		}
+		if err := validateKey(key); err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(key.Key))
+		if _, ok := a.keys[sum]; ok {
+			return nil, fmt.Errorf("key %q is used twice", key.Name)
+		}
+		k := *key
+		a.keys[sum] = &k
+	}
+	if kf.Anonymous != nil {
+		anon := *kf.Anonymous
+		anon.Name = "anonymous"
+		anon.Key = ""
+		if err := validateKey(&anon); err != nil {
+			return nil, err
+		}
+		a.anonymous = &anon
+	}
+	return a, nil
+}
+
+func validateKey(key *APIKey) error {
+	if _, ok := roleRanks[key.Role]; !ok {
+		return fmt.Errorf("key %q has unknown role %q, expected read, tester or admin", key.Name, key.Role)
+	}
+	if key.TestsPerHour < 0 || key.MaxAgents < 0 {
+		return fmt.Errorf("key %q has a negative quota", key.Name)
+	}
+	return nil
+}
+
+// Reload replaces the keys with those in path. Quota usage is kept for
+// keys that keep their name. On error the current keys stay in place.
+func (a *Authenticator) Reload(path string) error {
+	next, err := LoadKeys(path)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.keys = next.keys
+	a.anonymous = next.anonymous
+	return nil
+}
+
+// Authenticate answers the key r was made with, the anonymous key for
+// requests without one, or ErrUnauthorized.
+func (a *Authenticator) Authenticate(r *http.Request) (*APIKey, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	secret := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); secret == "" && auth != "" {
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return nil, ErrUnauthorized
+		}
+		secret = strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if secret == "" {
+		if a.anonymous == nil {
+			return nil, ErrUnauthorized
+		}
+		return a.anonymous, nil
+	}
+	//Keys are looked up by hash so lookups do not leak timing about the secrets
+	key, ok := a.keys[sha256.Sum256([]byte(secret))]
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+	return key, nil
+}
+
+// Charge records a test sent to agents agents against the quotas of key.
+// It answers a *QuotaError, and records nothing, when the test is not allowed.
+func (a *Authenticator) Charge(key *APIKey, agents int) error {
+	if key.MaxAgents > 0 && agents > key.MaxAgents {
+		return &QuotaError{Msg: fmt.Sprintf("test would run on %d agents, key %q allows %d, use AgentFilter or Selector", agents, key.Name, key.MaxAgents)}
+	}
+	if key.TestsPerHour == 0 {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	recent := a.usage[key.Name]
+	for len(recent) > 0 && now.Sub(recent[0]) >= time.Hour {
+		recent = recent[1:]
+	}
+	if len(recent) >= key.TestsPerHour {
+		a.usage[key.Name] = recent
+		return &QuotaError{
+			Msg:        fmt.Sprintf("key %q is limited to %d tests per hour", key.Name, key.TestsPerHour),
+			RetryAfter: recent[0].Add(time.Hour).Sub(now),
+		}
+	}
+	a.usage[key.Name] = append(recent, now)
+	return nil
+}
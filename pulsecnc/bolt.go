@@ -0,0 +1,291 @@
+package pulsecnc
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets used inside the bolt database file.
+var (
+	agentsBucket   = []byte("agents")
+	runsBucket     = []byte("runs")     //Full runs by id
+	runIndexBucket = []byte("runindex") //Runs without results by id, for listing
+	docsBucket     = []byte("docs")     //Holds one nested bucket per DocStore collection
+)
+
+// OpenBolt opens (creating if needed) the single file database that backs
+// the bolt stores. All bolt stores of a process should share the same *bolt.DB.
+func OpenBolt(path string) (*bolt.DB, error) {
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+}
+
+// BoltAgentStore is an AgentStore backed by an embedded bolt database.
+type BoltAgentStore struct {
+	db *bolt.DB
+}
+
+// NewBoltAgentStore answers an AgentStore that keeps agents in db.
+func NewBoltAgentStore(db *bolt.DB) (*BoltAgentStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(agentsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltAgentStore{db: db}, nil
+}
+
+func (s *BoltAgentStore) Get(serial *big.Int) (*AgentInfo, error) {
+	var agent *AgentInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(agentsBucket).Get([]byte(serial.String()))
+		if raw == nil {
+			return ErrAgentNotFound
+		}
+		agent = new(AgentInfo)
+		return json.Unmarshal(raw, agent)
+	})
+	return agent, err
+}
+
+func (s *BoltAgentStore) Insert(agent *AgentInfo) error {
+	return s.put(agent, false)
+}
+
+func (s *BoltAgentStore) Update(agent *AgentInfo) error {
+	return s.put(agent, true)
+}
+
+// put writes agent, requiring it to exist (update) or not to exist (insert).
+func (s *BoltAgentStore) put(agent *AgentInfo, update bool) error {
+	data, err := json.Marshal(agent)
+	if err != nil {
+		return err
+	}
+	key := []byte(agent.SerialNumber.String())
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(agentsBucket)
+		exists := b.Get(key) != nil
+		if update && !exists {
+			return ErrAgentNotFound
+		}
+		if !update && exists {
+			return errors.New("agent already exists: " + string(key))
+		}
+		return b.Put(key, data)
+	})
+}
+
+func (s *BoltAgentStore) Delete(serial *big.Int) error {
+	key := []byte(serial.String())
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(agentsBucket)
+		if b.Get(key) == nil {
+			return ErrAgentNotFound
+		}
+		return b.Delete(key)
+	})
+}
+
+func (s *BoltAgentStore) List() ([]*AgentInfo, error) {
+	agents := make([]*AgentInfo, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(agentsBucket).ForEach(func(k, v []byte) error {
+			agent := new(AgentInfo)
+			if err := json.Unmarshal(v, agent); err != nil {
+				return err
+			}
+			agents = append(agents, agent)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortAgents(agents)
+	return agents, nil
+}
+
+// BoltHistoryStore is a HistoryStore backed by an embedded bolt database.
+// Run ids sort by creation time, so bolt's key ordering doubles as time ordering.
+type BoltHistoryStore struct {
+	db *bolt.DB
+}
+
+// NewBoltHistoryStore answers a HistoryStore that keeps runs in db.
+func NewBoltHistoryStore(db *bolt.DB) (*BoltHistoryStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(runsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(runIndexBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltHistoryStore{db: db}, nil
+}
+
+func (s *BoltHistoryStore) Save(run *Run) error {
+	full, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	summary, err := json.Marshal(run.summary())
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(runsBucket).Put([]byte(run.Id), full); err != nil {
+			return err
+		}
+		return tx.Bucket(runIndexBucket).Put([]byte(run.Id), summary)
+	})
+}
+
+func (s *BoltHistoryStore) Get(id string) (*Run, error) {
+	var run *Run
+	err := s.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(runsBucket).Get([]byte(id))
+		if raw == nil {
+			return ErrRunNotFound
+		}
+		run = new(Run)
+		return json.Unmarshal(raw, run)
+	})
+	return run, err
+}
+
+func (s *BoltHistoryStore) List(filter RunFilter) ([]*Run, error) {
+	runs := make([]*Run, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(runIndexBucket).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			if filter.Limit > 0 && len(runs) >= filter.Limit {
+				break
+			}
+			run := new(Run)
+			if err := json.Unmarshal(v, run); err != nil {
+				return err
+			}
+			if filter.Match(run) {
+				runs = append(runs, run)
+			}
+		}
+		return nil
+	})
+	return runs, err
+}
+
+func (s *BoltHistoryStore) Prune(retention Retention) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(runIndexBucket)
+		ids := make([][]byte, 0)
+		started := make([]time.Time, 0)
+		err := index.ForEach(func(k, v []byte) error {
+			run := new(Run)
+			if err := json.Unmarshal(v, run); err != nil {
+				return err
+			}
+			ids = append(ids, append([]byte(nil), k...))
+			started = append(started, run.StartedAt)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		removed = pruneCount(len(ids), retention, func(i int) time.Time { return started[i] })
+		for _, id := range ids[:removed] {
+			if err := index.Delete(id); err != nil {
+				return err
+			}
+			if err := tx.Bucket(runsBucket).Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// BoltDocStore is a DocStore backed by an embedded bolt database.
+// Each collection is a bucket nested in the docs bucket.
+type BoltDocStore struct {
+	db *bolt.DB
+}
+
+// NewBoltDocStore answers a DocStore that keeps documents in db.
+func NewBoltDocStore(db *bolt.DB) (*BoltDocStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(docsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltDocStore{db: db}, nil
+}
+
+func (s *BoltDocStore) Put(collection, id string, doc interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(docsBucket).CreateBucketIfNotExists([]byte(collection))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+}
+
+func (s *BoltDocStore) Get(collection, id string, doc interface{}) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(docsBucket).Bucket([]byte(collection))
+		if b == nil {
+			return ErrDocNotFound
+		}
+		data := b.Get([]byte(id))
+		if data == nil {
+			return ErrDocNotFound
+		}
+		return json.Unmarshal(data, doc)
+	})
+}
+
+func (s *BoltDocStore) Delete(collection, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(docsBucket).Bucket([]byte(collection))
+		if b == nil || b.Get([]byte(id)) == nil {
+			return ErrDocNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+func (s *BoltDocStore) List(collection string) ([]json.RawMessage, error) {
+	docs := make([]json.RawMessage, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(docsBucket).Bucket([]byte(collection))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			//v is only valid during the transaction
+			docs = append(docs, json.RawMessage(append([]byte(nil), v...)))
+			return nil
+		})
+	})
+	return docs, err
+}
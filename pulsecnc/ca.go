@@ -0,0 +1,154 @@
+package pulsecnc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+// CA signs agent certificates with the CA minions and the CNC trust.
+type CA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// LoadCA reads a PEM encoded CA certificate and its private key.
+func LoadCA(certfile, keyfile string) (*CA, error) {
+	certpem, err := ioutil.ReadFile(certfile)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(certpem)
+	if blk == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", certfile)
+	}
+	cert, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", certfile, err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s: not a CA certificate", certfile)
+	}
+	keypem, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ = pem.Decode(keypem)
+	if blk == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", keyfile)
+	}
+	if blk.Type == "ENCRYPTED PRIVATE KEY" || blk.Headers["Proc-Type"] != "" {
+		return nil, fmt.Errorf("%s: encrypted keys are not supported", keyfile)
+	}
+	key, err := pulse.ParsePrivKey(blk.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyfile, err)
+	}
+	return NewCA(cert, key)
+}
+
+// NewCA answers a CA signing with key, which must belong to cert.
+func NewCA(cert *x509.Certificate, key crypto.Signer) (*CA, error) {
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if string(pub) != string(cert.RawSubjectPublicKeyInfo) {
+		return nil, errors.New("CA private key does not match the CA certificate")
+	}
+	return &CA{cert: cert, key: key}, nil
+}
+
+// serialLimit bounds random certificate serial numbers to 128 bits.
+var serialLimit = new(big.Int).Lsh(big.NewInt(1), 128)
+
+// Sign answers a client certificate for the key of csr, named name and
+// valid for validity, or until the CA itself expires if that is sooner.
+func (ca *CA) Sign(csr *x509.CertificateRequest, name string, validity time.Duration) (*x509.Certificate, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, serialLimit)
+	if err != nil {
+		return nil, err
+	}
+	return ca.sign(&x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, csr.PublicKey, validity)
+}
+
+// Renew answers a certificate replacing old for the key of csr, valid for
+// validity like Sign. It keeps the name of old under a serial number of its
+// own, see SerialLinks for how it still leads to the agent.
+func (ca *CA) Renew(csr *x509.CertificateRequest, old *x509.Certificate, validity time.Duration) (*x509.Certificate, error) {
+	if err := old.CheckSignatureFrom(ca.cert); err != nil {
+		return nil, fmt.Errorf("certificate was not signed by this CA: %s", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, serialLimit)
+	if err != nil {
+		return nil, err
+	}
+	return ca.sign(&x509.Certificate{
+		SerialNumber: serial,
+		Subject:      old.Subject,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, csr.PublicKey, validity)
+}
+
+// sign completes template with what all certificates of the CA have in
+// common and signs it for pub.
+func (ca *CA) sign(template *x509.Certificate, pub crypto.PublicKey, validity time.Duration) (*x509.Certificate, error) {
+	now := time.Now()
+	notafter := now.Add(validity)
+	if notafter.After(ca.cert.NotAfter) {
+		notafter = ca.cert.NotAfter
+	}
+	template.NotBefore = now.Add(-time.Hour) //Some slack for clocks that are off
+	template.NotAfter = notafter
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template.BasicConstraintsValid = true
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// EncodeCertificate answers cert in PEM form.
+func EncodeCertificate(cert *x509.Certificate) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+}
+
+// ParseCertificateRequest reads a PEM encoded CSR and checks its signature.
+func ParseCertificateRequest(data string) (*x509.CertificateRequest, error) {
+	blk, _ := pem.Decode([]byte(data))
+	if blk == nil || (blk.Type != "CERTIFICATE REQUEST" && blk.Type != "NEW CERTIFICATE REQUEST") {
+		return nil, errors.New("CSR is not a PEM encoded certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid CSR signature: %s", err)
+	}
+	return csr, nil
+}
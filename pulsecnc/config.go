@@ -0,0 +1,249 @@
+package pulsecnc
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds the deployment specific settings of the CNC.
+// Values come from, in increasing order of precedence, DefaultConfig,
+// the YAML file given with -config, PULSE_* environment variables and flags.
+type Config struct {
+	File             string   `yaml:"-"`                 //Path of the config file, if any
+	CA               string   `yaml:"ca"`                //Path to CA
+	CAKey            string   `yaml:"ca_key"`            //Path to CA private key, needed to approve enrollments
+	CertValidity     Duration `yaml:"cert_validity"`     //How long certificates signed for enrolled agents are valid
+	CertWarning      Duration `yaml:"cert_warning"`      //Report agents whose certificate expires within this
+	CRL              string   `yaml:"crl"`               //Path to a CRL of agent certificates, signed by the CA
+	Cert             string   `yaml:"crt"`               //Path to server certificate
+	Key              string   `yaml:"key"`               //Path to server private key
+	TLSLegacy        bool     `yaml:"tls_legacy"`        //Only TLS 1.2 with the cipher suites of older releases
+	Store            string   `yaml:"store"`             //mongo, bolt or memory
+	DB               string   `yaml:"db"`                //Database file of the bolt store
+	Mongo            string   `yaml:"mongo"`             //Address of mongodb for the mongo store
+	Keys             string   `yaml:"keys"`              //Path to API keys file, empty to leave the API open
+	HistoryAge       Duration `yaml:"history_age"`       //How long runs are kept, 0 for forever
+	HistoryRuns      int      `yaml:"history_runs"`      //How many runs are kept, 0 for no limit
+	MinionListen     string   `yaml:"minion_listen"`     //Address minions connect to
+	MinionNetwork    string   `yaml:"minion_network"`    //tcp, tcp4 or tcp6
+	APIListen        string   `yaml:"api_listen"`        //Address of the http API
+	DefaultResolvers []string `yaml:"default_resolvers"` //Nameservers for dns tests without Targets, next to the agent's own
+	CORSOrigins      []string `yaml:"cors_origins"`      //Origins browsers may call the API from
+	PingInterval     Duration `yaml:"ping_interval"`     //How often agents are pinged
+	PingTimeout      Duration `yaml:"ping_timeout"`      //Agents not answering a ping in time are dropped
+	TestTimeout      Duration `yaml:"test_timeout"`      //Agents not answering a test in time are dropped
+}
+
+// DefaultConfig answers the settings used when nothing else is given.
+func DefaultConfig() *Config {
+	return &Config{
+		CA:               "ca.crt",
+		CertValidity:     Duration(time.Hour * 24 * 365),
+		CertWarning:      Duration(time.Hour * 24 * 14),
+		Cert:             "server.crt",
+		Key:              "server.key",
+		Store:            "mongo",
+		DB:               "pulse.db",
+		Mongo:            "127.0.0.1",
+		HistoryAge:       Duration(time.Hour * 24 * 7),
+		HistoryRuns:      10000,
+		MinionListen:     ":7777",
+		MinionNetwork:    "tcp4",
+		APIListen:        ":7778",
+		DefaultResolvers: []string{"8.8.8.8:53", "208.67.222.222:53"},
+		CORSOrigins:      []string{"https://my.turbobytes.com", "http://127.0.0.1:8000"},
+		PingInterval:     Duration(time.Second * 20),
+		PingTimeout:      Duration(time.Second * 10),
+		TestTimeout:      Duration(time.Minute),
+	}
+}
+
+// flagSet answers flags bound to the fields of c.
+func (c *Config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&c.File, "config", c.File, "Path to YAML config file")
+	fs.StringVar(&c.CA, "ca", c.CA, "Path to CA")
+	fs.StringVar(&c.CAKey, "cakey", c.CAKey, "Path to CA private key. Without it enrollments can not be approved")
+	fs.Var(&c.CertValidity, "certvalidity", "How long certificates of enrolled agents are valid")
+	fs.Var(&c.CertWarning, "certwarning", "Report agents whose certificate expires within this")
+	fs.StringVar(&c.CRL, "crl", c.CRL, "Path to a CRL, signed by the CA, of agent certificates to refuse")
+	fs.StringVar(&c.Cert, "crt", c.Cert, "Path to Server Certificate")
+	fs.StringVar(&c.Key, "key", c.Key, "Path to Private key")
+	fs.BoolVar(&c.TLSLegacy, "tlslegacy", c.TLSLegacy, "Only use TLS 1.2 with the cipher suites of older releases")
+	fs.StringVar(&c.Store, "store", c.Store, "Where agent metadata is kept: mongo, bolt or memory")
+	fs.StringVar(&c.DB, "db", c.DB, "Path to database file used by the bolt store")
+	fs.StringVar(&c.Mongo, "mongo", c.Mongo, "Address of mongodb used by the mongo store")
+	fs.StringVar(&c.Keys, "keys", c.Keys, "Path to API keys file. Without it the http API is open to anyone")
+	fs.Var(&c.HistoryAge, "historyage", "How long test runs are kept in history, 0 to keep forever")
+	fs.IntVar(&c.HistoryRuns, "historyruns", c.HistoryRuns, "Maximum number of test runs kept in history, 0 for no limit")
+	fs.StringVar(&c.MinionListen, "minionlisten", c.MinionListen, "Address minions connect to")
+	fs.StringVar(&c.MinionNetwork, "minionnetwork", c.MinionNetwork, "Network minions connect over: tcp, tcp4 or tcp6")
+	fs.StringVar(&c.APIListen, "apilisten", c.APIListen, "Address of the http API")
+	fs.Var((*listFlag)(&c.DefaultResolvers), "resolvers", "Comma separated nameservers for dns tests without targets")
+	fs.Var((*listFlag)(&c.CORSOrigins), "corsorigins", "Comma separated origins browsers may call the API from")
+	fs.Var(&c.PingInterval, "pinginterval", "How often agents are pinged")
+	fs.Var(&c.PingTimeout, "pingtimeout", "Agents not answering a ping within this are dropped")
+	fs.Var(&c.TestTimeout, "testtimeout", "Agents not answering a test within this are dropped")
+	return fs
+}
+
+// listFlag is a comma separated flag.Value. Setting it replaces the whole list.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = nil
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// envName answers the environment variable that sets a flag, e.g. PULSE_PINGINTERVAL.
+func envName(flagname string) string {
+	return "PULSE_" + strings.ToUpper(flagname)
+}
+
+// LoadConfig answers the config for the command line args, which do not
+// include the program name.
+func LoadConfig(name string, args []string) (*Config, error) {
+	c := DefaultConfig()
+	fs := c.flagSet(name)
+	//First pass only to find the config file
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if c.File == "" {
+		c.File = os.Getenv(envName("config"))
+	}
+	if c.File != "" {
+		data, err := ioutil.ReadFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("%s: %s", c.File, err)
+		}
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok && err == nil && f.Name != "config" {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("%s: %s", envName(f.Name), e)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	//Flags win over everything else
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks the config for mistakes.
+func (c *Config) Validate() error {
+	switch c.Store {
+	case "mongo", "bolt", "memory":
+	default:
+		return fmt.Errorf("unknown store %q, expected mongo, bolt or memory", c.Store)
+	}
+	switch c.MinionNetwork {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("unknown minion network %q, expected tcp, tcp4 or tcp6", c.MinionNetwork)
+	}
+	for name, addr := range map[string]string{"minion listen": c.MinionListen, "api listen": c.APIListen} {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid %s address %q: %s", name, addr, err)
+		}
+	}
+	for _, resolver := range c.DefaultResolvers {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			return fmt.Errorf("invalid default resolver %q, expected host:port", resolver)
+		}
+	}
+	for _, origin := range c.CORSOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("invalid CORS origin %q, expected scheme://host[:port]", origin)
+		}
+	}
+	if c.HistoryAge < 0 || c.HistoryRuns < 0 {
+		return errors.New("history retention can not be negative")
+	}
+	if c.PingInterval <= 0 || c.PingTimeout <= 0 || c.TestTimeout <= 0 {
+		return errors.New("ping interval, ping timeout and test timeout must be positive")
+	}
+	if c.CertValidity <= 0 {
+		return errors.New("cert validity must be positive")
+	}
+	if c.CertWarning < 0 {
+		return errors.New("cert warning can not be negative")
+	}
+	if c.PingTimeout >= c.PingInterval {
+		return errors.New("ping timeout must be shorter than the ping interval")
+	}
+	return nil
+}
+
+// Retention answers the history retention of the config.
+func (c *Config) Retention() Retention {
+	return Retention{MaxAge: time.Duration(c.HistoryAge), MaxRuns: c.HistoryRuns}
+}
+
+// AllowsOrigin answers if browsers may call the API from origin.
+func (c *Config) AllowsOrigin(origin string) bool {
+	for _, allowed := range c.CORSOrigins {
+		if strings.TrimSuffix(allowed, "/") == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// restartFields lists the yaml names of settings only read at startup.
+var restartFields = []string{"ca", "ca_key", "crt", "key", "tls_legacy", "store", "db", "mongo", "minion_listen", "minion_network", "api_listen"}
+
+// RestartNeeded answers the settings that differ between c and next and
+// only take effect after a restart.
+func (c *Config) RestartNeeded(next *Config) []string {
+	var changed []string
+	cv, nv := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	t := cv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("yaml")
+		for _, f := range restartFields {
+			if f == name && !reflect.DeepEqual(cv.Field(i).Interface(), nv.Field(i).Interface()) {
+				changed = append(changed, name)
+			}
+		}
+	}
+	if (c.Keys == "") != (next.Keys == "") {
+		changed = append(changed, "keys")
+	}
+	return changed
+}
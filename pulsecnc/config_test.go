@@ -0,0 +1,99 @@
+package pulsecnc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulseconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cnc.yaml")
+	err = ioutil.WriteFile(path, []byte(`
+store: bolt
+api_listen: 127.0.0.1:8000
+ping_interval: 30s
+default_resolvers:
+  - 1.1.1.1:53
+cors_origins: []
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadConfig("cnc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, DefaultConfig()) {
+		t.Errorf("expected defaults, got %+v", c)
+	}
+
+	os.Setenv("PULSE_PINGINTERVAL", "40s")
+	os.Setenv("PULSE_STORE", "memory")
+	defer os.Unsetenv("PULSE_PINGINTERVAL")
+	defer os.Unsetenv("PULSE_STORE")
+	c, err = LoadConfig("cnc", []string{"-config", path, "-store=bolt", "-resolvers=9.9.9.9:53, 8.8.4.4:53"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.APIListen != "127.0.0.1:8000" {
+		t.Errorf("file not applied, api listen %q", c.APIListen)
+	}
+	if c.PingInterval != Duration(time.Second*40) {
+		t.Errorf("env should override file, ping interval %s", c.PingInterval)
+	}
+	if c.Store != "bolt" {
+		t.Errorf("flags should override env, store %q", c.Store)
+	}
+	if !reflect.DeepEqual(c.DefaultResolvers, []string{"9.9.9.9:53", "8.8.4.4:53"}) {
+		t.Errorf("unexpected resolvers %v", c.DefaultResolvers)
+	}
+	if len(c.CORSOrigins) != 0 || c.MinionListen != ":7777" {
+		t.Errorf("unexpected %v %q", c.CORSOrigins, c.MinionListen)
+	}
+	if next := DefaultConfig(); !reflect.DeepEqual(c.RestartNeeded(next), []string{"store", "api_listen"}) {
+		t.Errorf("unexpected restart fields %v", c.RestartNeeded(next))
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulseconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	typo := filepath.Join(dir, "typo.yaml")
+	ioutil.WriteFile(typo, []byte("pingintervall: 5s\n"), 0600)
+	for _, args := range [][]string{
+		{"-config", typo},
+		{"-config", filepath.Join(dir, "missing.yaml")},
+		{"-store=redis"},
+		{"-minionnetwork=udp"},
+		{"-apilisten=7778"},
+		{"-resolvers=8.8.8.8"},
+		{"-corsorigins=example.com"},
+		{"-pingtimeout=30s"},
+		{"-testtimeout=0s"},
+		{"-certwarning=-1h"},
+		{"-pinginterval=soon"},
+	} {
+		if _, err := LoadConfig("cnc", args); err == nil {
+			t.Errorf("%v should not load", args)
+		}
+	}
+}
+
+func TestConfigAllowsOrigin(t *testing.T) {
+	c := DefaultConfig()
+	if !c.AllowsOrigin("https://my.turbobytes.com") || c.AllowsOrigin("https://my.turbobytes.com.evil.com") {
+		t.Error("unexpected origin check")
+	}
+}
@@ -0,0 +1,47 @@
+package pulsecnc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	//A wednesday
+	base := time.Date(2016, time.October, 12, 10, 17, 30, 0, time.UTC)
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2016, time.October, 12, 10, 18, 0, 0, time.UTC)},
+		{"*/5 * * * *", time.Date(2016, time.October, 12, 10, 20, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2016, time.October, 12, 11, 0, 0, 0, time.UTC)},
+		{"15,45 9-17 * * *", time.Date(2016, time.October, 12, 10, 45, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2016, time.October, 13, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2016, time.November, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2016, time.October, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2016, time.October, 16, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		//Day of month or day of week when both are restricted
+		{"0 0 20 * 5", time.Date(2016, time.October, 14, 0, 0, 0, 0, time.UTC)},
+		{"30 10/6 * * *", time.Date(2016, time.October, 12, 10, 30, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, c := range cases {
+		cron, err := ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("%q: %s", c.expr, err)
+			continue
+		}
+		if next := cron.Next(base); !next.Equal(c.next) {
+			t.Errorf("%q: expected %s, got %s", c.expr, c.next, next)
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%q should not parse", expr)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package pulsecnc
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrDocNotFound is returned by a DocStore when no document matches an id.
+var ErrDocNotFound = errors.New("document not found")
+
+// DocStore keeps small json documents by id, grouped in named collections.
+// It backs the CNC's own state such as schedules, next to agents and history.
+type DocStore interface {
+	// Put stores doc under id, replacing any previous document.
+	Put(collection, id string, doc interface{}) error
+	// Get decodes the document stored under id into doc, or answers ErrDocNotFound.
+	Get(collection, id string, doc interface{}) error
+	// Delete removes the document stored under id, or answers ErrDocNotFound.
+	Delete(collection, id string) error
+	// List answers all documents of a collection, ordered by id.
+	List(collection string) ([]json.RawMessage, error)
+}
+
+// MemoryDocStore is a DocStore that lives in process memory only.
+type MemoryDocStore struct {
+	docs map[string]map[string][]byte
+	lock sync.RWMutex
+}
+
+// NewMemoryDocStore answers an empty MemoryDocStore.
+func NewMemoryDocStore() *MemoryDocStore {
+	return &MemoryDocStore{docs: make(map[string]map[string][]byte)}
+}
+
+func (s *MemoryDocStore) Put(collection, id string, doc interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.docs[collection] == nil {
+		s.docs[collection] = make(map[string][]byte)
+	}
+	s.docs[collection][id] = data
+	return nil
+}
+
+func (s *MemoryDocStore) Get(collection, id string, doc interface{}) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	data, ok := s.docs[collection][id]
+	if !ok {
+		return ErrDocNotFound
+	}
+	return json.Unmarshal(data, doc)
+}
+
+func (s *MemoryDocStore) Delete(collection, id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.docs[collection][id]; !ok {
+		return ErrDocNotFound
+	}
+	delete(s.docs[collection], id)
+	return nil
+}
+
+func (s *MemoryDocStore) List(collection string) ([]json.RawMessage, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	ids := make([]string, 0, len(s.docs[collection]))
+	for id := range s.docs[collection] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	docs := make([]json.RawMessage, len(ids))
+	for i, id := range ids {
+		docs[i] = json.RawMessage(s.docs[collection][id])
+	}
+	return docs, nil
+}
@@ -0,0 +1,74 @@
+package pulsecnc
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type testDoc struct {
+	Id    string
+	Value int
+}
+
+func testDocStore(t *testing.T, store DocStore) {
+	var doc testDoc
+	if err := store.Get("things", "a", &doc); err != ErrDocNotFound {
+		t.Fatalf("expected ErrDocNotFound, got %v", err)
+	}
+	if err := store.Delete("things", "a"); err != ErrDocNotFound {
+		t.Fatalf("expected ErrDocNotFound, got %v", err)
+	}
+	for _, d := range []testDoc{{"b", 2}, {"a", 1}, {"a", 3}} {
+		if err := store.Put("things", d.Id, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Put("others", "a", testDoc{"a", 9}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Get("things", "a", &doc); err != nil || doc.Value != 3 {
+		t.Errorf("expected replaced document, got %+v %v", doc, err)
+	}
+	raw, err := store.List("things")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 2 {
+		t.Fatalf("expected 2 documents, got %d", len(raw))
+	}
+	for i, id := range []string{"a", "b"} {
+		if err := json.Unmarshal(raw[i], &doc); err != nil || doc.Id != id {
+			t.Errorf("expected document %s at %d, got %+v %v", id, i, doc, err)
+		}
+	}
+	if err := store.Delete("things", "a"); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ = store.List("things")
+	if len(raw) != 1 {
+		t.Errorf("expected 1 document after delete, got %d", len(raw))
+	}
+	raw, _ = store.List("nothing")
+	if len(raw) != 0 {
+		t.Errorf("expected empty collection, got %d", len(raw))
+	}
+}
+
+func TestMemoryDocStore(t *testing.T) {
+	testDocStore(t, NewMemoryDocStore())
+}
+
+func TestBoltDocStore(t *testing.T) {
+	path, cleanup := tempBolt(t)
+	defer cleanup()
+	db, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := NewBoltDocStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDocStore(t, store)
+}
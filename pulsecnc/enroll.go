@@ -0,0 +1,232 @@
+package pulsecnc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+// Errors answered by Enroller.
+var (
+	ErrEnrollmentNotFound = errors.New("enrollment not found")
+	ErrEnrollmentDecided  = errors.New("enrollment was already approved or rejected")
+	ErrTooManyEnrollments = errors.New("too many pending enrollments, try again later")
+	ErrNoCA               = errors.New("no CA private key configured, enrollments can not be approved")
+)
+
+// MaxPendingEnrollments caps the pending enrollments, anyone who can reach
+// the enrollment endpoint can submit one.
+var MaxPendingEnrollments = 1000
+
+const enrollmentsCollection = "enrollments"
+
+// Enrollment is a request of a minion for a certificate, and its outcome.
+type Enrollment struct {
+	pulse.EnrollStatus
+	pulse.EnrollRequest
+	Serial      string `json:",omitempty"` //Serial number of the signed certificate
+	RemoteAddr  string //Where the request came from
+	RequestedAt time.Time
+	DecidedAt   time.Time
+}
+
+// Enroller keeps track of enrollments. Approving one signs its CSR
+// and creates the agent it is for.
+type Enroller struct {
+	docs   DocStore
+	agents AgentStore
+	ca     *CA
+	lock   sync.Mutex
+}
+
+// NewEnroller answers an Enroller keeping enrollments in docs. With a nil
+// ca enrollments can be submitted and rejected, but not approved.
+func NewEnroller(docs DocStore, agents AgentStore, ca *CA) *Enroller {
+	return &Enroller{docs: docs, agents: agents, ca: ca}
+}
+
+// Submit records a new enrollment from remote. Enrollments are identified
+// by the public key of their CSR, so submitting again replaces a pending or
+// rejected enrollment for the same key and answers an approved one as is.
+func (e *Enroller) Submit(req *pulse.EnrollRequest, remote string) (*Enrollment, error) {
+	csr, err := ParseCertificateRequest(req.CSR)
+	if err != nil {
+		return nil, err
+	}
+	agent := &AgentInfo{
+		Name:           req.Name,
+		Country:        req.Country,
+		State:          req.State,
+		City:           req.City,
+		LocalResolvers: req.Resolvers,
+	}
+	if err := ValidateAgent(agent); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(csr.RawSubjectPublicKeyInfo)
+	en := &Enrollment{
+		EnrollStatus: pulse.EnrollStatus{
+			Id:     hex.EncodeToString(sum[:16]),
+			Status: pulse.EnrollPending,
+		},
+		EnrollRequest: pulse.EnrollRequest{
+			CSR:       req.CSR,
+			Name:      agent.Name,
+			Country:   agent.Country,
+			State:     agent.State,
+			City:      agent.City,
+			Resolvers: agent.LocalResolvers,
+		},
+		RemoteAddr:  remote,
+		RequestedAt: time.Now(),
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	old, err := e.get(en.Id)
+	if err != nil && err != ErrEnrollmentNotFound {
+		return nil, err
+	}
+	if old != nil && old.Status == pulse.EnrollApproved {
+		return old, nil
+	}
+	if old == nil || old.Status != pulse.EnrollPending {
+		pending, err := e.list(pulse.EnrollPending)
+		if err != nil {
+			return nil, err
+		}
+		if len(pending) >= MaxPendingEnrollments {
+			return nil, ErrTooManyEnrollments
+		}
+	}
+	if err := e.docs.Put(enrollmentsCollection, en.Id, en); err != nil {
+		return nil, err
+	}
+	return en, nil
+}
+
+// Get answers the enrollment with id.
+func (e *Enroller) Get(id string) (*Enrollment, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.get(id)
+}
+
+func (e *Enroller) get(id string) (*Enrollment, error) {
+	en := new(Enrollment)
+	err := e.docs.Get(enrollmentsCollection, id, en)
+	if err == ErrDocNotFound {
+		return nil, ErrEnrollmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return en, nil
+}
+
+// List answers the enrollments with status, or all of them if status
+// is empty, oldest first.
+func (e *Enroller) List(status string) ([]*Enrollment, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.list(status)
+}
+
+func (e *Enroller) list(status string) ([]*Enrollment, error) {
+	raw, err := e.docs.List(enrollmentsCollection)
+	if err != nil {
+		return nil, err
+	}
+	enrollments := make([]*Enrollment, 0, len(raw))
+	for _, data := range raw {
+		en := new(Enrollment)
+		if err := json.Unmarshal(data, en); err != nil {
+			return nil, err
+		}
+		if status == "" || en.Status == status {
+			enrollments = append(enrollments, en)
+		}
+	}
+	sort.Sort(enrollmentsByTime(enrollments))
+	return enrollments, nil
+}
+
+// Approve signs the CSR of a pending enrollment with a certificate valid
+// for validity and creates the agent it is for.
+func (e *Enroller) Approve(id string, validity time.Duration) (*Enrollment, error) {
+	if e.ca == nil {
+		return nil, ErrNoCA
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	en, err := e.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if en.Status != pulse.EnrollPending {
+		return nil, ErrEnrollmentDecided
+	}
+	csr, err := ParseCertificateRequest(en.CSR)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := e.ca.Sign(csr, en.Name, validity)
+	if err != nil {
+		return nil, err
+	}
+	agent := &AgentInfo{
+		Name:           en.Name,
+		Country:        en.Country,
+		State:          en.State,
+		City:           en.City,
+		LocalResolvers: en.Resolvers,
+		SerialNumber:   cert.SerialNumber,
+	}
+	if err := e.agents.Insert(agent); err != nil {
+		return nil, err
+	}
+	en.Status = pulse.EnrollApproved
+	en.Certificate = EncodeCertificate(cert)
+	en.Serial = cert.SerialNumber.String()
+	en.DecidedAt = time.Now()
+	if err := e.docs.Put(enrollmentsCollection, en.Id, en); err != nil {
+		//Still pending, leave no agent behind for approving it again
+		if err := e.agents.Delete(agent.SerialNumber); err != nil {
+			log.Printf("error: failed to remove agent %s of enrollment %s: %s", agent.SerialNumber, en.Id, err)
+		}
+		return nil, err
+	}
+	return en, nil
+}
+
+// Reject turns down a pending enrollment, reason is passed on to the minion.
+func (e *Enroller) Reject(id, reason string) (*Enrollment, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	en, err := e.get(id)
+	if err != nil {
+		return nil, err
+	}
+	if en.Status != pulse.EnrollPending {
+		return nil, ErrEnrollmentDecided
+	}
+	en.Status = pulse.EnrollRejected
+	en.Reason = reason
+	en.DecidedAt = time.Now()
+	if err := e.docs.Put(enrollmentsCollection, en.Id, en); err != nil {
+		return nil, err
+	}
+	return en, nil
+}
+
+type enrollmentsByTime []*Enrollment
+
+func (a enrollmentsByTime) Len() int           { return len(a) }
+func (a enrollmentsByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a enrollmentsByTime) Less(i, j int) bool { return a[i].RequestedAt.Before(a[j].RequestedAt) }
@@ -0,0 +1,262 @@
+package pulsecnc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+// testCA answers a fresh self signed CA.
+func testCA(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 30),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// testCSR answers a PEM encoded CSR for a new key.
+func testCSR(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "Unnamed-Agent"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func TestLoadCA(t *testing.T) {
+	cert, key := testCA(t)
+	dir, err := ioutil.TempDir("", "pulseca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certfile, keyfile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	ioutil.WriteFile(certfile, []byte(EncodeCertificate(cert)), 0644)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if _, err := LoadCA(certfile, keyfile); err != nil {
+		t.Fatal(err)
+	}
+	_, other := testCA(t)
+	der, _ = x509.MarshalECPrivateKey(other)
+	ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if _, err := LoadCA(certfile, keyfile); err == nil {
+		t.Error("CA with a key of another certificate should not load")
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	cert, key := testCA(t)
+	ca, err := NewCA(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryAgentStore()
+	e := NewEnroller(NewMemoryDocStore(), store, ca)
+	req := &pulse.EnrollRequest{
+		CSR:       testCSR(t),
+		Name:      "client0",
+		Country:   "in",
+		City:      "Mumbai",
+		Resolvers: []string{"10.0.0.1"},
+	}
+	en, err := e.Submit(req, "192.0.2.1:4321")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if en.Status != pulse.EnrollPending || en.Country != "IN" {
+		t.Errorf("unexpected enrollment %+v", en)
+	}
+	again, err := e.Submit(req, "192.0.2.1:4322")
+	if err != nil || again.Id != en.Id {
+		t.Errorf("resubmitting the same key should keep the id, got %v %v", again, err)
+	}
+	if list, _ := e.List(pulse.EnrollPending); len(list) != 1 {
+		t.Errorf("expected 1 pending enrollment, got %d", len(list))
+	}
+
+	en, err = e.Approve(en.Id, time.Hour*24*365)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if en.Status != pulse.EnrollApproved || en.Certificate == "" {
+		t.Fatalf("unexpected enrollment %+v", en)
+	}
+	blk, _ := pem.Decode([]byte(en.Certificate))
+	signed, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	if _, err := signed.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Error(err)
+	}
+	if signed.Subject.CommonName != "client0" || !signed.NotAfter.Equal(cert.NotAfter) {
+		t.Errorf("unexpected certificate %v until %v", signed.Subject, signed.NotAfter)
+	}
+	agent, err := store.Get(signed.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if agent.Name != "client0" || agent.City != "Mumbai" || len(agent.LocalResolvers) != 1 {
+		t.Errorf("unexpected agent %+v", agent)
+	}
+	if _, err := e.Approve(en.Id, time.Hour); err != ErrEnrollmentDecided {
+		t.Errorf("expected ErrEnrollmentDecided, got %v", err)
+	}
+	if again, _ := e.Submit(req, "192.0.2.1:4323"); again.Certificate != en.Certificate {
+		t.Error("resubmitting an approved enrollment should answer its certificate")
+	}
+}
+
+func TestCARenew(t *testing.T) {
+	cert, key := testCA(t)
+	ca, err := NewCA(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := ParseCertificateRequest(testCSR(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := ca.Sign(csr, "client0", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, _ = ParseCertificateRequest(testCSR(t))
+	renewed, err := ca.Renew(csr, old, time.Hour*24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.SerialNumber.Cmp(old.SerialNumber) == 0 || renewed.Subject.CommonName != "client0" {
+		t.Errorf("renewed certificate should keep the name under a new serial, got %v %v", renewed.SerialNumber, renewed.Subject)
+	}
+	if !renewed.NotAfter.After(old.NotAfter) {
+		t.Errorf("renewed certificate expires %v, not after %v", renewed.NotAfter, old.NotAfter)
+	}
+	if string(renewed.RawSubjectPublicKeyInfo) == string(old.RawSubjectPublicKeyInfo) {
+		t.Error("renewed certificate should be for the new key")
+	}
+
+	//Certificates of another CA are not renewed
+	othercert, otherkey := testCA(t)
+	other, _ := NewCA(othercert, otherkey)
+	foreign, _ := other.Sign(csr, "client1", time.Hour)
+	if _, err := ca.Renew(csr, foreign, time.Hour); err == nil {
+		t.Error("certificate of another CA should not be renewed")
+	}
+}
+
+func TestEnrollReject(t *testing.T) {
+	e := NewEnroller(NewMemoryDocStore(), NewMemoryAgentStore(), nil)
+	if _, err := e.Submit(&pulse.EnrollRequest{CSR: "nope", Name: "client0"}, ""); err == nil {
+		t.Error("invalid CSR should not be accepted")
+	}
+	if _, err := e.Submit(&pulse.EnrollRequest{CSR: testCSR(t)}, ""); err == nil {
+		t.Error("enrollment without a name should not be accepted")
+	}
+	en, err := e.Submit(&pulse.EnrollRequest{CSR: testCSR(t), Name: "client0"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Approve(en.Id, time.Hour); err != ErrNoCA {
+		t.Errorf("expected ErrNoCA, got %v", err)
+	}
+	en, err = e.Reject(en.Id, "unknown host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if en.Status != pulse.EnrollRejected || en.Reason != "unknown host" {
+		t.Errorf("unexpected enrollment %+v", en)
+	}
+	if _, err := e.Reject("missing", ""); err != ErrEnrollmentNotFound {
+		t.Errorf("expected ErrEnrollmentNotFound, got %v", err)
+	}
+
+	defer func(max int) { MaxPendingEnrollments = max }(MaxPendingEnrollments)
+	MaxPendingEnrollments = 1
+	if _, err := e.Submit(&pulse.EnrollRequest{CSR: testCSR(t), Name: "client1"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Submit(&pulse.EnrollRequest{CSR: testCSR(t), Name: "client2"}, ""); err != ErrTooManyEnrollments {
+		t.Errorf("expected ErrTooManyEnrollments, got %v", err)
+	}
+}
+
+// failingDocStore fails to Put once fail is set.
+type failingDocStore struct {
+	*MemoryDocStore
+	fail bool
+}
+
+func (s *failingDocStore) Put(collection, id string, doc interface{}) error {
+	if s.fail {
+		return errors.New("store unavailable")
+	}
+	return s.MemoryDocStore.Put(collection, id, doc)
+}
+
+func TestEnrollApproveFailed(t *testing.T) {
+	cert, key := testCA(t)
+	ca, err := NewCA(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := &failingDocStore{MemoryDocStore: NewMemoryDocStore()}
+	store := NewMemoryAgentStore()
+	e := NewEnroller(docs, store, ca)
+	en, err := e.Submit(&pulse.EnrollRequest{CSR: testCSR(t), Name: "client0"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs.fail = true
+	if _, err := e.Approve(en.Id, time.Hour); err == nil {
+		t.Fatal("approve should fail when the enrollment can not be saved")
+	}
+	if list, _ := store.List(); len(list) != 0 {
+		t.Errorf("failed approve should leave no agent behind, got %d", len(list))
+	}
+	docs.fail = false
+	if en, err = e.Approve(en.Id, time.Hour); err != nil || en.Status != pulse.EnrollApproved {
+		t.Fatalf("approving again should work, got %+v %v", en, err)
+	}
+	if list, _ := store.List(); len(list) != 1 {
+		t.Errorf("expected 1 agent, got %d", len(list))
+	}
+}
@@ -0,0 +1,80 @@
+package pulsecnc
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of AgentEvent.
+const (
+	EventConnected    = "connected"
+	EventDisconnected = "disconnected"
+	EventPingTimeout  = "ping-timeout"
+	EventRepopulated  = "repopulated"
+	EventUpdated      = "updated"
+	EventRefused      = "refused"
+	EventCertExpiring = "cert-expiring"
+	EventRenewed      = "renewed"
+)
+
+// AgentEvent is a change in the fleet of connected agents.
+type AgentEvent struct {
+	Type   string
+	Serial string //Agent's ID
+	Name   string //The name assigned to this agent
+	Reason string //Why it happened, if known
+	Time   time.Time
+}
+
+// NewAgentEvent answers an event of type typ that happens now.
+func NewAgentEvent(typ, serial, name, reason string) AgentEvent {
+	return AgentEvent{
+		Type:   typ,
+		Serial: serial,
+		Name:   name,
+		Reason: reason,
+		Time:   time.Now(),
+	}
+}
+
+// EventBus fans out agent events to any number of subscribers.
+// Publishing never blocks, subscribers that fall behind miss events.
+type EventBus struct {
+	subs map[chan AgentEvent]struct{}
+	lock sync.Mutex
+}
+
+// NewEventBus answers an EventBus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan AgentEvent]struct{})}
+}
+
+// Subscribe answers a channel receiving every event published from now on,
+// buffering up to buffer of them, and a function to call when done with it.
+func (b *EventBus) Subscribe(buffer int) (<-chan AgentEvent, func()) {
+	ch := make(chan AgentEvent, buffer)
+	b.lock.Lock()
+	b.subs[ch] = struct{}{}
+	b.lock.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.lock.Lock()
+			delete(b.subs, ch)
+			b.lock.Unlock()
+		})
+	}
+}
+
+// Publish sends ev to all subscribers that have room for it.
+func (b *EventBus) Publish(ev AgentEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			//Subscriber is not keeping up, drop it for him
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package pulsecnc
+
+import (
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	a, unsubA := bus.Subscribe(10)
+	b, unsubB := bus.Subscribe(1)
+	defer unsubB()
+
+	bus.Publish(NewAgentEvent(EventConnected, "42", "client0", ""))
+	bus.Publish(NewAgentEvent(EventDisconnected, "42", "client0", "ping timeout"))
+
+	ev := <-a
+	if ev.Type != EventConnected || ev.Serial != "42" || ev.Time.IsZero() {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	ev = <-a
+	if ev.Type != EventDisconnected || ev.Reason != "ping timeout" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	//b only had room for one event, publishing must not have blocked
+	if ev = <-b; ev.Type != EventConnected {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	select {
+	case ev = <-b:
+		t.Errorf("slow subscriber should have missed %+v", ev)
+	default:
+	}
+
+	unsubA()
+	unsubA() //Must be safe to call twice
+	bus.Publish(NewAgentEvent(EventRepopulated, "42", "client0", ""))
+	select {
+	case ev = <-a:
+		t.Errorf("unsubscribed channel got %+v", ev)
+	default:
+	}
+	if ev = <-b; ev.Type != EventRepopulated {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
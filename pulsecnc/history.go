@@ -0,0 +1,247 @@
+package pulsecnc
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrRunNotFound is returned by a HistoryStore when no run matches an id.
+var ErrRunNotFound = errors.New("run not found")
+
+// Run is one execution of a test across the fleet, as stored in history.
+type Run struct {
+	Id          string
+	Type        int                     //Test type. 1=dns, 2=mtr, 3=curl
+	Target      string                  //Host, endpoint or target the test was aimed at
+	Request     *pulse.CombinedRequest  //The request as sent to agents
+	Results     []*pulse.CombinedResult `json:",omitempty"` //Per agent results, omitted in listings
+	ResultCount int                     //Number of agents that answered
+	Agents      []string                //Serial numbers of the agents that answered
+	StartedAt   time.Time
+	CompletedAt time.Time
+}
+
+// NewRun answers a Run with a fresh id for req and its results.
+func NewRun(req *pulse.CombinedRequest, results []*pulse.CombinedResult, started time.Time) *Run {
+	run := &Run{
+		Id:          NewRunID(),
+		Type:        req.Type,
+		Target:      RunTarget(req),
+		Request:     req,
+		Results:     results,
+		ResultCount: len(results),
+		Agents:      make([]string, 0, len(results)),
+		StartedAt:   started,
+		CompletedAt: time.Now(),
+	}
+	for _, res := range results {
+		if res != nil && res.Id != nil {
+			run.Agents = append(run.Agents, res.Id.String())
+		}
+	}
+	return run
+}
+
+// NewRunID answers a unique id. Ids sort in the order they were created.
+func NewRunID() string {
+	return bson.NewObjectId().Hex()
+}
+
+// ParseTestType accepts a test type by name or number.
+func ParseTestType(v string) (int, error) {
+	switch strings.ToLower(v) {
+	case "dns", "1":
+		return pulse.TypeDNS, nil
+	case "mtr", "2":
+		return pulse.TypeMTR, nil
+	case "curl", "3":
+		return pulse.TypeCurl, nil
+	}
+	return 0, errors.New("unknown test type: " + v)
+}
+
+// TestTypeName answers the name ParseTestType accepts for a test type.
+func TestTypeName(testtype int) string {
+	switch testtype {
+	case pulse.TypeDNS:
+		return "dns"
+	case pulse.TypeMTR:
+		return "mtr"
+	case pulse.TypeCurl:
+		return "curl"
+	}
+	return "unknown"
+}
+
+// RunTarget answers what a test request was aimed at.
+func RunTarget(req *pulse.CombinedRequest) string {
+	switch args := req.Args.(type) {
+	case pulse.DNSRequest:
+		return args.Host
+	case *pulse.DNSRequest:
+		return args.Host
+	case pulse.CurlRequest:
+		return curlTarget(&args)
+	case *pulse.CurlRequest:
+		return curlTarget(args)
+	case pulse.MtrRequest:
+		return args.Target
+	case *pulse.MtrRequest:
+		return args.Target
+	}
+	return ""
+}
+
+func curlTarget(args *pulse.CurlRequest) string {
+	if args.Host != "" {
+		return args.Host
+	}
+	return args.Endpoint
+}
+
+// summary answers a copy of run without per agent results.
+func (run *Run) summary() *Run {
+	s := *run
+	s.Results = nil
+	return &s
+}
+
+// RunFilter selects runs from history. Zero values match everything.
+type RunFilter struct {
+	Type   int
+	Target string   //Matched case insensitively, trailing dots are ignored
+	Agent  *big.Int //Only runs this agent answered
+	Since  time.Time
+	Until  time.Time
+	Limit  int //Maximum number of runs to answer, newest first
+}
+
+// Match answers if run is selected by f.
+func (f *RunFilter) Match(run *Run) bool {
+	if f.Type != 0 && run.Type != f.Type {
+		return false
+	}
+	if f.Target != "" && normalizeTarget(f.Target) != normalizeTarget(run.Target) {
+		return false
+	}
+	if !f.Since.IsZero() && run.StartedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && run.StartedAt.After(f.Until) {
+		return false
+	}
+	if f.Agent != nil {
+		agent := f.Agent.String()
+		for _, a := range run.Agents {
+			if a == agent {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func normalizeTarget(target string) string {
+	return strings.ToLower(strings.TrimSuffix(target, "."))
+}
+
+// Retention limits how much history is kept. Zero values mean no limit.
+type Retention struct {
+	MaxAge  time.Duration
+	MaxRuns int
+}
+
+// HistoryStore keeps test runs.
+type HistoryStore interface {
+	// Save stores a run.
+	Save(run *Run) error
+	// Get answers the run with the given id, or ErrRunNotFound.
+	Get(id string) (*Run, error)
+	// List answers runs matching filter, newest first, without per agent results.
+	List(filter RunFilter) ([]*Run, error)
+	// Prune removes runs not within retention, answering how many were removed.
+	Prune(retention Retention) (int, error)
+}
+
+// MemoryHistoryStore is a HistoryStore that lives in process memory only.
+type MemoryHistoryStore struct {
+	runs []*Run //Oldest first
+	lock sync.RWMutex
+}
+
+// NewMemoryHistoryStore answers an empty MemoryHistoryStore.
+func NewMemoryHistoryStore() *MemoryHistoryStore {
+	return &MemoryHistoryStore{runs: make([]*Run, 0)}
+}
+
+func (s *MemoryHistoryStore) Save(run *Run) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.runs = append(s.runs, run)
+	//Runs usually arrive in order, but long ones may complete after short ones
+	sort.Stable(runsByStart(s.runs))
+	return nil
+}
+
+func (s *MemoryHistoryStore) Get(id string) (*Run, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, run := range s.runs {
+		if run.Id == id {
+			return run, nil
+		}
+	}
+	return nil, ErrRunNotFound
+}
+
+func (s *MemoryHistoryStore) List(filter RunFilter) ([]*Run, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	runs := make([]*Run, 0)
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(runs) >= filter.Limit {
+			break
+		}
+		if filter.Match(s.runs[i]) {
+			runs = append(runs, s.runs[i].summary())
+		}
+	}
+	return runs, nil
+}
+
+func (s *MemoryHistoryStore) Prune(retention Retention) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	drop := pruneCount(len(s.runs), retention, func(i int) time.Time { return s.runs[i].StartedAt })
+	s.runs = append([]*Run(nil), s.runs[drop:]...)
+	return drop, nil
+}
+
+// pruneCount answers how many of the n oldest-first runs fall out of retention.
+func pruneCount(n int, retention Retention, started func(i int) time.Time) int {
+	drop := 0
+	if retention.MaxRuns > 0 && n > retention.MaxRuns {
+		drop = n - retention.MaxRuns
+	}
+	if retention.MaxAge > 0 {
+		cutoff := time.Now().Add(-retention.MaxAge)
+		for drop < n && started(drop).Before(cutoff) {
+			drop++
+		}
+	}
+	return drop
+}
+
+type runsByStart []*Run
+
+func (r runsByStart) Len() int           { return len(r) }
+func (r runsByStart) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r runsByStart) Less(i, j int) bool { return r[i].StartedAt.Before(r[j].StartedAt) }
@@ -0,0 +1,109 @@
+package pulsecnc
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+func newTestRun(typ int, args interface{}, started time.Time, agents ...int64) *Run {
+	req := &pulse.CombinedRequest{Type: typ, Args: args, RequestedAt: started}
+	results := make([]*pulse.CombinedResult, 0)
+	for _, a := range agents {
+		results = append(results, &pulse.CombinedResult{Type: typ, Id: big.NewInt(a)})
+	}
+	return NewRun(req, results, started)
+}
+
+func testHistoryStore(t *testing.T, store HistoryStore) {
+	now := time.Now()
+	old := newTestRun(pulse.TypeDNS, pulse.DNSRequest{Host: "example.com."}, now.Add(-time.Hour), 1, 2)
+	curl := newTestRun(pulse.TypeCurl, &pulse.CurlRequest{Endpoint: "1.2.3.4", Host: "www.example.com"}, now.Add(-time.Minute), 2)
+	mtr := newTestRun(pulse.TypeMTR, pulse.MtrRequest{Target: "example.com"}, now, 3)
+	for _, run := range []*Run{old, curl, mtr} {
+		if err := store.Save(run); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := store.Get(curl.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Target != "www.example.com" || len(got.Results) != 1 || got.Results[0].Id.Cmp(big.NewInt(2)) != 0 {
+		t.Errorf("unexpected run %+v", got)
+	}
+	if _, err := store.Get("nope"); err != ErrRunNotFound {
+		t.Errorf("expected ErrRunNotFound, got %v", err)
+	}
+
+	cases := []struct {
+		filter RunFilter
+		ids    []string
+	}{
+		{RunFilter{}, []string{mtr.Id, curl.Id, old.Id}},
+		{RunFilter{Limit: 1}, []string{mtr.Id}},
+		{RunFilter{Type: pulse.TypeDNS}, []string{old.Id}},
+		{RunFilter{Target: "EXAMPLE.com"}, []string{mtr.Id, old.Id}},
+		{RunFilter{Agent: big.NewInt(2)}, []string{curl.Id, old.Id}},
+		{RunFilter{Since: now.Add(-time.Minute * 30)}, []string{mtr.Id, curl.Id}},
+		{RunFilter{Until: now.Add(-time.Minute * 30)}, []string{old.Id}},
+	}
+	for i, c := range cases {
+		runs, err := store.List(c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) != len(c.ids) {
+			t.Errorf("case %d: expected %d runs, got %d", i, len(c.ids), len(runs))
+			continue
+		}
+		for j, run := range runs {
+			if run.Id != c.ids[j] {
+				t.Errorf("case %d: expected run %s at %d, got %s", i, c.ids[j], j, run.Id)
+			}
+			if run.Results != nil {
+				t.Errorf("case %d: listings should not carry results", i)
+			}
+		}
+	}
+
+	removed, err := store.Prune(Retention{MaxAge: time.Minute * 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 run pruned by age, got %d", removed)
+	}
+	removed, err = store.Prune(Retention{MaxRuns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("expected 1 run pruned by count, got %d", removed)
+	}
+	runs, _ := store.List(RunFilter{})
+	if len(runs) != 1 || runs[0].Id != mtr.Id {
+		t.Errorf("expected only the newest run to survive, got %v", runs)
+	}
+}
+
+func TestMemoryHistoryStore(t *testing.T) {
+	testHistoryStore(t, NewMemoryHistoryStore())
+}
+
+func TestBoltHistoryStore(t *testing.T) {
+	path, cleanup := tempBolt(t)
+	defer cleanup()
+	db, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := NewBoltHistoryStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testHistoryStore(t, store)
+}
@@ -0,0 +1,172 @@
+package pulsecnc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+// ErrJobNotFound is returned by JobManager when no job matches an id.
+var ErrJobNotFound = errors.New("job not found")
+
+// States of a Job.
+const (
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobCancelled = "cancelled"
+)
+
+// Dispatcher sends a test to agents. It answers a channel that yields each
+// result as it comes in and is closed once no more results are expected,
+// and the number of agents the test was sent to.
+type Dispatcher func(ctx context.Context, req *pulse.CombinedRequest) (<-chan *pulse.CombinedResult, int)
+
+// Job is a test running in the background on behalf of an API client.
+type Job struct {
+	Id          string //Also the id of the run in history once the job is over
+	Type        int
+	Target      string
+	State       string
+	Agents      int //Number of agents the test was sent to
+	Received    int //Number of results received so far
+	Results     []*pulse.CombinedResult
+	CreatedAt   time.Time
+	CompletedAt time.Time `json:",omitempty"`
+
+	req    *pulse.CombinedRequest
+	cancel context.CancelFunc
+	lock   sync.Mutex
+}
+
+// Snapshot answers a copy of the job that is safe to serialize while it runs.
+func (job *Job) Snapshot() *Job {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return &Job{
+		Id:          job.Id,
+		Type:        job.Type,
+		Target:      job.Target,
+		State:       job.State,
+		Agents:      job.Agents,
+		Received:    job.Received,
+		Results:     append([]*pulse.CombinedResult(nil), job.Results...),
+		CreatedAt:   job.CreatedAt,
+		CompletedAt: job.CompletedAt,
+	}
+}
+
+// finished answers if job is over and since when. A cancelled job is only
+// over once collect gathered what was still coming in.
+func (job *Job) finished() (bool, time.Time) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return !job.CompletedAt.IsZero(), job.CompletedAt
+}
+
+// JobManager runs tests in the background and keeps track of them.
+type JobManager struct {
+	dispatch Dispatcher
+	history  HistoryStore
+	ttl      time.Duration //How long finished jobs are kept around
+	jobs     map[string]*Job
+	lock     sync.Mutex
+}
+
+// NewJobManager answers a JobManager that runs tests using dispatch and
+// saves finished jobs into history. Finished jobs can be polled for ttl,
+// after that they are only available from history.
+func NewJobManager(dispatch Dispatcher, history HistoryStore, ttl time.Duration) *JobManager {
+	return &JobManager{
+		dispatch: dispatch,
+		history:  history,
+		ttl:      ttl,
+		jobs:     make(map[string]*Job),
+	}
+}
+
+// Submit starts req in the background and answers the new job at once.
+func (m *JobManager) Submit(req *pulse.CombinedRequest) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		Id:        NewRunID(),
+		Type:      req.Type,
+		Target:    RunTarget(req),
+		State:     JobRunning,
+		Results:   make([]*pulse.CombinedResult, 0),
+		CreatedAt: time.Now(),
+		req:       req,
+		cancel:    cancel,
+	}
+	m.lock.Lock()
+	m.purge()
+	m.jobs[job.Id] = job
+	m.lock.Unlock()
+	results, n := m.dispatch(ctx, req)
+	job.lock.Lock()
+	job.Agents = n
+	job.lock.Unlock()
+	go m.collect(job, results)
+	return job
+}
+
+// collect gathers results of job until the dispatcher is done with it.
+func (m *JobManager) collect(job *Job, results <-chan *pulse.CombinedResult) {
+	for res := range results {
+		job.lock.Lock()
+		job.Results = append(job.Results, res)
+		job.Received++
+		job.lock.Unlock()
+	}
+	job.lock.Lock()
+	if job.State == JobRunning {
+		job.State = JobDone
+	}
+	job.CompletedAt = time.Now()
+	run := NewRun(job.req, job.Results, job.CreatedAt)
+	job.lock.Unlock()
+	job.cancel() //Release context resources
+	run.Id = job.Id
+	if err := m.history.Save(run); err != nil {
+		log.Printf("error: failed to save run %s: %s", run.Id, err)
+	}
+}
+
+// Get answers the job with the given id, or ErrJobNotFound.
+func (m *JobManager) Get(id string) (*Job, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.purge()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// Cancel stops a running job. Results received so far are kept.
+func (m *JobManager) Cancel(id string) (*Job, error) {
+	job, err := m.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	job.lock.Lock()
+	if job.State == JobRunning {
+		job.State = JobCancelled
+	}
+	job.lock.Unlock()
+	job.cancel()
+	return job, nil
+}
+
+// purge forgets jobs that finished more than ttl ago. Caller must hold m.lock.
+func (m *JobManager) purge() {
+	for id, job := range m.jobs {
+		if done, at := job.finished(); done && time.Since(at) > m.ttl {
+			delete(m.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package pulsecnc
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+// fakeDispatcher answers one result per agent, each after the given delay,
+// and stops early when its context is cancelled.
+func fakeDispatcher(delays ...time.Duration) Dispatcher {
+	return func(ctx context.Context, req *pulse.CombinedRequest) (<-chan *pulse.CombinedResult, int) {
+		out := make(chan *pulse.CombinedResult, len(delays))
+		go func() {
+			defer close(out)
+			for i, d := range delays {
+				select {
+				case <-time.After(d):
+					out <- &pulse.CombinedResult{Type: req.Type, Id: big.NewInt(int64(i))}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out, len(delays)
+	}
+}
+
+// waitJob polls job until it is over or the test times out.
+func waitJob(t *testing.T, job *Job) *Job {
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		snap := job.Snapshot()
+		if snap.State != JobRunning {
+			return snap
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Fatal("job did not finish in time")
+	return nil
+}
+
+func TestJobDone(t *testing.T) {
+	history := NewMemoryHistoryStore()
+	m := NewJobManager(fakeDispatcher(0, time.Millisecond*10), history, time.Minute)
+	job := m.Submit(&pulse.CombinedRequest{Type: pulse.TypeMTR, Args: pulse.MtrRequest{Target: "example.com"}})
+	if got, err := m.Get(job.Id); err != nil || got != job {
+		t.Fatalf("job should be retrievable while running: %v", err)
+	}
+	snap := waitJob(t, job)
+	if snap.State != JobDone || snap.Agents != 2 || snap.Received != 2 || len(snap.Results) != 2 {
+		t.Errorf("unexpected job %+v", snap)
+	}
+	if snap.Target != "example.com" || snap.CompletedAt.IsZero() {
+		t.Errorf("unexpected job %+v", snap)
+	}
+	run, err := history.Get(job.Id)
+	if err != nil {
+		t.Fatal("finished job should be in history under its own id: ", err)
+	}
+	if run.ResultCount != 2 {
+		t.Errorf("expected 2 results in history, got %d", run.ResultCount)
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	history := NewMemoryHistoryStore()
+	m := NewJobManager(fakeDispatcher(0, time.Hour), history, time.Minute)
+	job := m.Submit(&pulse.CombinedRequest{Type: pulse.TypeDNS, Args: pulse.DNSRequest{Host: "example.com."}})
+	//Wait for the first result to come in
+	for job.Snapshot().Received < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := m.Cancel(job.Id); err != nil {
+		t.Fatal(err)
+	}
+	snap := waitJob(t, job)
+	if snap.State != JobCancelled || snap.Received != 1 {
+		t.Errorf("unexpected job %+v", snap)
+	}
+	if _, err := m.Cancel("nope"); err != ErrJobNotFound {
+		t.Errorf("expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestJobPurge(t *testing.T) {
+	m := NewJobManager(fakeDispatcher(), NewMemoryHistoryStore(), 0)
+	job := m.Submit(&pulse.CombinedRequest{Type: pulse.TypeDNS, Args: pulse.DNSRequest{}})
+	waitJob(t, job)
+	time.Sleep(time.Millisecond)
+	if _, err := m.Get(job.Id); err != ErrJobNotFound {
+		t.Errorf("finished job should have been purged, got %v", err)
+	}
+}
+
+func TestJobCancelledKept(t *testing.T) {
+	//A dispatcher still busy with the agents after the job was cancelled
+	release := make(chan struct{})
+	dispatch := func(ctx context.Context, req *pulse.CombinedRequest) (<-chan *pulse.CombinedResult, int) {
+		out := make(chan *pulse.CombinedResult)
+		go func() {
+			<-release
+			close(out)
+		}()
+		return out, 1
+	}
+	m := NewJobManager(dispatch, NewMemoryHistoryStore(), 0)
+	job := m.Submit(&pulse.CombinedRequest{Type: pulse.TypeDNS, Args: pulse.DNSRequest{}})
+	if _, err := m.Cancel(job.Id); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := m.Get(job.Id); err != nil {
+		t.Errorf("cancelled job should be kept until its results are collected, got %v", err)
+	}
+	close(release)
+	for job.Snapshot().CompletedAt.IsZero() {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := m.Get(job.Id); err != ErrJobNotFound {
+		t.Errorf("collected job should have been purged, got %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package pulsecnc
+
+import (
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MgoAgentStore is an AgentStore backed by a mongodb collection.
+// This is the historical storage of the CNC, documents are keyed by the
+// decimal serial number of the agent certificate.
+type MgoAgentStore struct {
+	c *mgo.Collection
+}
+
+// NewMgoAgentStore answers an AgentStore that keeps agents in c.
+func NewMgoAgentStore(c *mgo.Collection) *MgoAgentStore {
+	return &MgoAgentStore{c: c}
+}
+
+func (s *MgoAgentStore) Get(serial *big.Int) (*AgentInfo, error) {
+	agent := new(AgentInfo)
+	err := s.c.FindId(serial.String()).One(agent)
+	if err == mgo.ErrNotFound {
+		return nil, ErrAgentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+func (s *MgoAgentStore) Insert(agent *AgentInfo) error {
+	return s.c.Insert(agent)
+}
+
+// Update uses $set so fields edited by hand that AgentInfo does not know
+// about are preserved.
+func (s *MgoAgentStore) Update(agent *AgentInfo) error {
+	doc, _ := agent.GetBSON()
+	fields := bson.M{}
+	for _, elem := range doc.(bson.D) {
+		if elem.Name != "_id" {
+			fields[elem.Name] = elem.Value
+		}
+	}
+	err := s.c.UpdateId(agent.SerialNumber.String(), bson.M{"$set": fields})
+	if err == mgo.ErrNotFound {
+		return ErrAgentNotFound
+	}
+	return err
+}
+
+func (s *MgoAgentStore) Delete(serial *big.Int) error {
+	err := s.c.RemoveId(serial.String())
+	if err == mgo.ErrNotFound {
+		return ErrAgentNotFound
+	}
+	return err
+}
+
+func (s *MgoAgentStore) List() ([]*AgentInfo, error) {
+	agents := make([]*AgentInfo, 0)
+	err := s.c.Find(nil).All(&agents)
+	if err != nil {
+		return nil, err
+	}
+	sortAgents(agents)
+	return agents, nil
+}
+
+// MgoHistoryStore is a HistoryStore backed by a mongodb collection.
+// Results are kept as a json blob next to the fields used for filtering,
+// they contain types bson can not round trip (e.g. *big.Int, dns.RR).
+type MgoHistoryStore struct {
+	c *mgo.Collection
+}
+
+// mgoRun is the document stored for each run.
+type mgoRun struct {
+	Id        string    `bson:"_id"`
+	Type      int       `bson:"type"`
+	Target    string    `bson:"target"`
+	Agents    []string  `bson:"agents"`
+	StartedAt time.Time `bson:"startedat"`
+	Summary   string    `bson:"summary"`
+	Data      string    `bson:"data"`
+}
+
+// NewMgoHistoryStore answers a HistoryStore that keeps runs in c.
+func NewMgoHistoryStore(c *mgo.Collection) (*MgoHistoryStore, error) {
+	for _, key := range []string{"startedat", "target", "agents"} {
+		if err := c.EnsureIndexKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return &MgoHistoryStore{c: c}, nil
+}
+
+func (s *MgoHistoryStore) Save(run *Run) error {
+	full, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	summary, err := json.Marshal(run.summary())
+	if err != nil {
+		return err
+	}
+	return s.c.Insert(&mgoRun{
+		Id:        run.Id,
+		Type:      run.Type,
+		Target:    normalizeTarget(run.Target),
+		Agents:    run.Agents,
+		StartedAt: run.StartedAt,
+		Summary:   string(summary),
+		Data:      string(full),
+	})
+}
+
+func (s *MgoHistoryStore) Get(id string) (*Run, error) {
+	doc := new(mgoRun)
+	err := s.c.FindId(id).Select(bson.M{"data": 1}).One(doc)
+	if err == mgo.ErrNotFound {
+		return nil, ErrRunNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	run := new(Run)
+	err = json.Unmarshal([]byte(doc.Data), run)
+	return run, err
+}
+
+func (s *MgoHistoryStore) List(filter RunFilter) ([]*Run, error) {
+	query := bson.M{}
+	if filter.Type != 0 {
+		query["type"] = filter.Type
+	}
+	if filter.Target != "" {
+		query["target"] = normalizeTarget(filter.Target)
+	}
+	if filter.Agent != nil {
+		query["agents"] = filter.Agent.String()
+	}
+	started := bson.M{}
+	if !filter.Since.IsZero() {
+		started["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		started["$lte"] = filter.Until
+	}
+	if len(started) > 0 {
+		query["startedat"] = started
+	}
+	q := s.c.Find(query).Select(bson.M{"summary": 1}).Sort("-startedat")
+	if filter.Limit > 0 {
+		q = q.Limit(filter.Limit)
+	}
+	docs := make([]mgoRun, 0)
+	if err := q.All(&docs); err != nil {
+		return nil, err
+	}
+	runs := make([]*Run, 0, len(docs))
+	for _, doc := range docs {
+		run := new(Run)
+		if err := json.Unmarshal([]byte(doc.Summary), run); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func (s *MgoHistoryStore) Prune(retention Retention) (int, error) {
+	removed := 0
+	if retention.MaxAge > 0 {
+		info, err := s.c.RemoveAll(bson.M{"startedat": bson.M{"$lt": time.Now().Add(-retention.MaxAge)}})
+		if err != nil {
+			return removed, err
+		}
+		removed += info.Removed
+	}
+	if retention.MaxRuns > 0 {
+		n, err := s.c.Count()
+		if err != nil {
+			return removed, err
+		}
+		if n > retention.MaxRuns {
+			var oldest []mgoRun
+			err = s.c.Find(nil).Select(bson.M{"_id": 1}).Sort("startedat").Limit(n - retention.MaxRuns).All(&oldest)
+			if err != nil {
+				return removed, err
+			}
+			ids := make([]string, len(oldest))
+			for i, doc := range oldest {
+				ids[i] = doc.Id
+			}
+			info, err := s.c.RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+			if err != nil {
+				return removed, err
+			}
+			removed += info.Removed
+		}
+	}
+	return removed, nil
+}
+
+// MgoDocStore is a DocStore backed by a mongodb database, one mongo
+// collection per DocStore collection. Documents are kept as json blobs.
+type MgoDocStore struct {
+	db *mgo.Database
+}
+
+// mgoDoc is the document stored for each DocStore document.
+type mgoDoc struct {
+	Id   string `bson:"_id"`
+	Data string `bson:"data"`
+}
+
+// NewMgoDocStore answers a DocStore that keeps documents in db.
+func NewMgoDocStore(db *mgo.Database) *MgoDocStore {
+	return &MgoDocStore{db: db}
+}
+
+func (s *MgoDocStore) Put(collection, id string, doc interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.C(collection).UpsertId(id, &mgoDoc{Id: id, Data: string(data)})
+	return err
+}
+
+func (s *MgoDocStore) Get(collection, id string, doc interface{}) error {
+	var raw mgoDoc
+	err := s.db.C(collection).FindId(id).One(&raw)
+	if err == mgo.ErrNotFound {
+		return ErrDocNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(raw.Data), doc)
+}
+
+func (s *MgoDocStore) Delete(collection, id string) error {
+	err := s.db.C(collection).RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return ErrDocNotFound
+	}
+	return err
+}
+
+func (s *MgoDocStore) List(collection string) ([]json.RawMessage, error) {
+	var raw []mgoDoc
+	err := s.db.C(collection).Find(nil).Sort("_id").All(&raw)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]json.RawMessage, len(raw))
+	for i, doc := range raw {
+		docs[i] = json.RawMessage(doc.Data)
+	}
+	return docs, nil
+}
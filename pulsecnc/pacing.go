@@ -0,0 +1,68 @@
+package pulsecnc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+// Pacer paces sending a test to the n agents of a run as its Pacing asks.
+type Pacer struct {
+	start  time.Time
+	spread time.Duration
+	n      int
+	next   int           //Turn of the next agent to Wait
+	slots  chan struct{} //Held by agents running the test, nil for no limit
+	lock   sync.Mutex
+}
+
+// NewPacer answers a Pacer for a run to n agents starting now. A nil
+// pacing sends to all of them right away.
+func NewPacer(pacing *pulse.Pacing, n int) *Pacer {
+	p := &Pacer{start: time.Now(), n: n}
+	if pacing != nil {
+		p.spread = pacing.Spread
+		if pacing.MaxConcurrent > 0 {
+			p.slots = make(chan struct{}, pacing.MaxConcurrent)
+		}
+	}
+	return p
+}
+
+// Wait blocks until the next agent may be sent the test, and answers how
+// long after the start of the run that is. Agents take turns in the order
+// they Wait. Unless Wait fails with the error of ctx, Done must be called
+// once the agent answered.
+func (p *Pacer) Wait(ctx context.Context) (time.Duration, error) {
+	p.lock.Lock()
+	turn := p.next
+	p.next++
+	p.lock.Unlock()
+	if p.spread > 0 && p.n > 0 {
+		at := p.start.Add(p.spread * time.Duration(turn) / time.Duration(p.n))
+		timer := time.NewTimer(at.Sub(time.Now()))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		}
+	}
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	return time.Since(p.start), nil
+}
+
+// Done frees the place of an agent that answered, or never will.
+func (p *Pacer) Done() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
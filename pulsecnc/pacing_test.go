@@ -0,0 +1,65 @@
+package pulsecnc
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+func TestPacerSpread(t *testing.T) {
+	spread := time.Millisecond * 200
+	p := NewPacer(&pulse.Pacing{Spread: spread}, 4)
+	offsets := make(chan time.Duration, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			offset, err := p.Wait(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			p.Done()
+			offsets <- offset
+		}()
+	}
+	got := make([]time.Duration, 0, 4)
+	for i := 0; i < 4; i++ {
+		got = append(got, <-offsets)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	for i, offset := range got {
+		want := spread * time.Duration(i) / 4
+		if offset < want || offset > want+time.Millisecond*40 {
+			t.Errorf("agent %d: expected to start at %s, started at %s", i, want, offset)
+		}
+	}
+}
+
+func TestPacerMaxConcurrent(t *testing.T) {
+	p := NewPacer(&pulse.Pacing{MaxConcurrent: 1}, 2)
+	if _, err := p.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if _, err := p.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("second agent should wait for the first, got %v", err)
+	}
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		p.Done()
+	}()
+	offset, err := p.Wait(context.Background())
+	if err != nil || offset < time.Millisecond*50 {
+		t.Errorf("expected to start once the first is done, got %s %v", offset, err)
+	}
+
+	//No pacing at all
+	p = NewPacer(nil, 3)
+	for i := 0; i < 3; i++ {
+		if offset, err := p.Wait(context.Background()); err != nil || offset > time.Millisecond*10 {
+			t.Errorf("expected to start right away, got %s %v", offset, err)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package pulsecnc
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+// NewRootCA answers a new self signed CA named name, signing with key.
+func NewRootCA(name string, key crypto.Signer, validity time.Duration) (*CA, error) {
+	serial, err := rand.Int(rand.Reader, serialLimit)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return NewCA(cert, key)
+}
+
+// Issue answers a certificate for pub named name. Server certificates are
+// valid for hosts, names or IPs minions connect to, client certificates
+// are for minions.
+func (ca *CA) Issue(name string, server bool, hosts []string, pub crypto.PublicKey, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, serialLimit)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+	}
+	return ca.sign(template, pub, validity)
+}
+
+// PKI is a directory with a CA and the certificates it issued. It is laid
+// out like one of easyrsa: ca.crt, issued/<name>.crt and private/<name>.key.
+type PKI struct {
+	Dir string
+}
+
+// IssuedCert is a certificate in a PKI.
+type IssuedCert struct {
+	Name     string
+	Server   bool
+	Serial   string
+	NotAfter time.Time
+}
+
+// pkiName is what names of certificates issued through a PKI look like,
+// they are also file names.
+var pkiName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]{0,63}$`)
+
+// CACert answers the path of the CA certificate.
+func (p *PKI) CACert() string {
+	return filepath.Join(p.Dir, "ca.crt")
+}
+
+// CAKey answers the path of the CA private key.
+func (p *PKI) CAKey() string {
+	return p.Key("ca")
+}
+
+// Cert answers the path of the certificate named name.
+func (p *PKI) Cert(name string) string {
+	return filepath.Join(p.Dir, "issued", name+".crt")
+}
+
+// Key answers the path of the private key of the certificate named name.
+func (p *PKI) Key(name string) string {
+	return filepath.Join(p.Dir, "private", name+".key")
+}
+
+// Init creates the PKI with a new CA. An existing CA is never replaced.
+func (p *PKI) Init(name, keytype string, validity time.Duration) error {
+	if _, err := os.Stat(p.CACert()); err == nil {
+		return fmt.Errorf("%s already exists", p.CACert())
+	}
+	key, err := pulse.GeneratePrivKey(keytype)
+	if err != nil {
+		return err
+	}
+	ca, err := NewRootCA(name, key, validity)
+	if err != nil {
+		return err
+	}
+	if err := p.mkdirs(); err != nil {
+		return err
+	}
+	return p.write("ca", p.CACert(), ca.cert, key)
+}
+
+// Issue creates a key and a certificate for it signed by the CA, see CA.Issue.
+func (p *PKI) Issue(name string, server bool, hosts []string, keytype string, validity time.Duration) (*x509.Certificate, error) {
+	if !pkiName.MatchString(name) || name == "ca" {
+		return nil, fmt.Errorf("invalid name %q", name)
+	}
+	if _, err := os.Stat(p.Cert(name)); err == nil {
+		return nil, fmt.Errorf("%s already exists", p.Cert(name))
+	}
+	ca, err := LoadCA(p.CACert(), p.CAKey())
+	if err != nil {
+		return nil, err
+	}
+	key, err := pulse.GeneratePrivKey(keytype)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ca.Issue(name, server, hosts, key.Public(), validity)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.mkdirs(); err != nil {
+		return nil, err
+	}
+	return cert, p.write(name, p.Cert(name), cert, key)
+}
+
+func (p *PKI) mkdirs() error {
+	if err := os.MkdirAll(filepath.Join(p.Dir, "issued"), 0755); err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(p.Dir, "private"), 0700)
+}
+
+// write saves the key first, a certificate without its key is of no use.
+func (p *PKI) write(name, certfile string, cert *x509.Certificate, key crypto.Signer) error {
+	keypem, err := pulse.EncodePrivKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p.Key(name), keypem, 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certfile, []byte(EncodeCertificate(cert)), 0644)
+}
+
+// List answers the certificates issued in the PKI, ordered by name.
+func (p *PKI) List() ([]*IssuedCert, error) {
+	files, err := filepath.Glob(filepath.Join(p.Dir, "issued", "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*IssuedCert, 0, len(files))
+	for _, file := range files {
+		cert, err := readCertificate(file)
+		if err != nil {
+			return nil, err
+		}
+		issued := &IssuedCert{
+			Name:     strings.TrimSuffix(filepath.Base(file), ".crt"),
+			Serial:   cert.SerialNumber.String(),
+			NotAfter: cert.NotAfter,
+		}
+		for _, usage := range cert.ExtKeyUsage {
+			if usage == x509.ExtKeyUsageServerAuth {
+				issued.Server = true
+			}
+		}
+		list = append(list, issued)
+	}
+	sort.Sort(issuedByName(list))
+	return list, nil
+}
+
+// Bundle writes a tar.gz of what a new minion named name needs, its key and
+// certificate and the CA certificate, named as the minion expects by default.
+func (p *PKI) Bundle(w io.Writer, name string) error {
+	if !pkiName.MatchString(name) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	cert, err := readCertificate(p.Cert(name))
+	if err != nil {
+		return err
+	}
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		return fmt.Errorf("%s is not a minion certificate", name)
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		src, dst string
+		mode     int64
+	}{
+		{p.CACert(), "ca.crt", 0644},
+		{p.Cert(name), "minion.crt", 0644},
+		{p.Key(name), "minion.key", 0600},
+	} {
+		data, err := ioutil.ReadFile(f.src)
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: f.dst, Mode: f.mode, Size: int64(len(data)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func readCertificate(file string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(data)
+	if blk == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", file)
+	}
+	cert, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return cert, nil
+}
+
+type issuedByName []*IssuedCert
+
+func (a issuedByName) Len() int           { return len(a) }
+func (a issuedByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a issuedByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+const pkiUsage = `usage: %s pki [-dir pki] <command> [flags] [args]
+
+commands:
+  init   [-name "Pulse CA"] [-keytype ecdsa|ed25519|rsa] [-validity 87600h]
+         Creates the CA.
+  server [-keytype ecdsa|ed25519|rsa] [-validity 8760h] <hostname> [hostnames or IPs...]
+         Issues the CNC certificate, valid for the names minions connect to.
+  client [-keytype ecdsa|ed25519|rsa] [-validity 8760h] <name>
+         Issues a minion certificate. The name is shown as the agent name.
+  list   Lists issued certificates and when they expire.
+  bundle [-o <name>.tar.gz] <name>
+         Packs ca.crt, minion.crt and minion.key for the minion named name.
+`
+
+// RunPKI runs the pki subcommand of the CNC with args, those after "pki".
+func RunPKI(prog string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(prog+" pki", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.Usage = func() { fmt.Fprintf(out, pkiUsage, prog) }
+	p := new(PKI)
+	fs.StringVar(&p.Dir, "dir", "pki", "PKI directory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no command given")
+	}
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	sub := flag.NewFlagSet(prog+" pki "+cmd, flag.ContinueOnError)
+	sub.SetOutput(out)
+	validity := Duration(time.Hour * 24 * 365)
+	switch cmd {
+	case "init":
+		validity = Duration(time.Hour * 24 * 365 * 10)
+		sub.Var(&validity, "validity", "How long the CA is valid")
+		keytype := sub.String("keytype", pulse.KeyECDSA, "Key type, ecdsa, ed25519 or rsa")
+		name := sub.String("name", "Pulse CA", "Name of the CA")
+		if err := sub.Parse(args); err != nil {
+			return err
+		}
+		if err := p.Init(*name, *keytype, time.Duration(validity)); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "created", p.CACert(), "and", p.CAKey())
+	case "server", "client":
+		sub.Var(&validity, "validity", "How long the certificate is valid")
+		keytype := sub.String("keytype", pulse.KeyECDSA, "Key type, ecdsa, ed25519 or rsa")
+		if err := sub.Parse(args); err != nil {
+			return err
+		}
+		if sub.NArg() == 0 || (cmd == "client" && sub.NArg() != 1) {
+			fs.Usage()
+			return errors.New(cmd + ": name missing")
+		}
+		cert, err := p.Issue(sub.Arg(0), cmd == "server", sub.Args(), *keytype, time.Duration(validity))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "created", p.Cert(sub.Arg(0)), "and", p.Key(sub.Arg(0)), "serial", cert.SerialNumber, "valid until", cert.NotAfter)
+	case "list":
+		if err := sub.Parse(args); err != nil {
+			return err
+		}
+		list, err := p.List()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTYPE\tSERIAL\tEXPIRES\t")
+		for _, issued := range list {
+			typ, expires := "client", issued.NotAfter.UTC().Format(time.RFC3339)
+			if issued.Server {
+				typ = "server"
+			}
+			if issued.NotAfter.Before(time.Now()) {
+				expires += " (expired)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t\n", issued.Name, typ, issued.Serial, expires)
+		}
+		return tw.Flush()
+	case "bundle":
+		output := sub.String("o", "", "Output file, <name>.tar.gz by default")
+		if err := sub.Parse(args); err != nil {
+			return err
+		}
+		if sub.NArg() != 1 {
+			fs.Usage()
+			return errors.New("bundle: name missing")
+		}
+		name := sub.Arg(0)
+		if *output == "" {
+			*output = name + ".tar.gz"
+		}
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if err := p.Bundle(f, name); err != nil {
+			f.Close()
+			os.Remove(*output)
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "created", *output)
+	default:
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
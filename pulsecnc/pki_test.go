@@ -0,0 +1,218 @@
+package pulsecnc
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+func TestPKI(t *testing.T) {
+	for _, keytype := range []string{pulse.KeyECDSA, pulse.KeyEd25519, pulse.KeyRSA} {
+		dir, err := ioutil.TempDir("", "pulsepki")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		p := &PKI{Dir: filepath.Join(dir, "pki")}
+		if err := p.Init("Test CA", keytype, time.Hour*24); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Init("Test CA", keytype, time.Hour*24); err == nil {
+			t.Error("existing CA should not be replaced")
+		}
+		if _, err := p.Issue("localhost", true, []string{"localhost", "127.0.0.1"}, keytype, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Issue("client0", false, nil, keytype, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Issue("client0", false, nil, keytype, time.Hour); err == nil {
+			t.Error("existing certificate should not be replaced")
+		}
+		if _, err := p.Issue("../client1", false, nil, keytype, time.Hour); err == nil {
+			t.Error("names with a path should be refused")
+		}
+		if fi, err := os.Stat(p.Key("client0")); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("private key should only be readable by its owner: %v", err)
+		}
+
+		//What the CNC and a minion load has to shake hands
+		server := testTLSConfig(t, pulse.GetTLSConfig, p.CACert(), p.Cert("localhost"), p.Key("localhost"))
+		client := testTLSConfig(t, pulse.GetTLSConfig, p.CACert(), p.Cert("client0"), p.Key("client0"))
+		client.ServerName = "localhost"
+		if err := testHandshake(server, client); err != nil {
+			t.Errorf("%s: %v", keytype, err)
+		}
+		//Either side in legacy mode still talks to the other
+		legacy := testTLSConfig(t, pulse.GetLegacyTLSConfig, p.CACert(), p.Cert("localhost"), p.Key("localhost"))
+		if err := testHandshake(legacy, client); err != nil {
+			t.Errorf("%s: legacy server: %v", keytype, err)
+		}
+		legacy = testTLSConfig(t, pulse.GetLegacyTLSConfig, p.CACert(), p.Cert("client0"), p.Key("client0"))
+		legacy.ServerName = "localhost"
+		if err := testHandshake(server, legacy); err != nil {
+			t.Errorf("%s: legacy client: %v", keytype, err)
+		}
+		//A server certificate does not make a minion
+		client = testTLSConfig(t, pulse.GetTLSConfig, p.CACert(), p.Cert("localhost"), p.Key("localhost"))
+		client.ServerName = "localhost"
+		if err := testHandshake(server, client); err == nil {
+			t.Errorf("%s: server certificate should not be accepted from a minion", keytype)
+		}
+
+		list, err := p.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 2 || list[0].Name != "client0" || list[0].Server || !list[1].Server {
+			t.Errorf("unexpected list %+v", list)
+		}
+
+		var buf bytes.Buffer
+		if err := p.Bundle(&buf, "client0"); err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gz)
+		var names []string
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+		}
+		if strings.Join(names, ",") != "ca.crt,minion.crt,minion.key" {
+			t.Errorf("unexpected bundle %v", names)
+		}
+		if err := p.Bundle(ioutil.Discard, "localhost"); err == nil {
+			t.Error("server certificate should not be bundled for a minion")
+		}
+	}
+}
+
+func TestRunPKI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsepki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pki := filepath.Join(dir, "pki")
+	bundle := filepath.Join(dir, "client0.tar.gz")
+	var out bytes.Buffer
+	for _, args := range [][]string{
+		{"-dir", pki, "init", "-keytype", "rsa"},
+		{"-dir", pki, "server", "cnc.example.com"},
+		{"-dir", pki, "client", "-validity", "48h", "client0"},
+		{"-dir", pki, "bundle", "-o", bundle, "client0"},
+		{"-dir", pki, "list"},
+	} {
+		if err := RunPKI("cnc", args, &out); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	if !strings.Contains(out.String(), "cnc.example.com  server") {
+		t.Errorf("unexpected output %s", out.String())
+	}
+	if _, err := os.Stat(bundle); err != nil {
+		t.Error(err)
+	}
+	for _, args := range [][]string{
+		{},
+		{"-dir", pki, "revoke"},
+		{"-dir", pki, "client"},
+		{"-dir", pki, "client", "-keytype", "dsa", "client1"},
+		{"-dir", pki, "bundle", "-o", bundle, "client0"},
+	} {
+		if err := RunPKI("cnc", args, ioutil.Discard); err == nil {
+			t.Errorf("%v should fail", args)
+		}
+	}
+}
+
+// testTLSConfig answers what get answers for the files, failing t on error.
+func testTLSConfig(t *testing.T, get func(string, string, string) (*tls.Config, error), ca, cert, key string) *tls.Config {
+	cfg, err := get(ca, cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// testHandshake completes a TLS handshake between server and client.
+func testHandshake(server, client *tls.Config) error {
+	c, s, err := testConnPair()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	defer s.Close()
+	errs := make(chan error, 1)
+	go func() {
+		conn := tls.Server(s, server)
+		errs <- conn.Handshake()
+		//Let the client see the outcome
+		conn.Close()
+	}()
+	conn := tls.Client(c, client)
+	err = conn.Handshake()
+	if err == nil {
+		//With TLS 1.3 the server checks the client certificate after the client is done
+		_, err = conn.Read(make([]byte, 1))
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if serr := <-errs; serr != nil {
+		return serr
+	}
+	return err
+}
+
+// testConnPair answers both ends of a loopback TCP connection. Unlike
+// net.Pipe it is buffered, so a TLS alert sent while the other side is
+// still writing does not block both. Deadlines keep a broken handshake
+// from hanging the test.
+func testConnPair() (client, server net.Conn, err error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	server = <-accepted
+	if server == nil {
+		client.Close()
+		return nil, nil, errors.New("accept failed")
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	client.SetDeadline(deadline)
+	server.SetDeadline(deadline)
+	return client, server, nil
+}
@@ -0,0 +1,245 @@
+package pulsecnc
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Errors answered by RevocationList.
+var (
+	ErrNotRevoked = errors.New("certificate is not revoked")
+	ErrCRLListed  = errors.New("certificate is revoked by the CRL file, remove it there")
+	ErrSuperseded = errors.New("certificate was superseded by a renewal, it stays revoked")
+)
+
+const (
+	revocationsCollection = "revocations"
+	supersededCollection  = "superseded"
+)
+
+// Sources of revocations besides the path of a CRL file.
+const (
+	RevokedByAPI     = "api"     //Made through the API
+	RevokedByRenewal = "renewal" //Certificates superseded by a renewal
+)
+
+// Revocation is an agent certificate the CNC no longer accepts.
+type Revocation struct {
+	Serial    string
+	Reason    string
+	RevokedAt time.Time
+	Source    string //RevokedByAPI, RevokedByRenewal or the path of the CRL file listing it
+}
+
+// RevocationList holds the revoked agent certificates. Those revoked through
+// the API and those superseded by a renewal are kept apart in a DocStore,
+// next to them come those of a CRL file.
+type RevocationList struct {
+	docs       DocStore
+	revoked    map[string]*Revocation //Revoked through the API, by serial
+	superseded map[string]*Revocation //Superseded by a renewal, by serial
+	crl        map[string]*Revocation //Listed in the CRL file, by serial
+	lock       sync.RWMutex
+}
+
+// NewRevocationList answers a RevocationList with the revocations saved in docs.
+func NewRevocationList(docs DocStore) (*RevocationList, error) {
+	l := &RevocationList{
+		docs:       docs,
+		revoked:    make(map[string]*Revocation),
+		superseded: make(map[string]*Revocation),
+		crl:        make(map[string]*Revocation),
+	}
+	for collection, revoked := range map[string]map[string]*Revocation{
+		revocationsCollection: l.revoked,
+		supersededCollection:  l.superseded,
+	} {
+		raw, err := docs.List(collection)
+		if err != nil {
+			return nil, err
+		}
+		for _, data := range raw {
+			rev := new(Revocation)
+			if err := json.Unmarshal(data, rev); err != nil {
+				return nil, err
+			}
+			revoked[rev.Serial] = rev
+		}
+	}
+	return l, nil
+}
+
+// Revoked answers the revocation of the certificate with serial, nil if it
+// is not revoked. Those of the API and the CRL file come before the one of
+// a renewal.
+func (l *RevocationList) Revoked(serial *big.Int) *Revocation {
+	id := serial.String()
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	for _, revoked := range []map[string]*Revocation{l.revoked, l.crl, l.superseded} {
+		if rev, ok := revoked[id]; ok {
+			c := *rev
+			return &c
+		}
+	}
+	return nil
+}
+
+// Revoke stops the certificate with serial from being accepted. Revoking
+// again only changes the reason.
+func (l *RevocationList) Revoke(serial *big.Int, reason string) (*Revocation, error) {
+	return l.revoke(revocationsCollection, l.revoked, serial, reason, RevokedByAPI)
+}
+
+// Supersede revokes the certificate with serial once a renewal replaced it.
+// Unlike those of Revoke, such revocations leave the agent alone, and they
+// outlast Unrevoke.
+func (l *RevocationList) Supersede(serial *big.Int) (*Revocation, error) {
+	return l.revoke(supersededCollection, l.superseded, serial, "superseded", RevokedByRenewal)
+}
+
+// revoke saves the revocation of serial into collection and revoked.
+func (l *RevocationList) revoke(collection string, revoked map[string]*Revocation, serial *big.Int, reason, source string) (*Revocation, error) {
+	if serial == nil || serial.Sign() <= 0 {
+		return nil, errors.New("invalid serial number")
+	}
+	rev := &Revocation{
+		Serial:    serial.String(),
+		Reason:    reason,
+		RevokedAt: time.Now(),
+		Source:    source,
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if old, ok := revoked[rev.Serial]; ok {
+		rev.RevokedAt = old.RevokedAt
+	}
+	if err := l.docs.Put(collection, rev.Serial, rev); err != nil {
+		return nil, err
+	}
+	revoked[rev.Serial] = rev
+	c := *rev
+	return &c, nil
+}
+
+// Unrevoke undoes the revocation of serial through the API. Certificates
+// revoked by the CRL file stay revoked until removed from it, those
+// superseded by a renewal for good.
+func (l *RevocationList) Unrevoke(serial *big.Int) error {
+	id := serial.String()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.revoked[id]; !ok {
+		if _, ok := l.crl[id]; ok {
+			return ErrCRLListed
+		}
+		if _, ok := l.superseded[id]; ok {
+			return ErrSuperseded
+		}
+		return ErrNotRevoked
+	}
+	if err := l.docs.Delete(revocationsCollection, id); err != nil && err != ErrDocNotFound {
+		return err
+	}
+	delete(l.revoked, id)
+	return nil
+}
+
+// List answers all revocations, ordered by serial.
+func (l *RevocationList) List() []*Revocation {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	list := make([]*Revocation, 0, len(l.revoked)+len(l.crl)+len(l.superseded))
+	for _, rev := range l.revoked {
+		c := *rev
+		list = append(list, &c)
+	}
+	for id, rev := range l.crl {
+		if _, ok := l.revoked[id]; !ok {
+			c := *rev
+			list = append(list, &c)
+		}
+	}
+	for id, rev := range l.superseded {
+		_, api := l.revoked[id]
+		_, crl := l.crl[id]
+		if !api && !crl {
+			c := *rev
+			list = append(list, &c)
+		}
+	}
+	sort.Sort(revocationsBySerial(list))
+	return list
+}
+
+// LoadCRL replaces the revocations of the CRL file with those listed in
+// crlfile, which must be signed by a certificate in cafile. An empty
+// crlfile clears them. On error the current ones stay in place.
+func (l *RevocationList) LoadCRL(crlfile, cafile string) error {
+	crl := make(map[string]*Revocation)
+	if crlfile != "" {
+		data, err := ioutil.ReadFile(crlfile)
+		if err != nil {
+			return err
+		}
+		list, err := x509.ParseCRL(data)
+		if err != nil {
+			return fmt.Errorf("%s: %s", crlfile, err)
+		}
+		if err := checkCRLSignature(list, cafile); err != nil {
+			return fmt.Errorf("%s: %s", crlfile, err)
+		}
+		for _, entry := range list.TBSCertList.RevokedCertificates {
+			id := entry.SerialNumber.String()
+			crl[id] = &Revocation{Serial: id, RevokedAt: entry.RevocationTime, Source: crlfile}
+		}
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.crl = crl
+	return nil
+}
+
+// checkCRLSignature makes sure list was signed by one of the certificates in cafile.
+func checkCRLSignature(list *pkix.CertificateList, cafile string) error {
+	data, err := ioutil.ReadFile(cafile)
+	if err != nil {
+		return err
+	}
+	var lasterr error = errors.New("no certificates in " + cafile)
+	for {
+		var blk *pem.Block
+		blk, data = pem.Decode(data)
+		if blk == nil {
+			return lasterr
+		}
+		ca, err := x509.ParseCertificate(blk.Bytes)
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		if lasterr = ca.CheckCRLSignature(list); lasterr == nil {
+			return nil
+		}
+	}
+}
+
+type revocationsBySerial []*Revocation
+
+func (a revocationsBySerial) Len() int      { return len(a) }
+func (a revocationsBySerial) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a revocationsBySerial) Less(i, j int) bool {
+	if len(a[i].Serial) != len(a[j].Serial) {
+		return len(a[i].Serial) < len(a[j].Serial)
+	}
+	return a[i].Serial < a[j].Serial
+}
@@ -0,0 +1,127 @@
+package pulsecnc
+
+import (
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevocationList(t *testing.T) {
+	docs := NewMemoryDocStore()
+	l, err := NewRevocationList(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := big.NewInt(42)
+	if l.Revoked(serial) != nil {
+		t.Fatal("nothing should be revoked yet")
+	}
+	if _, err := l.Revoke(serial, "key leaked"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Revoke(big.NewInt(0), ""); err == nil {
+		t.Error("serial 0 should not be revocable")
+	}
+	if rev := l.Revoked(big.NewInt(42)); rev == nil || rev.Reason != "key leaked" || rev.Source != RevokedByAPI {
+		t.Errorf("unexpected revocation %+v", rev)
+	}
+
+	//Revocations survive a restart
+	l, err = NewRevocationList(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Revoked(serial) == nil || len(l.List()) != 1 {
+		t.Fatal("revocation lost")
+	}
+	if err := l.Unrevoke(serial); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Unrevoke(serial); err != ErrNotRevoked {
+		t.Errorf("expected ErrNotRevoked, got %v", err)
+	}
+	if l.Revoked(serial) != nil {
+		t.Error("certificate still revoked")
+	}
+	if rev, err := l.Supersede(serial); err != nil || rev.Source != RevokedByRenewal {
+		t.Errorf("unexpected revocation %+v %v", rev, err)
+	}
+
+	//Revoking a superseded certificate through the API and back leaves it superseded
+	if _, err := l.Revoke(serial, "agent decommissioned"); err != nil {
+		t.Fatal(err)
+	}
+	if rev := l.Revoked(serial); rev == nil || rev.Source != RevokedByAPI || len(l.List()) != 1 {
+		t.Errorf("expected the revocation of the API first, got %+v", rev)
+	}
+	if err := l.Unrevoke(serial); err != nil {
+		t.Fatal(err)
+	}
+	l, err = NewRevocationList(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rev := l.Revoked(serial); rev == nil || rev.Source != RevokedByRenewal {
+		t.Errorf("certificate should stay superseded, got %+v", rev)
+	}
+	if err := l.Unrevoke(serial); err != ErrSuperseded {
+		t.Errorf("expected ErrSuperseded, got %v", err)
+	}
+}
+
+func TestLoadCRL(t *testing.T) {
+	cert, key := testCA(t)
+	dir, err := ioutil.TempDir("", "pulsecrl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cafile, crlfile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "crl.pem")
+	ioutil.WriteFile(cafile, []byte(EncodeCertificate(cert)), 0644)
+	now := time.Now()
+	crl, err := cert.CreateCRL(rand.Reader, key, []pkix.RevokedCertificate{
+		{SerialNumber: big.NewInt(7), RevocationTime: now},
+		{SerialNumber: big.NewInt(9), RevocationTime: now},
+	}, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(crlfile, crl, 0644)
+
+	l, _ := NewRevocationList(NewMemoryDocStore())
+	if err := l.LoadCRL(crlfile, cafile); err != nil {
+		t.Fatal(err)
+	}
+	if rev := l.Revoked(big.NewInt(7)); rev == nil || rev.Source != crlfile {
+		t.Errorf("unexpected revocation %+v", rev)
+	}
+	if l.Revoked(big.NewInt(8)) != nil {
+		t.Error("8 is not in the CRL")
+	}
+	if err := l.Unrevoke(big.NewInt(9)); err != ErrCRLListed {
+		t.Errorf("expected ErrCRLListed, got %v", err)
+	}
+	l.Revoke(big.NewInt(9), "twice")
+	if list := l.List(); len(list) != 2 || list[1].Source != RevokedByAPI {
+		t.Errorf("unexpected list %+v", list)
+	}
+
+	//A CRL signed by another CA is refused and changes nothing
+	other, otherkey := testCA(t)
+	crl, _ = other.CreateCRL(rand.Reader, otherkey, []pkix.RevokedCertificate{{SerialNumber: big.NewInt(8), RevocationTime: now}}, now, now.Add(time.Hour))
+	ioutil.WriteFile(crlfile, crl, 0644)
+	if err := l.LoadCRL(crlfile, cafile); err == nil {
+		t.Error("CRL of another CA should not load")
+	}
+	if l.Revoked(big.NewInt(7)) == nil || l.Revoked(big.NewInt(8)) != nil {
+		t.Error("failed load changed revocations")
+	}
+	if err := l.LoadCRL("", cafile); err != nil || l.Revoked(big.NewInt(7)) != nil {
+		t.Errorf("empty crl should clear revocations: %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+package pulsecnc
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+// ErrScheduleNotFound is returned by Scheduler when no schedule matches an id.
+var ErrScheduleNotFound = errors.New("schedule not found")
+
+// MinScheduleInterval is the shortest interval a schedule may use.
+var MinScheduleInterval = time.Minute
+
+const schedulesCollection = "schedules"
+
+// Schedule is a saved test definition that the CNC runs on its own,
+// either every Interval or following a Cron expression.
+type Schedule struct {
+	Id        string
+	Name      string
+	Type      string          //dns, mtr or curl
+	Args      json.RawMessage //Same payload as the synchronous endpoint of that type, agent selection included
+	Interval  Duration        `json:",omitempty"`
+	Cron      string          `json:",omitempty"` //5 field cron expression, in the CNC's time zone
+	Jitter    Duration        `json:",omitempty"` //Up to this much random delay is added to each run
+	Paused    bool
+	NextRun   time.Time
+	LastRun   time.Time
+	LastRunId string //History id of the last run
+	LastErr   string
+	CreatedAt time.Time
+}
+
+// TestRunner runs tests on behalf of the Scheduler.
+type TestRunner interface {
+	// Parse turns a test type name and its json payload into a request.
+	Parse(testtype string, args json.RawMessage) (*pulse.CombinedRequest, error)
+	// Run runs req to completion, stores it in history and answers the run id.
+	Run(req *pulse.CombinedRequest) string
+}
+
+// Scheduler fires saved test definitions when they are due.
+type Scheduler struct {
+	docs      DocStore
+	runner    TestRunner
+	schedules map[string]*Schedule
+	running   map[string]bool //Ids of schedules with a run in progress
+	wake      chan struct{}
+	rand      *rand.Rand
+	lock      sync.Mutex
+}
+
+// NewScheduler answers a Scheduler using the schedules saved in docs.
+// Call Start to have it fire them.
+func NewScheduler(docs DocStore, runner TestRunner) (*Scheduler, error) {
+	s := &Scheduler{
+		docs:      docs,
+		runner:    runner,
+		schedules: make(map[string]*Schedule),
+		running:   make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	raw, err := docs.List(schedulesCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, data := range raw {
+		sch := new(Schedule)
+		if err := json.Unmarshal(data, sch); err != nil {
+			return nil, err
+		}
+		s.schedules[sch.Id] = sch
+	}
+	return s, nil
+}
+
+// Start fires schedules in the background, forever.
+func (s *Scheduler) Start() {
+	go func() {
+		for {
+			wait := s.tick(time.Now())
+			select {
+			case <-time.After(wait):
+			case <-s.wake:
+			}
+		}
+	}()
+}
+
+// tick fires schedules that are due at now and answers how long
+// until the next one is.
+func (s *Scheduler) tick(now time.Time) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	wait := time.Minute
+	for _, sch := range s.schedules {
+		if sch.Paused {
+			continue
+		}
+		if !sch.NextRun.After(now) {
+			if s.running[sch.Id] {
+				log.Printf("schedule %s: previous run still in progress, skipping", sch.Id)
+			} else {
+				s.running[sch.Id] = true
+				go s.fire(*sch)
+			}
+			sch.NextRun = s.next(sch, now)
+			s.save(sch)
+		}
+		if d := sch.NextRun.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// fire runs a copy of a schedule and records the outcome.
+func (s *Scheduler) fire(sch Schedule) {
+	var runid, errstr string
+	req, err := s.runner.Parse(sch.Type, sch.Args)
+	if err != nil {
+		errstr = err.Error()
+		log.Printf("schedule %s: %s", sch.Id, err)
+	} else {
+		runid = s.runner.Run(req)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.running, sch.Id)
+	current, ok := s.schedules[sch.Id]
+	if !ok {
+		//Deleted while running
+		return
+	}
+	current.LastRun = time.Now()
+	current.LastRunId = runid
+	current.LastErr = errstr
+	s.save(current)
+}
+
+// next answers when sch should run after now. Caller must hold s.lock.
+func (s *Scheduler) next(sch *Schedule, now time.Time) time.Time {
+	var next time.Time
+	if sch.Cron != "" {
+		c, err := ParseCron(sch.Cron)
+		if err != nil {
+			//validate keeps this from happening
+			return now.Add(time.Hour * 24 * 365)
+		}
+		next = c.Next(now)
+	} else {
+		next = now.Add(time.Duration(sch.Interval))
+	}
+	if sch.Jitter > 0 {
+		next = next.Add(time.Duration(s.rand.Int63n(int64(sch.Jitter) + 1)))
+	}
+	return next
+}
+
+// save persists sch. Caller must hold s.lock.
+func (s *Scheduler) save(sch *Schedule) {
+	if err := s.docs.Put(schedulesCollection, sch.Id, sch); err != nil {
+		log.Printf("error: failed to save schedule %s: %s", sch.Id, err)
+	}
+}
+
+// validate checks a schedule definition.
+func (s *Scheduler) validate(sch *Schedule) error {
+	if _, err := s.runner.Parse(sch.Type, sch.Args); err != nil {
+		return err
+	}
+	if sch.Interval != 0 && sch.Cron != "" {
+		return errors.New("set either Interval or Cron, not both")
+	}
+	if sch.Cron != "" {
+		c, err := ParseCron(sch.Cron)
+		if err != nil {
+			return err
+		}
+		if c.Next(time.Now()).IsZero() {
+			return errors.New("cron expression never fires")
+		}
+	} else if time.Duration(sch.Interval) < MinScheduleInterval {
+		return errors.New("Interval must be at least " + MinScheduleInterval.String())
+	}
+	if sch.Jitter < 0 {
+		return errors.New("Jitter can not be negative")
+	}
+	return nil
+}
+
+// notify wakes up the scheduler loop so changes apply right away.
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// List answers copies of all schedules, ordered by id.
+func (s *Scheduler) List() []*Schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list := make([]*Schedule, 0, len(s.schedules))
+	for _, sch := range s.schedules {
+		c := *sch
+		list = append(list, &c)
+	}
+	sort.Sort(schedulesById(list))
+	return list
+}
+
+// Get answers a copy of the schedule with the given id.
+func (s *Scheduler) Get(id string) (*Schedule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sch, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+	c := *sch
+	return &c, nil
+}
+
+// Create validates and saves a new schedule.
+func (s *Scheduler) Create(def *Schedule) (*Schedule, error) {
+	if err := s.validate(def); err != nil {
+		return nil, err
+	}
+	sch := &Schedule{
+		Id:        NewRunID(),
+		CreatedAt: time.Now(),
+	}
+	return s.apply(sch, def), nil
+}
+
+// Update replaces the definition of a schedule, keeping its run information.
+func (s *Scheduler) Update(id string, def *Schedule) (*Schedule, error) {
+	if err := s.validate(def); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	sch, ok := s.schedules[id]
+	s.lock.Unlock()
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+	return s.apply(sch, def), nil
+}
+
+// apply copies the definition fields of def into sch and saves it.
+func (s *Scheduler) apply(sch, def *Schedule) *Schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sch.Name = def.Name
+	sch.Type = def.Type
+	sch.Args = def.Args
+	sch.Interval = def.Interval
+	sch.Cron = def.Cron
+	sch.Jitter = def.Jitter
+	sch.Paused = def.Paused
+	sch.NextRun = s.next(sch, time.Now())
+	s.schedules[sch.Id] = sch
+	s.save(sch)
+	s.notify()
+	c := *sch
+	return &c
+}
+
+// Delete removes a schedule. A run in progress is not interrupted.
+func (s *Scheduler) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.schedules[id]; !ok {
+		return ErrScheduleNotFound
+	}
+	delete(s.schedules, id)
+	err := s.docs.Delete(schedulesCollection, id)
+	if err == ErrDocNotFound {
+		err = nil
+	}
+	return err
+}
+
+// SetPaused pauses or resumes a schedule. Resuming plans the next run from now.
+func (s *Scheduler) SetPaused(id string, paused bool) (*Schedule, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sch, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+	if sch.Paused && !paused {
+		sch.NextRun = s.next(sch, time.Now())
+	}
+	sch.Paused = paused
+	s.save(sch)
+	s.notify()
+	c := *sch
+	return &c, nil
+}
+
+type schedulesById []*Schedule
+
+func (a schedulesById) Len() int           { return len(a) }
+func (a schedulesById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a schedulesById) Less(i, j int) bool { return a[i].Id < a[j].Id }
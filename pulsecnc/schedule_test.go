@@ -0,0 +1,137 @@
+package pulsecnc
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+// fakeRunner counts runs, blocking each one until release is closed.
+type fakeRunner struct {
+	release chan struct{}
+	runs    int
+	lock    sync.Mutex
+}
+
+func (f *fakeRunner) Parse(testtype string, args json.RawMessage) (*pulse.CombinedRequest, error) {
+	if testtype != "dns" {
+		return nil, errors.New("unknown test type: " + testtype)
+	}
+	return &pulse.CombinedRequest{Type: pulse.TypeDNS}, nil
+}
+
+func (f *fakeRunner) Run(req *pulse.CombinedRequest) string {
+	<-f.release
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.runs++
+	return "run"
+}
+
+func (f *fakeRunner) count() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.runs
+}
+
+func TestScheduleValidate(t *testing.T) {
+	s, err := NewScheduler(NewMemoryDocStore(), &fakeRunner{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := []*Schedule{
+		{Type: "foo", Interval: Duration(time.Hour)},
+		{Type: "dns"},
+		{Type: "dns", Interval: Duration(time.Second)},
+		{Type: "dns", Interval: Duration(time.Hour), Cron: "* * * * *"},
+		{Type: "dns", Cron: "* * *"},
+		{Type: "dns", Cron: "0 0 30 2 *"},
+		{Type: "dns", Interval: Duration(time.Hour), Jitter: Duration(-time.Second)},
+	}
+	for i, sch := range bad {
+		if _, err := s.Create(sch); err == nil {
+			t.Errorf("schedule %d should not validate", i)
+		}
+	}
+	if len(s.List()) != 0 {
+		t.Errorf("invalid schedules were stored")
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	runner := &fakeRunner{release: make(chan struct{})}
+	store := NewMemoryDocStore()
+	s, err := NewScheduler(store, runner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sch, err := s.Create(&Schedule{Name: "hourly", Type: "dns", Interval: Duration(time.Hour), Jitter: Duration(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait := sch.NextRun.Sub(sch.CreatedAt)
+	if wait < time.Hour || wait > time.Hour+time.Minute+time.Second {
+		t.Errorf("next run outside interval plus jitter: %s", wait)
+	}
+	if d := s.tick(sch.CreatedAt); d > time.Minute {
+		t.Errorf("tick should wait at most a minute, got %s", d)
+	}
+
+	//Due, fires once; due again while running, skipped
+	now := sch.NextRun
+	s.tick(now)
+	now = now.Add(time.Hour * 2)
+	s.tick(now)
+	close(runner.release)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		got, _ := s.Get(sch.Id)
+		if got.LastRunId == "run" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("run was not recorded")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := runner.count(); n != 1 {
+		t.Errorf("expected 1 run, got %d", n)
+	}
+
+	//Paused schedules do not fire
+	if _, err := s.SetPaused(sch.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	s.tick(now.Add(time.Hour * 24))
+	time.Sleep(time.Millisecond * 50)
+	if n := runner.count(); n != 1 {
+		t.Errorf("paused schedule ran, %d runs", n)
+	}
+
+	//Schedules survive a restart
+	s2, err := NewScheduler(store, runner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s2.Get(sch.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "hourly" || !got.Paused || got.Interval != Duration(time.Hour) || got.LastRunId != "run" {
+		t.Errorf("schedule not restored: %+v", got)
+	}
+
+	if err := s.Delete(sch.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(sch.Id); err != ErrScheduleNotFound {
+		t.Errorf("expected ErrScheduleNotFound, got %v", err)
+	}
+	if err := s.Delete(sch.Id); err != ErrScheduleNotFound {
+		t.Errorf("expected ErrScheduleNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package pulsecnc
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SelectableAgent describes a connected agent to a Selector.
+type SelectableAgent struct {
+	Key      string //Identifies the agent to the caller of Select
+	Serial   string
+	Name     string
+	Country  string
+	State    string
+	City     string
+	ASN      string
+	HostType string //H, O or D
+	Version  string
+	Labels   map[string]string
+}
+
+// selectorKeys are the agent attributes a selector can match on.
+var selectorKeys = map[string]func(a *SelectableAgent) string{
+	"serial":   func(a *SelectableAgent) string { return a.Serial },
+	"name":     func(a *SelectableAgent) string { return a.Name },
+	"country":  func(a *SelectableAgent) string { return a.Country },
+	"state":    func(a *SelectableAgent) string { return a.State },
+	"city":     func(a *SelectableAgent) string { return a.City },
+	"asn":      func(a *SelectableAgent) string { return normalizeASN(a.ASN) },
+	"hosttype": func(a *SelectableAgent) string { return a.HostType },
+	"version":  func(a *SelectableAgent) string { return a.Version },
+}
+
+// hostTypes maps the names accepted in selectors to stored host types.
+var hostTypes = map[string]string{
+	"home":       "H",
+	"office":     "O",
+	"datacenter": "D",
+	"h":          "H",
+	"o":          "O",
+	"d":          "D",
+}
+
+// labelPrefix starts selector keys that match on agent labels, e.g. label.pool=canary.
+const labelPrefix = "label."
+
+// selectorGetter answers how to get the attribute key of an agent.
+func selectorGetter(key string) (func(a *SelectableAgent) string, bool) {
+	if strings.HasPrefix(key, labelPrefix) && len(key) > len(labelPrefix) {
+		label := key[len(labelPrefix):]
+		return func(a *SelectableAgent) string { return a.Labels[label] }, true
+	}
+	get, ok := selectorKeys[key]
+	return get, ok
+}
+
+// selectorTerm is one key=values condition of a selector.
+type selectorTerm struct {
+	get     func(a *SelectableAgent) string
+	values  map[string]bool //Lower case
+	exclude bool
+}
+
+func (t *selectorTerm) matches(a *SelectableAgent) bool {
+	return t.values[strings.ToLower(t.get(a))] != t.exclude
+}
+
+// Selector picks agents by their attributes. It is written as space
+// separated terms, all of which must hold :-
+//
+//	country=IN,US        Agents in any of the listed countries
+//	country!=CN          Agents not in CN, same as !country=CN
+//	state=, city=, name=, serial=, version=
+//	asn=AS9829,15169     The AS prefix is optional
+//	hosttype=home        home, office or datacenter
+//	label.pool=canary    Agents with a label, label.pool!=canary includes unlabeled ones
+//	per=asn              One random agent per asn, country, state or city
+//	random=5             5 random agents among those matching
+//
+// per is applied before random, e.g. "per=country random=3" picks three
+// agents in three different countries.
+type Selector struct {
+	terms  []*selectorTerm
+	per    string
+	random int
+}
+
+// ParseSelector parses a selector. An empty selector selects every agent.
+func ParseSelector(expr string) (*Selector, error) {
+	s := &Selector{}
+	for _, field := range strings.Fields(expr) {
+		exclude := false
+		if strings.HasPrefix(field, "!") {
+			exclude = true
+			field = field[1:]
+		}
+		i := strings.Index(field, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid selector term %q, expected key=value", field)
+		}
+		key, value := strings.ToLower(field[:i]), field[i+1:]
+		if strings.HasSuffix(key, "!") {
+			exclude = !exclude
+			key = key[:len(key)-1]
+		}
+		switch key {
+		case "random", "per":
+			if exclude {
+				return nil, fmt.Errorf("%s can not be negated", key)
+			}
+		}
+		switch key {
+		case "random":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid random count %q", value)
+			}
+			s.random = n
+		case "per":
+			value = strings.ToLower(value)
+			switch value {
+			case "asn", "country", "state", "city":
+			default:
+				return nil, fmt.Errorf("invalid per %q, expected asn, country, state or city", value)
+			}
+			s.per = value
+		default:
+			get, ok := selectorGetter(key)
+			if !ok {
+				return nil, fmt.Errorf("unknown selector key %q", key)
+			}
+			term := &selectorTerm{get: get, values: make(map[string]bool), exclude: exclude}
+			for _, v := range strings.Split(value, ",") {
+				if v == "" {
+					continue
+				}
+				switch key {
+				case "asn":
+					v = normalizeASN(v)
+				case "hosttype":
+					ht, ok := hostTypes[strings.ToLower(v)]
+					if !ok {
+						return nil, fmt.Errorf("invalid hosttype %q, expected home, office or datacenter", v)
+					}
+					v = ht
+				}
+				term.values[strings.ToLower(v)] = true
+			}
+			if len(term.values) == 0 {
+				return nil, fmt.Errorf("no values for %s", key)
+			}
+			s.terms = append(s.terms, term)
+		}
+	}
+	return s, nil
+}
+
+// Select answers the keys of the agents s picks, in key order. rnd is
+// used for random and per picks, nil means the math/rand default source.
+func (s *Selector) Select(agents []*SelectableAgent, rnd *rand.Rand) []string {
+	if rnd == nil {
+		rnd = rand.New(rand.NewSource(rand.Int63()))
+	}
+	picked := make([]*SelectableAgent, 0, len(agents))
+	for _, a := range agents {
+		if s.matches(a) {
+			picked = append(picked, a)
+		}
+	}
+	//Work in key order so picks only depend on rnd
+	sort.Sort(agentsByKey(picked))
+	if s.per != "" {
+		groups := make(map[string][]*SelectableAgent)
+		var order []string
+		for _, a := range picked {
+			g := strings.ToLower(selectorKeys[s.per](a))
+			if _, ok := groups[g]; !ok {
+				order = append(order, g)
+			}
+			groups[g] = append(groups[g], a)
+		}
+		picked = picked[:0]
+		for _, g := range order {
+			members := groups[g]
+			picked = append(picked, members[rnd.Intn(len(members))])
+		}
+	}
+	if s.random > 0 && len(picked) > s.random {
+		sample := make([]*SelectableAgent, s.random)
+		for i, j := range rnd.Perm(len(picked))[:s.random] {
+			sample[i] = picked[j]
+		}
+		picked = sample
+		sort.Sort(agentsByKey(picked))
+	}
+	keys := make([]string, len(picked))
+	for i, a := range picked {
+		keys[i] = a.Key
+	}
+	return keys
+}
+
+func (s *Selector) matches(a *SelectableAgent) bool {
+	for _, t := range s.terms {
+		if !t.matches(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeASN drops the AS prefix, so AS9829 and 9829 are the same.
+func normalizeASN(asn string) string {
+	if len(asn) > 2 && strings.EqualFold(asn[:2], "AS") {
+		return asn[2:]
+	}
+	return asn
+}
+
+type agentsByKey []*SelectableAgent
+
+func (a agentsByKey) Len() int           { return len(a) }
+func (a agentsByKey) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a agentsByKey) Less(i, j int) bool { return a[i].Key < a[j].Key }
@@ -0,0 +1,88 @@
+package pulsecnc
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+var selectorAgents = []*SelectableAgent{
+	{Key: "a", Serial: "1", Country: "IN", City: "Mumbai", ASN: "AS9829", HostType: "H", Version: "1.0", Labels: map[string]string{"pool": "canary", "isp": "bsnl"}},
+	{Key: "b", Serial: "2", Country: "IN", City: "Delhi", ASN: "AS9829", HostType: "D", Version: "1.1", Labels: map[string]string{"pool": "stable"}},
+	{Key: "c", Serial: "3", Country: "US", City: "Ashburn", ASN: "AS15169", HostType: "D", Version: "1.1"},
+	{Key: "d", Serial: "4", Country: "US", City: "Dallas", ASN: "AS7922", HostType: "O", Version: "1.1"},
+	{Key: "e", Serial: "5", Country: "CN", City: "Beijing", ASN: "AS4134", HostType: "D", Version: "1.0"},
+}
+
+func TestSelector(t *testing.T) {
+	cases := []struct {
+		expr string
+		keys []string
+	}{
+		{"", []string{"a", "b", "c", "d", "e"}},
+		{"country=in", []string{"a", "b"}},
+		{"country=IN,US hosttype=datacenter", []string{"b", "c"}},
+		{"country!=CN", []string{"a", "b", "c", "d"}},
+		{"!country=CN !city=Dallas", []string{"a", "b", "c"}},
+		{"asn=9829", []string{"a", "b"}},
+		{"asn=as15169,AS7922", []string{"c", "d"}},
+		{"hosttype=home,office", []string{"a", "d"}},
+		{"version=1.0", []string{"a", "e"}},
+		{"serial=3,5", []string{"c", "e"}},
+		{"country=FR", []string{}},
+		{"label.pool=canary", []string{"a"}},
+		{"label.pool=canary,stable label.isp!=bsnl", []string{"b"}},
+		{"!label.pool=stable", []string{"a", "c", "d", "e"}},
+	}
+	for _, c := range cases {
+		s, err := ParseSelector(c.expr)
+		if err != nil {
+			t.Errorf("%q: %s", c.expr, err)
+			continue
+		}
+		if keys := s.Select(selectorAgents, nil); !reflect.DeepEqual(keys, c.keys) {
+			t.Errorf("%q: expected %v, got %v", c.expr, c.keys, keys)
+		}
+	}
+}
+
+func TestSelectorPicks(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	s, _ := ParseSelector("per=country")
+	keys := s.Select(selectorAgents, rnd)
+	if len(keys) != 3 {
+		t.Fatalf("expected one agent per country, got %v", keys)
+	}
+	countries := make(map[string]bool)
+	for _, key := range keys {
+		for _, a := range selectorAgents {
+			if a.Key == key {
+				countries[a.Country] = true
+			}
+		}
+	}
+	if len(countries) != 3 {
+		t.Errorf("expected 3 different countries, got %v", keys)
+	}
+
+	s, _ = ParseSelector("random=2 !country=CN")
+	for i := 0; i < 20; i++ {
+		keys := s.Select(selectorAgents, rnd)
+		if len(keys) != 2 || keys[0] >= keys[1] || keys[1] == "e" {
+			t.Fatalf("unexpected random pick %v", keys)
+		}
+	}
+
+	s, _ = ParseSelector("per=asn random=10")
+	if keys := s.Select(selectorAgents, rnd); len(keys) != 4 {
+		t.Errorf("expected one agent per asn, got %v", keys)
+	}
+}
+
+func TestSelectorInvalid(t *testing.T) {
+	for _, expr := range []string{"country", "=IN", "planet=earth", "random=0", "random=x", "per=planet", "!random=2", "hosttype=castle", "country=", "country=,", "label.=x"} {
+		if _, err := ParseSelector(expr); err == nil {
+			t.Errorf("%q should not parse", expr)
+		}
+	}
+}
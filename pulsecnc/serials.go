@@ -0,0 +1,72 @@
+package pulsecnc
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync"
+)
+
+const serialsCollection = "serials"
+
+// serialLink ties the serial of a renewed certificate to its agent.
+type serialLink struct {
+	Serial string
+	Agent  string
+}
+
+// SerialLinks knows which agent a renewed certificate belongs to. An agent
+// is known by the serial of the certificate it enrolled with, its agent
+// id, while each renewal gets a serial of its own. The links are kept in a
+// DocStore.
+type SerialLinks struct {
+	docs   DocStore
+	agents map[string]string //Agent id by serial of renewed certificates
+	lock   sync.RWMutex
+}
+
+// NewSerialLinks answers SerialLinks with the links saved in docs.
+func NewSerialLinks(docs DocStore) (*SerialLinks, error) {
+	l := &SerialLinks{docs: docs, agents: make(map[string]string)}
+	raw, err := docs.List(serialsCollection)
+	if err != nil {
+		return nil, err
+	}
+	for _, data := range raw {
+		link := new(serialLink)
+		if err := json.Unmarshal(data, link); err != nil {
+			return nil, err
+		}
+		l.agents[link.Serial] = link.Agent
+	}
+	return l, nil
+}
+
+// Agent answers the agent id of the certificate with serial, serial itself
+// unless it was renewed.
+func (l *SerialLinks) Agent(serial *big.Int) *big.Int {
+	l.lock.RLock()
+	agent, ok := l.agents[serial.String()]
+	l.lock.RUnlock()
+	if !ok {
+		return serial
+	}
+	id, _ := new(big.Int).SetString(agent, 10)
+	return id
+}
+
+// Link ties the certificate with serial to the agent of the certificate
+// with previous, the one it renews.
+func (l *SerialLinks) Link(serial, previous *big.Int) error {
+	if serial == nil || previous == nil || serial.Cmp(previous) == 0 {
+		return errors.New("invalid serial number")
+	}
+	link := &serialLink{Serial: serial.String(), Agent: l.Agent(previous).String()}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.docs.Put(serialsCollection, link.Serial, link); err != nil {
+		return err
+	}
+	l.agents[link.Serial] = link.Agent
+	return nil
+}
@@ -0,0 +1,39 @@
+package pulsecnc
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestSerialLinks(t *testing.T) {
+	docs := NewMemoryDocStore()
+	l, err := NewSerialLinks(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := big.NewInt(42)
+	if id := l.Agent(agent); id.Cmp(agent) != 0 {
+		t.Errorf("serial of a first certificate should be the agent id, got %v", id)
+	}
+	if err := l.Link(big.NewInt(43), agent); err != nil {
+		t.Fatal(err)
+	}
+	//Renewing a renewed certificate still leads to the agent
+	if err := l.Link(big.NewInt(44), big.NewInt(43)); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Link(big.NewInt(44), big.NewInt(44)); err == nil {
+		t.Error("a certificate should not renew itself")
+	}
+
+	//Links survive a restart
+	l, err = NewSerialLinks(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, serial := range []int64{42, 43, 44} {
+		if id := l.Agent(big.NewInt(serial)); id.Cmp(agent) != 0 {
+			t.Errorf("certificate %d should belong to agent 42, got %v", serial, id)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package pulsecnc
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Formats understood by StreamWriter.
+const (
+	StreamSSE    = "sse"    //Server-Sent Events
+	StreamNDJSON = "ndjson" //Newline delimited json
+)
+
+// StreamFormat answers which streaming format a client asked for, if any.
+// The stream query string parameter wins over the Accept header.
+func StreamFormat(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("stream")) {
+	case StreamSSE:
+		return StreamSSE
+	case StreamNDJSON:
+		return StreamNDJSON
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "text/event-stream") {
+		return StreamSSE
+	}
+	if strings.Contains(accept, "application/x-ndjson") {
+		return StreamNDJSON
+	}
+	return ""
+}
+
+// StreamSummary is the last record of a streamed run.
+type StreamSummary struct {
+	RunId        string
+	Agents       int //Number of agents the test was sent to
+	Received     int //Number of agents that answered
+	Missing      int //Number of agents that never answered
+	StartedAt    time.Time
+	CompletedAt  time.Time
+	TimeTaken    time.Duration
+	TimeTakenStr string
+}
+
+// NewStreamSummary answers the summary of a run that was sent to agents
+// and got received results, started at started.
+func NewStreamSummary(runid string, agents, received int, started time.Time) *StreamSummary {
+	now := time.Now()
+	return &StreamSummary{
+		RunId:        runid,
+		Agents:       agents,
+		Received:     received,
+		Missing:      agents - received,
+		StartedAt:    started,
+		CompletedAt:  now,
+		TimeTaken:    now.Sub(started),
+		TimeTakenStr: now.Sub(started).String(),
+	}
+}
+
+// StreamWriter writes records to a client one at a time, flushing each of
+// them so it reaches the client right away.
+type StreamWriter struct {
+	w      io.Writer
+	format string
+}
+
+// NewStreamWriter sets the response headers for format and answers a StreamWriter.
+func NewStreamWriter(w http.ResponseWriter, format string) *StreamWriter {
+	if format == StreamSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") //Ask nginx not to buffer us
+	return &StreamWriter{w: w, format: format}
+}
+
+// Write sends v as a record of the given event type. Event types are only
+// visible with SSE, ndjson clients tell records apart by their fields.
+func (s *StreamWriter) Write(event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if s.format == StreamSSE {
+		_, err = io.WriteString(s.w, "event: "+event+"\ndata: "+string(data)+"\n\n")
+	} else {
+		_, err = s.w.Write(append(data, '\n'))
+	}
+	if err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+// KeepAlive sends something clients ignore, to keep idle connections
+// from being closed by proxies.
+func (s *StreamWriter) KeepAlive() error {
+	var err error
+	if s.format == StreamSSE {
+		_, err = io.WriteString(s.w, ": keepalive\n\n")
+	} else {
+		_, err = io.WriteString(s.w, "\n")
+	}
+	if err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+// flush pushes buffered data out to the client, if the writer supports it.
+func (s *StreamWriter) flush() {
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// WriteSummary sends the final record of a run. With ndjson it is wrapped
+// in a Summary field so clients can tell it apart from results.
+func (s *StreamWriter) WriteSummary(summary *StreamSummary) error {
+	if s.format == StreamSSE {
+		return s.Write("summary", summary)
+	}
+	return s.Write("summary", struct{ Summary *StreamSummary }{summary})
+}
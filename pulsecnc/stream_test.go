@@ -0,0 +1,88 @@
+package pulsecnc
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+func TestStreamFormat(t *testing.T) {
+	cases := []struct {
+		url    string
+		accept string
+		format string
+	}{
+		{"/dns/", "", ""},
+		{"/dns/", "application/json", ""},
+		{"/dns/?stream=sse", "", StreamSSE},
+		{"/dns/?stream=NDJSON", "text/event-stream", StreamNDJSON},
+		{"/dns/", "text/event-stream", StreamSSE},
+		{"/dns/", "application/x-ndjson", StreamNDJSON},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", c.url, nil)
+		if c.accept != "" {
+			r.Header.Set("Accept", c.accept)
+		}
+		if got := StreamFormat(r); got != c.format {
+			t.Errorf("%s with Accept %q: expected %q, got %q", c.url, c.accept, c.format, got)
+		}
+	}
+}
+
+func TestStreamWriterNDJSON(t *testing.T) {
+	rec := httptest.NewRecorder()
+	s := NewStreamWriter(rec, StreamNDJSON)
+	s.Write("result", &pulse.CombinedResult{Name: "client0"})
+	s.WriteSummary(NewStreamSummary("abc", 2, 1, time.Now()))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	if !rec.Flushed {
+		t.Error("records should be flushed")
+	}
+	scanner := bufio.NewScanner(rec.Body)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %v", len(lines), lines)
+	}
+	var res pulse.CombinedResult
+	if err := json.Unmarshal([]byte(lines[0]), &res); err != nil || res.Name != "client0" {
+		t.Errorf("unexpected result line %s", lines[0])
+	}
+	var summary struct{ Summary StreamSummary }
+	if err := json.Unmarshal([]byte(lines[1]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Summary.RunId != "abc" || summary.Summary.Missing != 1 {
+		t.Errorf("unexpected summary line %s", lines[1])
+	}
+}
+
+func TestStreamWriterSSE(t *testing.T) {
+	rec := httptest.NewRecorder()
+	s := NewStreamWriter(rec, StreamSSE)
+	s.Write("result", map[string]string{"Name": "client0"})
+	s.WriteSummary(NewStreamSummary("abc", 1, 1, time.Now()))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	events := strings.Split(strings.TrimSpace(rec.Body.String()), "\n\n")
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d", len(events))
+	}
+	if events[0] != "event: result\ndata: {\"Name\":\"client0\"}" {
+		t.Errorf("unexpected event %q", events[0])
+	}
+	if !strings.HasPrefix(events[1], "event: summary\ndata: {\"RunId\":\"abc\"") {
+		t.Errorf("unexpected event %q", events[1])
+	}
+}
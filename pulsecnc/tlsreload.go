@@ -0,0 +1,87 @@
+package pulsecnc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+// TLSReloader holds the TLS config of the minion listener, read from its
+// files again on Reload. New connections get the config of the last
+// successful Reload, those already made carry on with the one they had.
+type TLSReloader struct {
+	ca, cert, key string
+	legacy        bool
+	current       atomic.Value //*tls.Config
+	stamp         string       //Of the files as of the last Reload
+	lock          sync.Mutex
+}
+
+// NewTLSReloader answers a TLSReloader for the CA, certificate and key
+// files, see pulse.GetTLSConfig and pulse.GetLegacyTLSConfig.
+func NewTLSReloader(ca, cert, key string, legacy bool) (*TLSReloader, error) {
+	r := &TLSReloader{ca: ca, cert: cert, key: key, legacy: legacy}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. On error the current config stays in use.
+func (r *TLSReloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	//Taken first, so a change while reading is seen by the next Changed
+	r.stamp = r.filestamp()
+	getconfig := pulse.GetTLSConfig
+	if r.legacy {
+		getconfig = pulse.GetLegacyTLSConfig
+	}
+	cfg, err := getconfig(r.ca, r.cert, r.key)
+	if err != nil {
+		return err
+	}
+	r.current.Store(cfg)
+	return nil
+}
+
+// Changed answers if any of the files changed since the last Reload,
+// successful or not.
+func (r *TLSReloader) Changed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.filestamp() != r.stamp
+}
+
+// filestamp answers what changes when any of the files does.
+func (r *TLSReloader) filestamp() string {
+	var stamp string
+	for _, name := range []string{r.ca, r.cert, r.key} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			stamp += err.Error() + ";"
+			continue
+		}
+		stamp += fmt.Sprintf("%s %d %d;", name, fi.ModTime().UnixNano(), fi.Size())
+	}
+	return stamp
+}
+
+// Current answers the config of the last successful Reload.
+func (r *TLSReloader) Current() *tls.Config {
+	return r.current.Load().(*tls.Config)
+}
+
+// Config answers a config for tls.Listen that hands each new connection
+// the config of the last successful Reload.
+func (r *TLSReloader) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.Current(), nil
+		},
+	}
+}
@@ -0,0 +1,110 @@
+package pulsecnc
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+func TestTLSReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsereload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := &PKI{Dir: dir}
+	if err := p.Init("Test CA", pulse.KeyECDSA, time.Hour*24); err != nil {
+		t.Fatal(err)
+	}
+	first, err := p.Issue("localhost", true, []string{"localhost"}, pulse.KeyECDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.Issue("cnc", true, []string{"localhost"}, pulse.KeyECDSA, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Issue("client0", false, nil, pulse.KeyECDSA, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	client := testTLSConfig(t, pulse.GetTLSConfig, p.CACert(), p.Cert("client0"), p.Key("client0"))
+	client.ServerName = "localhost"
+
+	certfile, keyfile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	install := func(name string) {
+		for src, dst := range map[string]string{p.Cert(name): certfile, p.Key(name): keyfile} {
+			data, _ := ioutil.ReadFile(src)
+			if err := ioutil.WriteFile(dst, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	install("localhost")
+	r, err := NewTLSReloader(p.CACert(), certfile, keyfile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Changed() {
+		t.Error("nothing changed yet")
+	}
+	before, serial := testTLSConnect(t, r.Config(), client)
+	if serial.Cmp(first.SerialNumber) != 0 {
+		t.Errorf("expected the first certificate, got serial %v", serial)
+	}
+
+	//A broken pair is not taken, the current config stays
+	ioutil.WriteFile(keyfile, []byte("nope"), 0600)
+	if !r.Changed() {
+		t.Error("key file changed")
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("broken key should not load")
+	}
+	if r.Changed() {
+		t.Error("a failed reload should not be retried until the files change again")
+	}
+	if _, serial := testTLSConnect(t, r.Config(), client); serial.Cmp(first.SerialNumber) != 0 {
+		t.Errorf("failed reload changed the certificate to %v", serial)
+	}
+
+	install("cnc")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, serial := testTLSConnect(t, r.Config(), client); serial.Cmp(second.SerialNumber) != 0 {
+		t.Errorf("expected the second certificate, got serial %v", serial)
+	}
+	//The connection made before the reload still works
+	if _, err := before.Write([]byte("x")); err != nil {
+		t.Errorf("connection made before the reload broke: %v", err)
+	}
+}
+
+// testTLSConnect connects client to a server using config, answers the
+// client side of the connection and the serial of the server certificate.
+func testTLSConnect(t *testing.T, config, client *tls.Config) (*tls.Conn, *big.Int) {
+	c, s, err := testConnPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn := tls.Server(s, config)
+		if conn.Handshake() != nil {
+			return
+		}
+		//Swallow what the client writes
+		ioutil.ReadAll(conn)
+	}()
+	conn := tls.Client(c, client)
+	if err := conn.Handshake(); err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	return conn, conn.ConnectionState().PeerCertificates[0].SerialNumber
+}
@@ -0,0 +1,41 @@
+package pulsecnc
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/turbobytes/pulse/utils"
+)
+
+func TestNegotiatedProtocol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulseproto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := &PKI{Dir: dir}
+	if err := p.Init("Test CA", pulse.KeyECDSA, time.Hour*24); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"localhost", "client0"} {
+		if _, err := p.Issue(name, name == "localhost", []string{name}, pulse.KeyECDSA, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := testTLSConfig(t, pulse.GetTLSConfig, p.CACert(), p.Cert("localhost"), p.Key("localhost"))
+	for _, get := range []func(string, string, string) (*tls.Config, error){pulse.GetTLSConfig, pulse.GetLegacyTLSConfig} {
+		client := testTLSConfig(t, get, p.CACert(), p.Cert("client0"), p.Key("client0"))
+		client.ServerName = "localhost"
+		if conn, _ := testTLSConnect(t, server, client); pulse.NegotiatedProtocol(conn) != pulse.ProtoJSON {
+			t.Errorf("expected %s, got %q", pulse.ProtoJSON, pulse.NegotiatedProtocol(conn))
+		}
+		//Releases from before negotiation offer nothing and get gob
+		client.NextProtos = nil
+		if conn, _ := testTLSConnect(t, server, client); pulse.NegotiatedProtocol(conn) != pulse.ProtoGob {
+			t.Errorf("expected gob, got %q", pulse.NegotiatedProtocol(conn))
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package pulse
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Capabilities is what a minion tells the CNC about itself when it connects.
+type Capabilities struct {
+	Version   string
+	OS        string //As in GOOS
+	Arch      string //As in GOARCH
+	Tests     []int  //Test types it runs
+	MTR       bool   //mtr is installed and usable
+	MTRErr    string `json:",omitempty"` //Why mtr is not usable
+	IPv4      bool   //Has a route to the IPv4 internet
+	IPv6      bool   //Has a route to the IPv6 internet
+	Resolvers []string
+	Timeouts  bool //Honors CombinedRequest.Timeouts
+}
+
+// Unsupported answers why the minion can not run req, or an empty string if
+// it can. A nil Capabilities is a minion from before capabilities, which
+// runs the test types it knew about and has to be trusted on the rest.
+func (c *Capabilities) Unsupported(req *CombinedRequest) string {
+	if c == nil {
+		if req.Type == TypeDNS || req.Type == TypeMTR || req.Type == TypeCurl {
+			return ""
+		}
+		return fmt.Sprintf("test type %d not supported by this version", req.Type)
+	}
+	supported := false
+	for _, t := range c.Tests {
+		supported = supported || t == req.Type
+	}
+	switch {
+	case !supported && req.Type == TypeMTR && c.MTRErr != "":
+		return "mtr not usable: " + c.MTRErr
+	case !supported:
+		return fmt.Sprintf("test type %d not supported by this version", req.Type)
+	}
+	if args, ok := req.Args.(MtrRequest); ok {
+		if args.IPv == "4" && !c.IPv4 {
+			return "no IPv4 connectivity"
+		}
+		if args.IPv == "6" && !c.IPv6 {
+			return "no IPv6 connectivity"
+		}
+	}
+	return ""
+}
+
+// resolvConf is where the system resolvers are read from.
+var resolvConf = "/etc/resolv.conf"
+
+// mtrCheck runs mtr once to see if it works, it needs privileges to do so.
+var mtrCheck struct {
+	once sync.Once
+	err  error
+}
+
+func checkMtr() error {
+	mtrCheck.once.Do(func() {
+		path, err := exec.LookPath("mtr")
+		if err != nil {
+			mtrCheck.err = err
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, path, "--report", "--report-cycles", "1", "--no-dns", "127.0.0.1").CombinedOutput()
+		if err != nil {
+			mtrCheck.err = fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+	})
+	return mtrCheck.err
+}
+
+// hasRoute answers if there is a route to addr over network. Dialing udp
+// sends nothing, it only picks a local address.
+func hasRoute(network, addr string) bool {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Capabilities answers what this minion can do. Connectivity and resolvers
+// are looked at anew each time, as they change when the host moves.
+func (r *Resolver) Capabilities(args bool, caps *Capabilities) error {
+	c := &Capabilities{
+		Version:  r.Version,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		IPv4:     hasRoute("udp4", "8.8.8.8:53"),
+		IPv6:     hasRoute("udp6", "[2001:4860:4860::8888]:53"),
+		Timeouts: true,
+	}
+	c.Tests = append(c.Tests, TypeDNS)
+	if err := checkMtr(); err != nil {
+		c.MTRErr = err.Error()
+	} else {
+		c.MTR = true
+		c.Tests = append(c.Tests, TypeMTR)
+	}
+	c.Tests = append(c.Tests, TypeCurl)
+	if conf, err := dns.ClientConfigFromFile(resolvConf); err == nil {
+		c.Resolvers = conf.Servers
+	}
+	*caps = *c
+	return nil
+}
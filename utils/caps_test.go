@@ -0,0 +1,67 @@
+package pulse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnsupported(t *testing.T) {
+	var legacy *Capabilities
+	full := &Capabilities{Tests: []int{TypeDNS, TypeMTR, TypeCurl}, MTR: true, IPv4: true, IPv6: true}
+	nomtr := &Capabilities{Tests: []int{TypeDNS, TypeCurl}, MTRErr: "exec: \"mtr\": executable file not found in $PATH", IPv4: true}
+	for _, tc := range []struct {
+		caps *Capabilities
+		req  *CombinedRequest
+		want string //Start of the reason, empty if supported
+	}{
+		{legacy, &CombinedRequest{Type: TypeMTR, Args: MtrRequest{Target: "example.com", IPv: "6"}}, ""},
+		{legacy, &CombinedRequest{Type: 42}, "test type 42"},
+		{full, &CombinedRequest{Type: TypeMTR, Args: MtrRequest{Target: "example.com", IPv: "6"}}, ""},
+		{full, &CombinedRequest{Type: 42}, "test type 42"},
+		{nomtr, &CombinedRequest{Type: TypeDNS}, ""},
+		{nomtr, &CombinedRequest{Type: TypeMTR, Args: MtrRequest{Target: "example.com"}}, "mtr not usable"},
+		{&Capabilities{Tests: []int{TypeMTR}}, &CombinedRequest{Type: TypeMTR, Args: MtrRequest{Target: "example.com", IPv: "4"}}, "no IPv4"},
+		{nomtr, &CombinedRequest{Type: TypeCurl}, ""},
+	} {
+		got := tc.caps.Unsupported(tc.req)
+		if (tc.want == "") != (got == "") || !strings.HasPrefix(got, tc.want) {
+			t.Errorf("%+v type %d: expected %q, got %q", tc.caps, tc.req.Type, tc.want, got)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsecaps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(orig string) { resolvConf = orig }(resolvConf)
+	resolvConf = filepath.Join(dir, "resolv.conf")
+	ioutil.WriteFile(resolvConf, []byte("nameserver 192.0.2.53\nnameserver 2001:db8::53\n"), 0644)
+
+	r := &Resolver{Version: "test"}
+	var caps Capabilities
+	if err := r.Capabilities(true, &caps); err != nil {
+		t.Fatal(err)
+	}
+	if caps.Version != "test" || caps.OS == "" || caps.Arch == "" {
+		t.Errorf("version and platform not filled: %+v", caps)
+	}
+	if want := []string{"192.0.2.53", "2001:db8::53"}; !reflect.DeepEqual(caps.Resolvers, want) {
+		t.Errorf("expected resolvers %v, got %v", want, caps.Resolvers)
+	}
+	if caps.MTR == (caps.MTRErr != "") {
+		t.Errorf("mtr either works or has a reason not to: %+v", caps)
+	}
+	//Whatever the host, the minion runs what it says it runs
+	for _, typ := range caps.Tests {
+		if reason := caps.Unsupported(&CombinedRequest{Type: typ}); reason != "" {
+			t.Errorf("type %d: %s", typ, reason)
+		}
+	}
+}
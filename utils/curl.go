@@ -30,6 +30,9 @@ var (
 	keepalive           = time.Second * 30 //Keepalive timeout
 )
 
+// fallbackdelay is the head start of IPv6 over IPv4 dialing dual-stack hosts.
+var fallbackdelay = time.Millisecond * 300
+
 type CurlResult struct {
 	Status          int                  //HTTP status of result
 	Header          http.Header          //Headers
@@ -49,6 +52,7 @@ type CurlResult struct {
 	TLSTimeStr      string               //Stringified
 	TtfbStr         string               //Stringified
 	ConnectionState *tls.ConnectionState //Additional TLS data when running test over https. We snip out PublicKey from the certs cause they dont serialize well.
+	TimedOut        string               //Phase that ran out of time, one of dns, connect, tls or response
 }
 
 type CurlRequest struct {
@@ -57,6 +61,9 @@ type CurlRequest struct {
 	Host        string
 	Ssl         bool
 	AgentFilter []*big.Int
+	Selector    string    //Picks agents by attributes, see pulsecnc.Selector
+	Timeouts    *Timeouts //Limits of the test, defaults when nil
+	Pacing      *Pacing   //How fast the CNC sends the test to agents, all at once when nil
 }
 
 type conInfo struct {
@@ -77,6 +84,8 @@ type conTrack struct {
 	Addr                 string
 	WroteRequest         time.Time
 	GotFirstResponseByte time.Time
+	TLSDone              time.Time
+	Dialed               time.Time //When dialing got a connection
 }
 
 func (ct *conTrack) getConInfo() *conInfo {
@@ -109,22 +118,55 @@ func (ct *conTrack) getConInfo() *conInfo {
 	return ci
 }
 
-func dialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	con, err := (&net.Dialer{
-		Timeout:   dialtimeout, //DNS + Connect
-		KeepAlive: keepalive,
-	}).DialContext(ctx, network, address)
-	if err == nil {
-		//If a connection could be established, ensure its not local
-		a, _ := con.RemoteAddr().(*net.TCPAddr)
+// dialContext answers a DialContext that resolves and connects within
+// timeout, and notes in ct when it got a connection.
+func dialContext(timeout time.Duration, ct *conTrack) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		con, err := (&net.Dialer{
+			Timeout:       timeout, //DNS + Connect
+			KeepAlive:     keepalive,
+			FallbackDelay: fallbackdelay,
+		}).DialContext(ctx, network, address)
+		if err == nil {
+			ct.Dialed = time.Now()
+			//If a connection could be established, ensure its not local
+			a, _ := con.RemoteAddr().(*net.TCPAddr)
 
-		if islocalip(a.IP) {
-			fmt.Println(a.IP)
-			con.Close()
-			return nil, securityerr
+			if islocalip(a.IP) {
+				fmt.Println(a.IP)
+				con.Close()
+				return nil, securityerr
+			}
 		}
+		return con, err
 	}
-	return con, err
+}
+
+// dialBudget answers how long dialing may take, the DNS and Connect
+// timeouts together, dialtimeout when neither is set.
+func dialBudget(t *Timeouts) time.Duration {
+	if t.DNS == 0 && t.Connect == 0 {
+		return dialtimeout
+	}
+	return bounded(t.DNS, dialtimeout, MaxPhaseTimeout) + bounded(t.Connect, dialtimeout, MaxPhaseTimeout)
+}
+
+// timedOut answers the phase that ran out of time when a request failed
+// with err, or an empty string if none did.
+func (ct *conTrack) timedOut(err error, ssl bool) string {
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		return ""
+	}
+	if ct.Dialed.IsZero() {
+		if !ct.DNSStart.IsZero() && ct.DNSDone.IsZero() {
+			return PhaseDNS
+		}
+		return PhaseConnect
+	}
+	if ssl && ct.TLSDone.IsZero() {
+		return PhaseTLS
+	}
+	return PhaseResponse
 }
 
 //fixipv6endpoint is a temporary workaround for issue #5
@@ -153,7 +195,7 @@ func CurlImpl(ctx context.Context, r *CurlRequest) *CurlResult {
 		r.Endpoint = fixipv6endpoint(r.Endpoint)
 	}
 	result := &CurlResult{}
-	defer translateCurlError(result)
+	defer translateCurlError(result, timeoutsFrom(ctx))
 	var url string
 	if r.Ssl {
 		url = fmt.Sprintf("https://%s%s", r.Endpoint, r.Path)
@@ -179,15 +221,22 @@ func CurlImpl(ctx context.Context, r *CurlRequest) *CurlResult {
 	// does not respect IdleConnTimeout
 	// https://github.com/golang/go/issues/16808
 
+	//Initialize connection tracker
+	ct := &conTrack{
+		ConnectStart: make(map[string]time.Time),
+		ConnectDone:  make(map[string]time.Time),
+	}
+
 	//Configure our transport, new one for each request
+	timeouts := timeoutsFrom(ctx)
 	transport := &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
-		DialContext:           dialContext,
+		DialContext:           dialContext(dialBudget(timeouts), ct),
 		MaxIdleConns:          100,              //Irrelevant
 		IdleConnTimeout:       90 * time.Second, //Irrelevant
-		TLSHandshakeTimeout:   tlshandshaketimeout,
+		TLSHandshakeTimeout:   bounded(timeouts.TLS, tlshandshaketimeout, MaxPhaseTimeout),
 		ExpectContinueTimeout: 1 * time.Second,
-		ResponseHeaderTimeout: responsetimeout,
+		ResponseHeaderTimeout: bounded(timeouts.Response, responsetimeout, MaxPhaseTimeout),
 	}
 
 	// Due to #16808, transport going out of scope does not cleanup
@@ -229,11 +278,6 @@ func CurlImpl(ctx context.Context, r *CurlRequest) *CurlResult {
 		}
 	}
 
-	//Initialize connection tracker
-	ct := &conTrack{
-		ConnectStart: make(map[string]time.Time),
-		ConnectDone:  make(map[string]time.Time),
-	}
 	//Initialize httptrace
 	trace := &httptrace.ClientTrace{
 		GotConn: func(connInfo httptrace.GotConnInfo) {
@@ -255,6 +299,11 @@ func CurlImpl(ctx context.Context, r *CurlRequest) *CurlResult {
 		GotFirstResponseByte: func() {
 			ct.GotFirstResponseByte = time.Now()
 		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				ct.TLSDone = time.Now()
+			}
+		},
 		WroteRequest: func(wr httptrace.WroteRequestInfo) {
 			ct.WroteRequest = time.Now()
 		},
@@ -281,6 +330,10 @@ func CurlImpl(ctx context.Context, r *CurlRequest) *CurlResult {
 	//On error stamp err and return
 	if err != nil {
 		result.Err = err.Error()
+		if ctx.Err() == nil {
+			//Otherwise the deadline of the whole test ran out, or it was cancelled
+			result.TimedOut = ct.timedOut(err, r.Ssl)
+		}
 		return result
 	}
 	resp.Body.Close()
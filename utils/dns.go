@@ -2,6 +2,7 @@ package pulse
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"math/big"
 	"strings"
@@ -39,18 +40,29 @@ type DNSRequest struct {
 	Targets     []string //The target nameservers
 	NoRecursion bool     //true means RecursionDesired = false. false means RecursionDesired = true
 	AgentFilter []*big.Int
+	Selector    string    //Picks agents by attributes, see pulsecnc.Selector
+	Timeouts    *Timeouts //Limits of the test, defaults when nil
+	Pacing      *Pacing   //How fast the CNC sends the test to agents, all at once when nil
 }
 
-func rundnsquery(host, server string, ch chan IndividualDNSResult, qclass uint16, norecurse, retry bool) {
+func rundnsquery(host, server string, ch chan IndividualDNSResult, qclass uint16, norecurse, retry bool, timeout time.Duration) {
 	res := IndividualDNSResult{}
 	res.Server = strings.Split(server, ":")[0]
+	sent := false //A panic after the result went out must not send another
+	defer func() {
+		//Runs in its own goroutine, out of reach of the recover of the test
+		if p := recover(); p != nil && !sent {
+			log.Println("dns query panicked:", p)
+			ch <- IndividualDNSResult{Server: res.Server, Err: fmt.Sprintf("query panicked: %v", p)}
+		}
+	}()
 	m1 := new(dns.Msg)
 	m1.Id = dns.Id()
 	m1.RecursionDesired = !norecurse
 	m1.Question = make([]dns.Question, 1)
 	m1.Question[0] = dns.Question{host, qclass, dns.ClassINET}
 	c := new(dns.Client)
-	c.Timeout = dnsTimeout
+	c.Timeout = timeout
 	log.Println("Asking", server, "for", host)
 	msg, rtt, err := c.Exchange(m1, server)
 	res.RttStr = rtt.String()
@@ -60,28 +72,33 @@ func rundnsquery(host, server string, ch chan IndividualDNSResult, qclass uint16
 		if retry {
 			//If fail at first... try again .. once...
 			//I could tell a UDP joke... but you might not get it...
-			rundnsquery(host, server, ch, qclass, norecurse, false)
+			sent = true //The retry sends its own result
+			rundnsquery(host, server, ch, qclass, norecurse, false, timeout)
 		} else {
+			sent = true
 			ch <- res
 		}
 	} else {
 		//res.Result = msg.String()
 		res.Raw, _ = msg.Pack()
 		//res.Formated = msg.String()
+		sent = true
 		ch <- res
 	}
 }
 
 func rundnsqueryCtx(ctx context.Context, host, server string, ch chan IndividualDNSResult, qclass uint16, norecurse, retry bool) {
-	ctxCh := make(chan IndividualDNSResult)
-	go rundnsquery(host, server, ctxCh, qclass, norecurse, retry)
+	//Buffered so the query is not left blocked once nobody waits for it
+	ctxCh := make(chan IndividualDNSResult, 1)
+	timeout := bounded(timeoutsFrom(ctx).DNS, dnsTimeout, MaxPhaseTimeout)
+	go rundnsquery(host, server, ctxCh, qclass, norecurse, retry, timeout)
 	select {
 	case res := <-ctxCh:
 		ch <- res
 	case <-ctx.Done():
 		ch <- IndividualDNSResult{
 			Server: strings.Split(server, ":")[0],
-			Err:    "context deadline exceeded",
+			Err:    ctx.Err().Error(),
 		}
 	}
 }
@@ -98,7 +115,7 @@ func DNSImpl(ctx context.Context, r *DNSRequest) *DNSResult {
 	}
 	for i := 0; i < n; i++ {
 		item := <-ch
-		translateDnsError(&item)
+		translateDnsError(&item, timeoutsFrom(ctx))
 		res.Results[i] = item
 		//res := runquery(*host, server)
 	}
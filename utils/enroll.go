@@ -0,0 +1,146 @@
+package pulse
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Enrollment states.
+const (
+	EnrollPending  = "pending"
+	EnrollApproved = "approved"
+	EnrollRejected = "rejected"
+)
+
+// EnrollRequest is what a minion without a certificate sends to the CNC
+// enrollment endpoint, instead of mailing the form of PrintCertRequest.
+type EnrollRequest struct {
+	CSR       string //PEM encoded certificate request
+	Name      string
+	Country   string
+	State     string
+	City      string
+	Resolvers []string //IPs of the ISP resolvers
+}
+
+// EnrollStatus is what the CNC answers about an enrollment.
+type EnrollStatus struct {
+	Id          string
+	Status      string
+	Reason      string `json:",omitempty"` //Why it was rejected
+	Certificate string `json:",omitempty"` //PEM encoded, once approved
+}
+
+// enrollPoll is how often a minion asks the CNC if its enrollment was decided.
+var enrollPoll = time.Second * 30
+
+// Enroll submits req, along with a CSR for the key in privfname, to the
+// enrollment endpoint of the CNC http API at api and waits until an admin
+// decides on it. The certificate is checked against the CA in caFile
+// before being written to certfname.
+func Enroll(api string, req *EnrollRequest, caFile, privfname, certfname string) error {
+	pk, err := loadPrivKey(privfname)
+	if err != nil {
+		return err
+	}
+	csr, err := newCertRequest(pk, req.Name)
+	if err != nil {
+		return err
+	}
+	req.CSR = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}))
+	base := strings.TrimSuffix(api, "/") + "/enroll/"
+	st, err := enrollCall(http.MethodPost, base, req)
+	if err != nil {
+		return err
+	}
+	log.Println("enrollment", st.Id, "submitted, waiting for approval")
+	for st.Status == EnrollPending {
+		time.Sleep(enrollPoll)
+		next, err := enrollCall(http.MethodGet, base+st.Id, nil)
+		if err != nil {
+			log.Println("enrollment", err)
+			continue
+		}
+		st = next
+	}
+	if st.Status != EnrollApproved {
+		return fmt.Errorf("enrollment %s was %s: %s", st.Id, st.Status, st.Reason)
+	}
+	if err := checkEnrolledCert(st.Certificate, caFile, pk.Public()); err != nil {
+		return fmt.Errorf("enrollment %s: %s", st.Id, err)
+	}
+	log.Println("enrollment", st.Id, "approved")
+	return ioutil.WriteFile(certfname, []byte(st.Certificate), 0644)
+}
+
+// enrollCall sends body, if any, to url and answers the decoded status.
+func enrollCall(method, url string, body interface{}) (*EnrollStatus, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("got status code %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	st := new(EnrollStatus)
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// checkEnrolledCert makes sure certpem is for our key and signed by the CA in caFile,
+// the enrollment endpoint is plain http.
+func checkEnrolledCert(certpem, caFile string, pub interface{}) error {
+	blk, _ := pem.Decode([]byte(certpem))
+	if blk == nil {
+		return errors.New("no certificate in answer")
+	}
+	cert, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return err
+	}
+	want, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(want, cert.RawSubjectPublicKeyInfo) {
+		return errors.New("certificate is not for our key")
+	}
+	capem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(capem) {
+		return errors.New("no certificates in " + caFile)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	return err
+}
@@ -0,0 +1,132 @@
+package pulse
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnroll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulseenroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "minion.key")
+	certFile := filepath.Join(dir, "minion.crt")
+
+	cakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cader, err := x509.CreateCertificate(rand.Reader, catemplate, catemplate, cakey.Public(), cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacert, _ := x509.ParseCertificate(cader)
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cader}), 0644)
+	if err := GeneratePrivKeyFile(keyFile, KeyECDSA); err != nil {
+		t.Fatal(err)
+	}
+
+	//A CNC that approves on the second poll
+	var polls int
+	var signed string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/enroll/":
+			req := new(EnrollRequest)
+			json.NewDecoder(r.Body).Decode(req)
+			if req.Name != "client0" || req.Country != "IN" {
+				t.Errorf("unexpected request %+v", req)
+			}
+			blk, _ := pem.Decode([]byte(req.CSR))
+			csr, err := x509.ParseCertificateRequest(blk.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+				SerialNumber: big.NewInt(42),
+				Subject:      pkix.Name{CommonName: req.Name},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			}, cacert, csr.PublicKey, cakey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signed = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(EnrollStatus{Id: "abc", Status: EnrollPending})
+		case r.Method == http.MethodGet && r.URL.Path == "/enroll/abc":
+			polls++
+			if polls < 2 {
+				json.NewEncoder(w).Encode(EnrollStatus{Id: "abc", Status: EnrollPending})
+			} else {
+				json.NewEncoder(w).Encode(EnrollStatus{Id: "abc", Status: EnrollApproved, Certificate: signed})
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	defer func(d time.Duration) { enrollPoll = d }(enrollPoll)
+	enrollPoll = time.Millisecond
+	err = Enroll(srv.URL+"/", &EnrollRequest{Name: "client0", Country: "IN"}, caFile, keyFile, certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil || string(data) != signed {
+		t.Errorf("certificate not written: %v", err)
+	}
+
+	//A certificate for someone else's key must not be accepted
+	other, _ := rsa.GenerateKey(rand.Reader, 1024)
+	if err := checkEnrolledCert(signed, caFile, other.Public()); err == nil {
+		t.Error("certificate for another key should not be accepted")
+	}
+}
+
+func TestEnrollRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulseenroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "minion.key")
+	GeneratePrivKeyFile(keyFile, KeyRSA)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(EnrollStatus{Id: "abc", Status: EnrollRejected, Reason: "who are you"})
+	}))
+	defer srv.Close()
+	err = Enroll(srv.URL, &EnrollRequest{Name: "client0"}, filepath.Join(dir, "ca.crt"), keyFile, filepath.Join(dir, "minion.crt"))
+	if err == nil {
+		t.Fatal("rejected enrollment should fail")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "minion.crt")); !os.IsNotExist(err) {
+		t.Error("no certificate should be written")
+	}
+}
@@ -0,0 +1,89 @@
+package pulse
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrBusy is answered for tests there is no room for, running or queued.
+var ErrBusy = errors.New("busy: too many tests running and queued, try again later")
+
+// Default limits of the minion executor.
+const (
+	DefaultMaxDNS   = 20
+	DefaultMaxMTR   = 2
+	DefaultMaxCurl  = 10
+	DefaultMaxQueue = 20
+)
+
+// Executor limits how many tests of each type run at once. Tests over the
+// limit wait their turn in a queue of at most queue tests per type, those
+// that don't fit are refused with ErrBusy. A nil Executor runs everything
+// right away.
+type Executor struct {
+	queue   int
+	slots   map[int]chan struct{} //By test type, a test holds a slot while it runs
+	waiting map[int]int           //By test type, tests waiting for a slot
+	lock    sync.Mutex
+}
+
+// NewExecutor answers an Executor running at most limits[type] tests of
+// each type at once, and queueing at most queue more. Types without a
+// positive limit are not limited.
+func NewExecutor(limits map[int]int, queue int) *Executor {
+	e := &Executor{
+		queue:   queue,
+		slots:   make(map[int]chan struct{}),
+		waiting: make(map[int]int),
+	}
+	for testtype, limit := range limits {
+		if limit > 0 {
+			e.slots[testtype] = make(chan struct{}, limit)
+		}
+	}
+	return e
+}
+
+// Run runs fn as a test of testtype once there is room for it. It answers
+// ErrBusy when the queue is full, or the error of ctx when it ends while
+// waiting, without running fn.
+func (e *Executor) Run(ctx context.Context, testtype int, fn func()) error {
+	if e == nil || e.slots[testtype] == nil {
+		fn()
+		return nil
+	}
+	slots := e.slots[testtype]
+	select {
+	case slots <- struct{}{}:
+	default:
+		if err := e.wait(ctx, testtype, slots); err != nil {
+			return err
+		}
+	}
+	defer func() { <-slots }()
+	fn()
+	return nil
+}
+
+// wait queues for a slot of testtype.
+func (e *Executor) wait(ctx context.Context, testtype int, slots chan struct{}) error {
+	e.lock.Lock()
+	if e.waiting[testtype] >= e.queue {
+		e.lock.Unlock()
+		return ErrBusy
+	}
+	e.waiting[testtype]++
+	e.lock.Unlock()
+	defer func() {
+		e.lock.Lock()
+		e.waiting[testtype]--
+		e.lock.Unlock()
+	}()
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
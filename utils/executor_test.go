@@ -0,0 +1,101 @@
+package pulse
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecutor(t *testing.T) {
+	e := NewExecutor(map[int]int{TypeMTR: 1}, 1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan error, 2)
+	go func() {
+		done <- e.Run(context.Background(), TypeMTR, func() {
+			close(started)
+			<-release
+		})
+	}()
+	<-started
+	queued := make(chan struct{})
+	go func() {
+		done <- e.Run(context.Background(), TypeMTR, func() { close(queued) })
+	}()
+	//Wait for it to be queued
+	for i := 0; i < 100; i++ {
+		e.lock.Lock()
+		n := e.waiting[TypeMTR]
+		e.lock.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err := e.Run(context.Background(), TypeMTR, func() { t.Error("should not run when busy") }); err != ErrBusy {
+		t.Errorf("expected busy, got %v", err)
+	}
+	ran := false
+	if err := e.Run(context.Background(), TypeDNS, func() { ran = true }); err != nil || !ran {
+		t.Errorf("other test types are not limited: %v", err)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+	select {
+	case <-queued:
+	default:
+		t.Error("queued test did not run")
+	}
+
+	//Giving up while queued
+	e = NewExecutor(map[int]int{TypeCurl: 1}, 5)
+	release = make(chan struct{})
+	go e.Run(context.Background(), TypeCurl, func() { <-release })
+	defer close(release)
+	time.Sleep(time.Millisecond * 10)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := e.Run(ctx, TypeCurl, func() { t.Error("should not run once given up") }); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline, got %v", err)
+	}
+
+	var none *Executor
+	ran = false
+	if none.Run(context.Background(), TypeMTR, func() { ran = true }); !ran {
+		t.Error("nil executor should run right away")
+	}
+}
+
+func TestRecoverTest(t *testing.T) {
+	res := &CombinedResult{Result: "partial"}
+	func() {
+		defer recoverTest(res)
+		panic("boom")
+	}()
+	if res.Result != nil || !strings.Contains(res.Err, "boom") {
+		t.Errorf("expected the panic as error, got %+v", res)
+	}
+}
+
+func TestResolverBusy(t *testing.T) {
+	r := &Resolver{Version: "test", Executor: NewExecutor(map[int]int{TypeDNS: 1}, 0)}
+	//Hold the only dns slot
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go r.Executor.Run(context.Background(), TypeDNS, func() {
+		close(started)
+		<-release
+	})
+	<-started
+	defer close(release)
+	var res CombinedResult
+	r.Combined(&CombinedRequest{Type: TypeDNS, Args: DNSRequest{Host: "example.com."}}, &res)
+	if !res.Busy || res.Err != ErrBusy.Error() || res.Result != nil {
+		t.Errorf("expected a busy result, got %+v", res)
+	}
+}
@@ -29,6 +29,7 @@ type Pinger struct {
 func (p *Pinger) Ping(host, out *bool) error {
 	log.Println("Got pung")
 	p.Last = time.Now()
+	status.pinged()
 	*out = true
 	return nil
 }
@@ -40,9 +41,12 @@ func listen(cnc string, cfg *tls.Config) {
 	conn, err := tls.DialWithDialer(dialer, "tcp", cnc, cfg)
 	if err != nil {
 		log.Println(err)
+		status.disconnected(cnc, err)
 		time.Sleep(time.Second * 5)
 		return
 	}
+	status.connected(cnc)
+	log.Printf("Connected to %s, protocol %q", cnc, NegotiatedProtocol(conn))
 	//log.Println(conn)
 	//conn.SetKeepAlive(true)
 	//conn.SetKeepAlivePeriod(time.Minute)
@@ -63,8 +67,9 @@ func listen(cnc string, cfg *tls.Config) {
 			}
 		}
 	}(conn)
-	rpc.ServeConn(conn)
+	ServeRPC(conn)
 	signal = true
+	status.disconnected(cnc, nil)
 }
 
 // If new version is available... commit suicide.
@@ -105,7 +110,28 @@ func expectedVersion() (string, error) {
 	return strings.TrimSpace(string(body)), nil
 }
 
-func Runminion(cnc, caFile, certificateFile, privateKeyFile, reqFile, ver string) error {
+// MinionConfig holds the settings of a minion.
+type MinionConfig struct {
+	CNC             string //Address of the CNC
+	CAFile          string
+	CertificateFile string
+	PrivateKeyFile  string
+	ReqFile         string //Where the legacy flow writes the certificate request
+	Version         string
+	EnrollURL       string         //CNC http API to enroll with when there is no certificate, legacy flow if empty
+	Enroll          *EnrollRequest //What to enroll with
+	RenewBefore     time.Duration  //Renew the certificate when it expires within this
+	KeyType         string         //Of new private keys, see GeneratePrivKey
+	TLSLegacy       bool           //Use GetLegacyTLSConfig
+	MaxTests        map[int]int    //Tests of each type running at once, see NewExecutor
+	MaxQueue        int            //Tests of each type waiting to run, beyond that the minion is busy
+}
+
+// Runminion connects to the CNC and serves tests until it fails. Without a
+// certificate, it enrolls with the CNC http API at EnrollURL, or falls back
+// to printing a certificate request when EnrollURL is empty. The CNC renews
+// the certificate when it expires within RenewBefore.
+func Runminion(mc *MinionConfig) error {
 	gob.RegisterName("github.com/turbobytes/pulse/utils.MtrRequest", MtrRequest{})
 	gob.RegisterName("github.com/turbobytes/pulse/utils.MtrResult", MtrResult{})
 	gob.RegisterName("github.com/turbobytes/pulse/utils.CurlRequest", CurlRequest{})
@@ -113,23 +139,26 @@ func Runminion(cnc, caFile, certificateFile, privateKeyFile, reqFile, ver string
 	gob.RegisterName("github.com/turbobytes/pulse/utils.DNSRequest", DNSRequest{})
 	gob.RegisterName("github.com/turbobytes/pulse/utils.DNSResult", DNSResult{})
 
-	version = ver
+	version = mc.Version
 	if version == "" {
 		log.Println("No version information provided, not doing autoupdate")
 		version = "dirty"
 	} else {
 		go versionsuicide()
 	}
+	status.setVersion(version)
 
 	resolver := new(Resolver)
 	resolver.Version = version
+	resolver.Executor = NewExecutor(mc.MaxTests, mc.MaxQueue)
 	pinger = &Pinger{}
 	rpc.Register(resolver)
 	rpc.Register(pinger)
+	rpc.Register(NewRenewer(mc.CAFile, mc.CertificateFile, mc.PrivateKeyFile, mc.KeyType, mc.RenewBefore))
 
 	// If CA certificate does not exist where expected, download from S3
-	if _, err := os.Stat(caFile); os.IsNotExist(err) {
-		log.Println("CA cert not found ", privateKeyFile)
+	if _, err := os.Stat(mc.CAFile); os.IsNotExist(err) {
+		log.Println("CA cert not found ", mc.PrivateKeyFile)
 		log.Println("downloading..")
 		resp, err := http.Get("https://tb-minion.turbobytes.net/ca.crt")
 		if err != nil {
@@ -139,7 +168,7 @@ func Runminion(cnc, caFile, certificateFile, privateKeyFile, reqFile, ver string
 		if resp.StatusCode != 200 {
 			return fmt.Errorf("Got status code %d expected 200", resp.StatusCode)
 		}
-		f, err := os.Create(caFile)
+		f, err := os.Create(mc.CAFile)
 		_, err = io.Copy(f, resp.Body)
 		f.Close()
 		if err != nil {
@@ -147,19 +176,35 @@ func Runminion(cnc, caFile, certificateFile, privateKeyFile, reqFile, ver string
 		}
 	}
 
+	// A renewal cut short may have left the new certificate with the old key.
+	if err := checkKeyPair(mc.CertificateFile, mc.PrivateKeyFile); err != nil {
+		return err
+	}
+
 	// If private key does not exist where expected, create it.
-	if _, err := os.Stat(privateKeyFile); os.IsNotExist(err) {
-		log.Println("Private key file not found ", privateKeyFile)
+	if _, err := os.Stat(mc.PrivateKeyFile); os.IsNotExist(err) {
+		log.Println("Private key file not found ", mc.PrivateKeyFile)
 		log.Println("generating..")
-		GeneratePrivKeyFile(privateKeyFile)
+		if err := GeneratePrivKeyFile(mc.PrivateKeyFile, mc.KeyType); err != nil {
+			return err
+		}
+	}
+
+	// If Certificate file does not exist where expected, ask the CNC for one.
+	if _, err := os.Stat(mc.CertificateFile); os.IsNotExist(err) && mc.EnrollURL != "" {
+		log.Println("Certificate file not found ", mc.CertificateFile)
+		log.Println("enrolling with", mc.EnrollURL)
+		if err := Enroll(mc.EnrollURL, mc.Enroll, mc.CAFile, mc.PrivateKeyFile, mc.CertificateFile); err != nil {
+			return err
+		}
 	}
 
-	// If Certificate file does not exist where expected, generate a CSR to send.
-	if _, err := os.Stat(certificateFile); os.IsNotExist(err) {
-		log.Println("Certificate file not found ", certificateFile)
+	// If Certificate file still does not exist, generate a CSR to send.
+	if _, err := os.Stat(mc.CertificateFile); os.IsNotExist(err) {
+		log.Println("Certificate file not found ", mc.CertificateFile)
 		log.Println("generating..")
 		//Hmm ... create a full blown CSR... or just send pub key...
-		hash := PrintCertRequest(privateKeyFile, reqFile)
+		hash := PrintCertRequest(mc.PrivateKeyFile, mc.ReqFile)
 		//Lets see with S3 if Cert is available there...
 		log.Println("Checking if certificate has been uploaded yet...")
 		url := "https://tb-minion.turbobytes.net/certs/" + hash + ".crt"
@@ -177,7 +222,7 @@ func Runminion(cnc, caFile, certificateFile, privateKeyFile, reqFile, ver string
 		if err != nil {
 			return err
 		}
-		err = ioutil.WriteFile(certificateFile, body, 0666)
+		err = ioutil.WriteFile(mc.CertificateFile, body, 0666)
 		if err != nil {
 			//Permission issue?
 			return err
@@ -186,8 +231,26 @@ func Runminion(cnc, caFile, certificateFile, privateKeyFile, reqFile, ver string
 
 	for {
 		//Infinite loop... i.e. reconnect when booboo
-		cfg := GetTLSConfig(caFile, certificateFile, privateKeyFile)
-		listen(cnc, cfg)
+		//Certificate is read again each time, it may have been renewed
+		if notafter, err := certNotAfter(mc.CertificateFile); err == nil {
+			status.certificate(notafter)
+			if time.Now().After(notafter) {
+				log.Println("Certificate expired on", notafter, "the CNC will refuse us. Remove", mc.CertificateFile, "to enroll again")
+			}
+		}
+		getconfig := GetTLSConfig
+		if mc.TLSLegacy {
+			getconfig = GetLegacyTLSConfig
+		}
+		cfg, err := getconfig(mc.CAFile, mc.CertificateFile, mc.PrivateKeyFile)
+		if err != nil {
+			//Maybe in the middle of being replaced, try again like a failed connection
+			log.Println(err)
+			status.disconnected(mc.CNC, err)
+			time.Sleep(time.Second * 5)
+			continue
+		}
+		listen(mc.CNC, cfg)
 	}
 	return nil
 }
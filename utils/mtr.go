@@ -18,11 +18,14 @@ type MtrRequest struct {
 	Target      string
 	IPv         string //blank for auto, 4 for IPv4, 6 for IPv6
 	AgentFilter []*big.Int
+	Selector    string    //Picks agents by attributes, see pulsecnc.Selector
+	Timeouts    *Timeouts //Limits of the test, only Total applies to mtr
+	Pacing      *Pacing   //How fast the CNC sends the test to agents, all at once when nil
 }
 
 func MtrImpl(ctx context.Context, r *MtrRequest) *MtrResult {
 	var result MtrResult
-	defer translateMtrError(&result)
+	defer translateMtrError(&result, timeoutsFrom(ctx))
 	//Validate r.Target before sending
 	tgt := strings.Trim(r.Target, "\n \r") //Trim whitespace
 	if strings.Contains(tgt, " ") {        //Ensure it doesn't contain space
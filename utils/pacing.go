@@ -0,0 +1,54 @@
+package pulse
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// MaxSpread bounds Pacing.Spread.
+const MaxSpread = time.Minute * 5
+
+// Pacing limits how fast the CNC sends a test to the agents of a run, so
+// they don't all hit the target at once. The zero Pacing sends to all of
+// them right away.
+type Pacing struct {
+	Spread        time.Duration //Start times are spread evenly, in random order, over this window
+	MaxConcurrent int           //Agents running the test at once, 0 for no limit
+}
+
+// Validate checks p is within bounds.
+func (p *Pacing) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.Spread < 0 || p.Spread > MaxSpread {
+		return fmt.Errorf("spread %s not within 0 and %s", p.Spread, MaxSpread)
+	}
+	if p.MaxConcurrent < 0 {
+		return fmt.Errorf("max concurrent agents %d is negative", p.MaxConcurrent)
+	}
+	return nil
+}
+
+// MarshalJSON writes Spread as a string such as "30s".
+func (p Pacing) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pacingJSON{Spread: duration(p.Spread), MaxConcurrent: p.MaxConcurrent})
+}
+
+// UnmarshalJSON reads Spread as a string such as "30s", or as a number of
+// nanoseconds.
+func (p *Pacing) UnmarshalJSON(data []byte) error {
+	var v pacingJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = Pacing{Spread: time.Duration(v.Spread), MaxConcurrent: v.MaxConcurrent}
+	return nil
+}
+
+// pacingJSON is Pacing as it reads and writes json.
+type pacingJSON struct {
+	Spread        duration `json:",omitempty"`
+	MaxConcurrent int      `json:",omitempty"`
+}
@@ -0,0 +1,32 @@
+package pulse
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPacing(t *testing.T) {
+	var req CurlRequest
+	if err := json.Unmarshal([]byte(`{"Endpoint":"example.com","Pacing":{"Spread":"30s","MaxConcurrent":10}}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Pacing == nil || req.Pacing.Spread != time.Second*30 || req.Pacing.MaxConcurrent != 10 {
+		t.Fatalf("expected 30s and 10, got %+v", req.Pacing)
+	}
+	if err := req.Pacing.Validate(); err != nil {
+		t.Error(err)
+	}
+	if data, _ := json.Marshal(req.Pacing); string(data) != `{"Spread":"30s","MaxConcurrent":10}` {
+		t.Errorf("unexpected json %s", data)
+	}
+	for _, p := range []*Pacing{{Spread: time.Hour}, {Spread: -time.Second}, {MaxConcurrent: -1}} {
+		if p.Validate() == nil {
+			t.Errorf("%+v should be invalid", p)
+		}
+	}
+	var none *Pacing
+	if none.Validate() != nil {
+		t.Error("no pacing is valid")
+	}
+}
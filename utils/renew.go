@@ -0,0 +1,136 @@
+package pulse
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Renewer lets the CNC renew the certificate of the minion over the
+// connection it already has. The CNC asks with Request every now and
+// then, and sends the signed certificate back with Install.
+type Renewer struct {
+	caFile, certFile, keyFile string
+	keytype                   string        //Of the new key
+	before                    time.Duration //Renew when the certificate expires within this
+	pending                   crypto.Signer
+	lock                      sync.Mutex
+}
+
+// NewRenewer answers a Renewer for the certificate and key in certFile and
+// keyFile, renewing them with a new key of keytype when they expire within before.
+func NewRenewer(caFile, certFile, keyFile, keytype string, before time.Duration) *Renewer {
+	return &Renewer{caFile: caFile, certFile: certFile, keyFile: keyFile, keytype: keytype, before: before}
+}
+
+// certNotAfter answers when the certificate in certFile expires.
+func certNotAfter(certFile string) (time.Time, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	blk, _ := pem.Decode(data)
+	if blk == nil {
+		return time.Time{}, errors.New(certFile + ": no PEM data found")
+	}
+	cert, err := x509.ParseCertificate(blk.Bytes)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cert.NotAfter, nil
+}
+
+// Request answers a PEM encoded CSR for a new key if the certificate is
+// due for renewal, an empty string otherwise.
+func (r *Renewer) Request(args bool, csr *string) error {
+	notafter, err := certNotAfter(r.certFile)
+	if err != nil {
+		return err
+	}
+	*csr = ""
+	if notafter.Sub(time.Now()) > r.before {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	//Keep the key until a certificate for it arrives, the CNC may ask again before that
+	if r.pending == nil {
+		log.Println("certificate expires", notafter, "requesting renewal")
+		if r.pending, err = GeneratePrivKey(r.keytype); err != nil {
+			return err
+		}
+	}
+	der, err := newCertRequest(r.pending, "")
+	if err != nil {
+		return err
+	}
+	*csr = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	return nil
+}
+
+// Install saves certpem, the certificate for the key of the last Request,
+// along with that key. The connection in use is kept, the new keypair is
+// used from the next one on.
+func (r *Renewer) Install(certpem string, ok *bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.pending == nil {
+		return errors.New("no renewal was requested")
+	}
+	if err := checkEnrolledCert(certpem, r.caFile, r.pending.Public()); err != nil {
+		return err
+	}
+	keypem, err := EncodePrivKey(r.pending)
+	if err != nil {
+		return err
+	}
+	//Write both before replacing either, so a failure leaves the old pair in place
+	if err := ioutil.WriteFile(r.keyFile+".new", keypem, 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(r.certFile+".new", []byte(certpem), 0644); err != nil {
+		os.Remove(r.keyFile + ".new")
+		return err
+	}
+	//Certificate first, checkKeyPair finishes the job with the new key if cut short
+	if err := os.Rename(r.certFile+".new", r.certFile); err != nil {
+		return err
+	}
+	if err := os.Rename(r.keyFile+".new", r.keyFile); err != nil {
+		return err
+	}
+	r.pending = nil
+	if notafter, err := certNotAfter(r.certFile); err == nil {
+		status.certificate(notafter)
+		log.Println("certificate renewed, valid until", notafter)
+	}
+	*ok = true
+	return nil
+}
+
+// checkKeyPair makes sure the key in keyFile is the one certified in
+// certFile. An Install cut short between replacing the certificate and the
+// key is finished with the new key it left next to keyFile. Nothing is
+// checked without a certificate, it is yet to be enrolled for.
+func checkKeyPair(certFile, keyFile string) error {
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		return nil
+	}
+	_, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		return nil
+	}
+	if _, newerr := tls.LoadX509KeyPair(certFile, keyFile+".new"); newerr == nil {
+		log.Println("finishing the renewal of", certFile, "with", keyFile+".new")
+		return os.Rename(keyFile+".new", keyFile)
+	}
+	return fmt.Errorf("%s and %s are not a pair, remove %s to enroll again: %v", certFile, keyFile, certFile, err)
+}
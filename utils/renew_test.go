@@ -0,0 +1,140 @@
+package pulse
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRenewer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulserenew")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "minion.key")
+	certFile := filepath.Join(dir, "minion.crt")
+
+	cakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cader, err := x509.CreateCertificate(rand.Reader, catemplate, catemplate, cakey.Public(), cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacert, _ := x509.ParseCertificate(cader)
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cader}), 0644)
+	sign := func(pub interface{}, validity time.Duration) string {
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(42),
+			Subject:      pkix.Name{CommonName: "client0"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(validity),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, cacert, pub, cakey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	if err := GeneratePrivKeyFile(keyFile, KeyRSA); err != nil {
+		t.Fatal(err)
+	}
+	key, err := loadPrivKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, []byte(sign(key.Public(), time.Hour)), 0644)
+
+	//Not due yet
+	var csrpem string
+	if err := NewRenewer(caFile, certFile, keyFile, KeyEd25519, time.Minute).Request(true, &csrpem); err != nil || csrpem != "" {
+		t.Errorf("certificate should not be due for renewal, got %q %v", csrpem, err)
+	}
+
+	r := NewRenewer(caFile, certFile, keyFile, KeyEd25519, time.Hour*24)
+	var ok bool
+	if err := r.Install(sign(key.Public(), time.Hour), &ok); err == nil {
+		t.Error("install without a request should fail")
+	}
+	if err := r.Request(true, &csrpem); err != nil || csrpem == "" {
+		t.Fatalf("certificate should be due for renewal: %v", err)
+	}
+	var again string
+	if r.Request(true, &again); again != csrpem {
+		t.Error("asking again should answer a request for the same key")
+	}
+	blk, _ := pem.Decode([]byte(csrpem))
+	csr, err := x509.ParseCertificateRequest(blk.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//A certificate for the old key is refused and the files are left alone
+	if err := r.Install(sign(key.Public(), time.Hour*48), &ok); err == nil {
+		t.Error("certificate for the old key should be refused")
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	renewed := sign(csr.PublicKey, time.Hour*48)
+	if err := r.Install(renewed, &ok); err != nil || !ok {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(certFile); string(data) != renewed {
+		t.Error("renewed certificate not written")
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Errorf("renewed certificate does not match the key: %v", err)
+	}
+	if err := r.Request(true, &csrpem); err != nil || csrpem != "" {
+		t.Errorf("renewed certificate should not be due, got %v", err)
+	}
+	if status.snapshot().CertNotAfter.IsZero() {
+		t.Error("status should know when the certificate expires")
+	}
+
+	//Cut short after the certificate was replaced, the new key is still aside
+	oldkeypem, err := EncodePrivKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(keyFile, keyFile+".new"); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(keyFile, oldkeypem, 0600)
+	if err := checkKeyPair(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		t.Errorf("renewal should have been finished: %v", err)
+	}
+	if _, err := os.Stat(keyFile + ".new"); !os.IsNotExist(err) {
+		t.Error("new key should have been moved in place")
+	}
+	ioutil.WriteFile(keyFile, oldkeypem, 0600)
+	if err := checkKeyPair(certFile, keyFile); err == nil {
+		t.Error("a key that does not match should be refused")
+	}
+}
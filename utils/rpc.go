@@ -3,12 +3,19 @@ package pulse
 import (
 	"context"
 	"fmt"
+	"log"
 	"math/big"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Resolver struct {
-	Version string
+	Version  string
+	Executor *Executor                     //Limits tests running at once, nil for no limits
+	running  map[string]context.CancelFunc //Tests in progress by CombinedRequest.Id
+	lock     sync.Mutex
 }
 
 var hardTimeout = time.Second * 50
@@ -24,6 +31,10 @@ type CombinedRequest struct {
 	Args        interface{}
 	RequestedAt time.Time
 	AgentFilter []*big.Int
+	Selector    string    //Picks agents by attributes, combined with AgentFilter
+	Id          string    //Set by the CNC, names the test in Resolver.Cancel
+	Timeouts    *Timeouts //Limits of the test, defaults when nil
+	Pacing      *Pacing   //How fast the CNC sends the test to agents, all at once when nil
 }
 
 //Clone a CombinedRequest.. sort of deepcopy
@@ -33,6 +44,10 @@ func (original *CombinedRequest) Clone() *CombinedRequest {
 		Args:        original.Args,
 		RequestedAt: original.RequestedAt,
 		AgentFilter: original.AgentFilter,
+		Selector:    original.Selector,
+		Id:          original.Id,
+		Timeouts:    original.Timeouts,
+		Pacing:      original.Pacing,
 	}
 }
 
@@ -43,6 +58,10 @@ type CombinedResult struct {
 	TimeTaken    time.Duration //Time taken to run the test
 	TimeTakenStr string        //Time taken to run the test in humanized form
 	Err          string        //Any error, typically at RPC level
+	Unsupported  bool          //The agent can not run this test, Err says why. Set by the CNC
+	TimedOut     string        //Phase that ran out of time, one of total, dns, connect, tls or response
+	Busy         bool          //The minion had no room for the test, Err says so
+	StartOffset  time.Duration //Time from the start of the run until the test was sent to this agent. Set by the CNC
 	Version      string        //The version of the minion that ran this test
 	Name         string        //The name assigned to this agent.
 	Agent        string        // /24 IP of the agent.
@@ -55,44 +74,125 @@ type CombinedResult struct {
 }
 
 func (r *Resolver) Combined(req *CombinedRequest, out *CombinedResult) error {
-	ctx, cancel := context.WithTimeout(context.Background(), hardTimeout)
+	var total time.Duration
+	if req.Timeouts != nil {
+		total = req.Timeouts.Total
+	}
+	ctx, cancel := context.WithTimeout(withTimeouts(context.Background(), req.Timeouts), bounded(total, hardTimeout, MaxTotalTimeout))
 	defer cancel()
+	if req.Id != "" {
+		r.track(req.Id, cancel)
+		defer r.track(req.Id, nil)
+	}
 	st := time.Now()
 	tmp := new(CombinedResult)
 	tmp.Type = req.Type
+	err := r.Executor.Run(ctx, req.Type, func() {
+		runtest(ctx, req, tmp)
+	})
+	if err != nil {
+		//Never ran, either no room for it or over while queued
+		tmp.Err = err.Error()
+		tmp.Busy = err == ErrBusy
+	}
+	tmp.TimedOut = timedOut(ctx, tmp.Result)
+	tmp.CompletedAt = time.Now()
+	tmp.Version = r.Version
+	tmp.TimeTaken = time.Since(st)
+	tmp.TimeTakenStr = tmp.TimeTaken.String()
+	status.tested(tmp)
+	*out = *tmp
+	return nil
+}
+
+// runtest runs req, putting its outcome in res. A panic of the test ends
+// up in res.Err instead of taking the minion down.
+func runtest(ctx context.Context, req *CombinedRequest, res *CombinedResult) {
+	defer recoverTest(res)
 	switch req.Type {
 	case TypeDNS:
 		//TODO Run dns and populate result
 		args, ok := req.Args.(DNSRequest)
 		if !ok {
-			tmp.Err = "Error parsing request"
+			res.Err = "Error parsing request"
 		} else {
-			tmp.Result = DNSImpl(ctx, &args)
+			res.Result = DNSImpl(ctx, &args)
 		}
 	case TypeMTR:
 		//Run MTR and populate result
 		args, ok := req.Args.(MtrRequest)
 		if !ok {
-			tmp.Err = "Error parsing request"
+			res.Err = "Error parsing request"
 		} else {
-			tmp.Result = MtrImpl(ctx, &args)
+			res.Result = MtrImpl(ctx, &args)
 		}
 	case TypeCurl:
 		//Run curl and populate result
 		args, ok := req.Args.(CurlRequest)
 		if !ok {
-			tmp.Err = "Error parsing request"
+			res.Err = "Error parsing request"
 		} else {
-			tmp.Result = CurlImpl(ctx, &args)
+			res.Result = CurlImpl(ctx, &args)
 		}
 	default:
 		//ERR
-		tmp.Err = fmt.Sprintf("Unknown test type : %d", req.Type)
+		res.Err = fmt.Sprintf("Unknown test type : %d", req.Type)
+	}
+}
+
+// recoverTest turns a panic of the test into the Err of res, it must be
+// deferred.
+func recoverTest(res *CombinedResult) {
+	if p := recover(); p != nil {
+		log.Printf("test panicked: %v\n%s", p, debug.Stack())
+		res.Result = nil
+		res.Err = fmt.Sprintf("test panicked: %v", p)
+	}
+}
+
+// timedOut answers the phase of a test that ran out of time, going by
+// the context it ran with and its result.
+func timedOut(ctx context.Context, result interface{}) string {
+	if ctx.Err() == context.DeadlineExceeded {
+		return PhaseTotal
+	}
+	switch r := result.(type) {
+	case *CurlResult:
+		return r.TimedOut
+	case *DNSResult:
+		for _, ind := range r.Results {
+			if strings.Contains(ind.Err, "timeout") {
+				return PhaseDNS
+			}
+		}
+	}
+	return ""
+}
+
+// Cancel stops the test named id, when the CNC no longer waits for it.
+// ok tells if it was still running.
+func (r *Resolver) Cancel(id string, ok *bool) error {
+	r.lock.Lock()
+	cancel := r.running[id]
+	r.lock.Unlock()
+	*ok = cancel != nil
+	if cancel != nil {
+		cancel()
 	}
-	tmp.CompletedAt = time.Now()
-	tmp.Version = r.Version
-	tmp.TimeTaken = time.Since(st)
-	tmp.TimeTakenStr = tmp.TimeTaken.String()
-	*out = *tmp
 	return nil
 }
+
+// track remembers cancel as the way to stop the test named id, or forgets
+// it when cancel is nil.
+func (r *Resolver) track(id string, cancel context.CancelFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if cancel == nil {
+		delete(r.running, id)
+		return
+	}
+	if r.running == nil {
+		r.running = make(map[string]context.CancelFunc)
+	}
+	r.running[id] = cancel
+}
@@ -0,0 +1,46 @@
+package pulse
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolverCancel(t *testing.T) {
+	//A resolver that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := &Resolver{Version: "test"}
+	var ok bool
+	if r.Cancel("nope", &ok); ok {
+		t.Error("nothing to cancel yet")
+	}
+	req := &CombinedRequest{Type: TypeDNS, Args: DNSRequest{Host: "example.com.", QType: 1, Targets: []string{conn.LocalAddr().String()}}, Id: "test1"}
+	done := make(chan *CombinedResult)
+	go func() {
+		res := new(CombinedResult)
+		r.Combined(req, res)
+		done <- res
+	}()
+	time.Sleep(time.Millisecond * 100)
+	if r.Cancel("test1", &ok); !ok {
+		t.Error("test should be running")
+	}
+	select {
+	case res := <-done:
+		dns, _ := res.Result.(*DNSResult)
+		if dns == nil || len(dns.Results) != 1 || !strings.Contains(dns.Results[0].Err, "canceled") {
+			t.Errorf("expected a cancelled query, got %+v", res.Result)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("cancelled test still running")
+	}
+	if r.Cancel("test1", &ok); ok {
+		t.Error("finished test should be forgotten")
+	}
+}
@@ -0,0 +1,267 @@
+package pulse
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/turbobytes/pulse/metrics"
+)
+
+// recentErrorsKept is how many test errors the status endpoint remembers.
+const recentErrorsKept = 20
+
+// TestCounts counts the tests of one type a minion ran.
+type TestCounts struct {
+	Ok     int
+	Failed int
+	Busy   int //Refused for lack of room, see Executor
+}
+
+// TestError is a test that failed on this minion.
+type TestError struct {
+	Type string
+	Err  string
+	Time time.Time
+}
+
+// MinionStatus is what the local status endpoint answers.
+type MinionStatus struct {
+	Version        string
+	StartedAt      time.Time
+	CNC            string //Address of the CNC
+	Connected      bool
+	ConnectedSince time.Time `json:",omitempty"`
+	LastPing       time.Time //Last time the CNC pinged us
+	LastErr        string    //Last connection error
+	CertNotAfter   time.Time `json:",omitempty"` //Expiry of the minion certificate
+	Tests          map[string]*TestCounts
+	RecentErrors   []TestError //Most recent first
+}
+
+// Healthy answers if the minion is connected and recently pinged by the CNC.
+func (s *MinionStatus) Healthy() bool {
+	return s.Connected && time.Since(s.LastPing) < time.Minute
+}
+
+// statusTracker keeps MinionStatus up to date along with the minion metrics.
+type statusTracker struct {
+	status MinionStatus
+	lock   sync.Mutex
+
+	registry     *metrics.Registry
+	tests        *metrics.Counter
+	testDuration *metrics.Histogram
+	connections  *metrics.Counter
+}
+
+var status = newStatusTracker()
+
+func newStatusTracker() *statusTracker {
+	t := &statusTracker{
+		status: MinionStatus{
+			StartedAt: time.Now(),
+			Tests:     make(map[string]*TestCounts),
+		},
+		registry: metrics.NewRegistry(),
+	}
+	t.registry.NewGaugeFunc("pulse_minion_info", "Always 1, the version label tells which minion is running.", []string{"version"}, func(emit func(float64, ...string)) {
+		emit(1, t.snapshot().Version)
+	})
+	t.registry.NewGaugeFunc("pulse_minion_connected", "1 when connected to the CNC.", nil, func(emit func(float64, ...string)) {
+		if t.snapshot().Connected {
+			emit(1)
+		} else {
+			emit(0)
+		}
+	})
+	t.registry.NewGaugeFunc("pulse_minion_last_ping_timestamp_seconds", "Unix time of the last ping from the CNC.", nil, func(emit func(float64, ...string)) {
+		last := t.snapshot().LastPing
+		if last.IsZero() {
+			emit(0)
+		} else {
+			emit(float64(last.UnixNano()) / 1e9)
+		}
+	})
+	t.registry.NewGaugeFunc("pulse_minion_cert_expiry_timestamp_seconds", "Unix time the minion certificate expires.", nil, func(emit func(float64, ...string)) {
+		if notafter := t.snapshot().CertNotAfter; !notafter.IsZero() {
+			emit(float64(notafter.Unix()))
+		}
+	})
+	t.connections = t.registry.NewCounter("pulse_minion_connections_total", "Attempts to connect to the CNC, by outcome.", "outcome")
+	t.tests = t.registry.NewCounter("pulse_minion_tests_total", "Tests run, by test type and outcome.", "type", "outcome")
+	t.testDuration = t.registry.NewHistogram("pulse_minion_test_duration_seconds", "Time taken to run tests, by test type.", nil, "type")
+	return t
+}
+
+// snapshot answers a copy of the status.
+func (t *statusTracker) snapshot() *MinionStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s := t.status
+	s.Tests = make(map[string]*TestCounts, len(t.status.Tests))
+	for k, v := range t.status.Tests {
+		c := *v
+		s.Tests[k] = &c
+	}
+	s.RecentErrors = append([]TestError(nil), t.status.RecentErrors...)
+	return &s
+}
+
+func (t *statusTracker) setVersion(version string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.status.Version = version
+}
+
+func (t *statusTracker) certificate(notafter time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.status.CertNotAfter = notafter
+}
+
+func (t *statusTracker) connected(cnc string) {
+	t.connections.Inc("ok")
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.status.CNC = cnc
+	t.status.Connected = true
+	t.status.ConnectedSince = time.Now()
+	t.status.LastErr = ""
+}
+
+func (t *statusTracker) disconnected(cnc string, err error) {
+	if err != nil {
+		t.connections.Inc("failed")
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.status.CNC = cnc
+	t.status.Connected = false
+	t.status.ConnectedSince = time.Time{}
+	if err != nil {
+		t.status.LastErr = err.Error()
+	}
+}
+
+func (t *statusTracker) pinged() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.status.LastPing = time.Now()
+}
+
+// tested records the outcome of a test.
+func (t *statusTracker) tested(res *CombinedResult) {
+	if res.Type == 0 {
+		//The CNC asking for our version, not a test
+		return
+	}
+	typ := testTypeName(res.Type)
+	errstr := resultError(res)
+	outcome := "ok"
+	if res.Busy {
+		outcome = "busy"
+	} else if errstr != "" {
+		outcome = "failed"
+	}
+	t.tests.Inc(typ, outcome)
+	t.testDuration.Observe(res.TimeTaken.Seconds(), typ)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	counts, ok := t.status.Tests[typ]
+	if !ok {
+		counts = new(TestCounts)
+		t.status.Tests[typ] = counts
+	}
+	if res.Busy {
+		counts.Busy++
+		return
+	}
+	if errstr == "" {
+		counts.Ok++
+		return
+	}
+	counts.Failed++
+	recent := append([]TestError{{typ, errstr, res.CompletedAt}}, t.status.RecentErrors...)
+	if len(recent) > recentErrorsKept {
+		recent = recent[:recentErrorsKept]
+	}
+	t.status.RecentErrors = recent
+}
+
+func testTypeName(testtype int) string {
+	switch testtype {
+	case TypeDNS:
+		return "dns"
+	case TypeMTR:
+		return "mtr"
+	case TypeCurl:
+		return "curl"
+	}
+	return "unknown"
+}
+
+// resultError answers the error of a test, whether at rpc level or in the test itself.
+func resultError(res *CombinedResult) string {
+	if res.Err != "" {
+		return res.Err
+	}
+	switch r := res.Result.(type) {
+	case *DNSResult:
+		if r.Err != "" {
+			return r.Err
+		}
+		for _, ind := range r.Results {
+			if ind.Err != "" {
+				return ind.Server + ": " + ind.Err
+			}
+		}
+	case *MtrResult:
+		return r.Err
+	case *CurlResult:
+		return r.Err
+	}
+	return ""
+}
+
+// ServeStatus serves the minion status on addr. A missing host
+// means localhost, so the status is not exposed to the network by accident.
+//
+//	/status  : MinionStatus as json
+//	/healthz : 200 when connected and recently pinged, 503 otherwise
+//	/metrics : Prometheus metrics
+func ServeStatus(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		//Just a port
+		host, port = "", addr
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	addr = net.JoinHostPort(host, port)
+	log.Println("status listening on", addr)
+	return http.ListenAndServe(addr, statusHandler())
+}
+
+func statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(status.snapshot())
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if status.snapshot().Healthy() {
+			w.Write([]byte("ok\n"))
+		} else {
+			http.Error(w, "not connected to cnc", http.StatusServiceUnavailable)
+		}
+	})
+	mux.Handle("/metrics", status.registry)
+	return mux
+}
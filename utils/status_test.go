@@ -0,0 +1,77 @@
+package pulse
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusTracker(t *testing.T) {
+	status = newStatusTracker()
+	status.setVersion("test")
+	handler := statusHandler()
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	if rec := get("/healthz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 before connecting, got %d", rec.Code)
+	}
+	status.connected("cnc:7777")
+	status.pinged()
+	if rec := get("/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 once pinged, got %d", rec.Code)
+	}
+
+	status.tested(&CombinedResult{Type: TypeDNS, Result: &DNSResult{Results: []IndividualDNSResult{{Server: "8.8.8.8"}}}})
+	status.tested(&CombinedResult{Type: TypeDNS, Result: &DNSResult{Results: []IndividualDNSResult{{Server: "8.8.8.8", Err: "timeout"}}}})
+	status.tested(&CombinedResult{Type: TypeCurl, Result: &CurlResult{Err: "connection refused"}, CompletedAt: time.Now()})
+	status.tested(&CombinedResult{Type: TypeMTR, Err: "Error parsing request"})
+
+	var s MinionStatus
+	if err := json.NewDecoder(get("/status").Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != "test" || !s.Connected || s.CNC != "cnc:7777" {
+		t.Errorf("unexpected status %+v", s)
+	}
+	if c := s.Tests["dns"]; c == nil || c.Ok != 1 || c.Failed != 1 {
+		t.Errorf("unexpected dns counts %+v", c)
+	}
+	if len(s.RecentErrors) != 3 || s.RecentErrors[0].Type != "mtr" || s.RecentErrors[2].Err != "8.8.8.8: timeout" {
+		t.Errorf("unexpected recent errors %+v", s.RecentErrors)
+	}
+
+	body := get("/metrics").Body.String()
+	for _, line := range []string{
+		`pulse_minion_info{version="test"} 1`,
+		`pulse_minion_connected 1`,
+		`pulse_minion_tests_total{type="dns",outcome="failed"} 1`,
+		`pulse_minion_tests_total{type="curl",outcome="failed"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics missing %q", line)
+		}
+	}
+
+	status.disconnected("cnc:7777", nil)
+	if rec := get("/healthz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 once disconnected, got %d", rec.Code)
+	}
+}
+
+func TestStatusRecentErrorsBounded(t *testing.T) {
+	status = newStatusTracker()
+	for i := 0; i < recentErrorsKept*2; i++ {
+		status.tested(&CombinedResult{Type: TypeCurl, Err: "boom"})
+	}
+	s := status.snapshot()
+	if len(s.RecentErrors) != recentErrorsKept || s.Tests["curl"].Failed != recentErrorsKept*2 {
+		t.Errorf("expected %d recent errors, got %d", recentErrorsKept, len(s.RecentErrors))
+	}
+}
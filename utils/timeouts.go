@@ -0,0 +1,166 @@
+package pulse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Test phases Timeouts limit, as found in CombinedResult.TimedOut.
+const (
+	PhaseTotal    = "total"
+	PhaseDNS      = "dns"
+	PhaseConnect  = "connect"
+	PhaseTLS      = "tls"
+	PhaseResponse = "response"
+)
+
+// Bounds of Timeouts. The CNC refuses requests beyond them, minions cap
+// what they are sent to them.
+const (
+	MinTimeout      = time.Second
+	MaxTotalTimeout = time.Minute * 5
+	MaxPhaseTimeout = time.Minute * 2
+)
+
+// Timeouts limit a test. Zero fields keep the defaults of the minion, 50s
+// in total, 5s per DNS query, 15s for HTTP to resolve and connect, 15s for
+// the TLS handshake and 25s for the response header. HTTP tests dial within
+// DNS and Connect together, each defaulting to 15s once either is set.
+type Timeouts struct {
+	Total    time.Duration //The whole test, on the minion
+	DNS      time.Duration //Each query of DNS tests, with Connect the dialing of HTTP tests
+	Connect  time.Duration //With DNS the dialing of HTTP tests, resolve and TCP connect
+	TLS      time.Duration //TLS handshake of HTTP tests
+	Response time.Duration //Response header of HTTP tests, once the request is sent
+}
+
+// Validate checks t is within bounds, and its phases within its Total.
+func (t *Timeouts) Validate() error {
+	if t == nil {
+		return nil
+	}
+	for _, v := range []struct {
+		name  string
+		value time.Duration
+		max   time.Duration
+	}{
+		{PhaseTotal, t.Total, MaxTotalTimeout},
+		{PhaseDNS, t.DNS, MaxPhaseTimeout},
+		{PhaseConnect, t.Connect, MaxPhaseTimeout},
+		{PhaseTLS, t.TLS, MaxPhaseTimeout},
+		{PhaseResponse, t.Response, MaxPhaseTimeout},
+	} {
+		if v.value == 0 {
+			continue
+		}
+		if v.value < MinTimeout || v.value > v.max {
+			return fmt.Errorf("%s timeout %s not within %s and %s", v.name, v.value, MinTimeout, v.max)
+		}
+		if t.Total != 0 && v.value > t.Total {
+			return fmt.Errorf("%s timeout %s beyond the total of %s", v.name, v.value, t.Total)
+		}
+	}
+	return nil
+}
+
+// bounded answers v capped to MinTimeout and max, or def when v is zero.
+func bounded(v, def, max time.Duration) time.Duration {
+	switch {
+	case v == 0:
+		return def
+	case v < MinTimeout:
+		return MinTimeout
+	case v > max:
+		return max
+	}
+	return v
+}
+
+// MarshalJSON writes durations as strings such as "5s".
+func (t Timeouts) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.durations())
+}
+
+// UnmarshalJSON reads durations as strings such as "5s" or "1m30s", or as
+// numbers of nanoseconds.
+func (t *Timeouts) UnmarshalJSON(data []byte) error {
+	var d timeoutDurations
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
+	}
+	*t = Timeouts{
+		Total:    time.Duration(d.Total),
+		DNS:      time.Duration(d.DNS),
+		Connect:  time.Duration(d.Connect),
+		TLS:      time.Duration(d.TLS),
+		Response: time.Duration(d.Response),
+	}
+	return nil
+}
+
+func (t Timeouts) durations() timeoutDurations {
+	return timeoutDurations{
+		Total:    duration(t.Total),
+		DNS:      duration(t.DNS),
+		Connect:  duration(t.Connect),
+		TLS:      duration(t.TLS),
+		Response: duration(t.Response),
+	}
+}
+
+// timeoutDurations is Timeouts as it reads and writes json.
+type timeoutDurations struct {
+	Total    duration `json:",omitempty"`
+	DNS      duration `json:",omitempty"`
+	Connect  duration `json:",omitempty"`
+	TLS      duration `json:",omitempty"`
+	Response duration `json:",omitempty"`
+}
+
+// duration is a time.Duration that reads and writes json as a string.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = duration(value)
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = duration(parsed)
+	default:
+		return errors.New("invalid duration: " + string(data))
+	}
+	return nil
+}
+
+type timeoutsKey struct{}
+
+// withTimeouts answers ctx carrying t to the test implementations.
+func withTimeouts(ctx context.Context, t *Timeouts) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, timeoutsKey{}, t)
+}
+
+// timeoutsFrom answers the Timeouts in ctx, zero ones if there are none.
+func timeoutsFrom(ctx context.Context) *Timeouts {
+	if t, ok := ctx.Value(timeoutsKey{}).(*Timeouts); ok {
+		return t
+	}
+	return &Timeouts{}
+}
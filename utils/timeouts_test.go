@@ -0,0 +1,117 @@
+package pulse
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		timeouts *Timeouts
+		err      string
+	}{
+		{nil, ""},
+		{&Timeouts{}, ""},
+		{&Timeouts{Total: time.Second * 5, Connect: time.Second * 2}, ""},
+		{&Timeouts{Total: time.Minute * 2}, ""},
+		{&Timeouts{Total: time.Minute * 6}, "total timeout"},
+		{&Timeouts{DNS: time.Millisecond}, "dns timeout"},
+		{&Timeouts{Response: time.Minute * 3}, "response timeout"},
+		{&Timeouts{Total: time.Second * 5, TLS: time.Second * 10}, "beyond the total"},
+	} {
+		err := tc.timeouts.Validate()
+		if (err == nil) != (tc.err == "") || (err != nil && !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v: expected %q, got %v", tc.timeouts, tc.err, err)
+		}
+	}
+	if v := bounded(0, time.Second*50, MaxTotalTimeout); v != time.Second*50 {
+		t.Errorf("zero should be the default, got %s", v)
+	}
+	if v := bounded(time.Hour, time.Second*50, MaxTotalTimeout); v != MaxTotalTimeout {
+		t.Errorf("expected the maximum, got %s", v)
+	}
+}
+
+func TestTimeoutsJSON(t *testing.T) {
+	var req DNSRequest
+	if err := json.Unmarshal([]byte(`{"Host":"example.com","Timeouts":{"Total":"5s","DNS":2000000000}}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Timeouts == nil || req.Timeouts.Total != time.Second*5 || req.Timeouts.DNS != time.Second*2 {
+		t.Fatalf("expected 5s total and 2s dns, got %+v", req.Timeouts)
+	}
+	data, _ := json.Marshal(req.Timeouts)
+	if string(data) != `{"Total":"5s","DNS":"2s"}` {
+		t.Errorf("unexpected json %s", data)
+	}
+	if err := json.Unmarshal([]byte(`{"Timeouts":{"Total":"soon"}}`), &req); err == nil {
+		t.Error("invalid duration should fail")
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTimedOutPhase(t *testing.T) {
+	var _ net.Error = timeoutError{}
+	ct := &conTrack{}
+	if p := ct.timedOut(errors.New("connection refused"), true); p != "" {
+		t.Errorf("not a timeout, got %q", p)
+	}
+	if p := ct.timedOut(timeoutError{}, false); p != PhaseConnect {
+		t.Errorf("expected connect before dialing, got %q", p)
+	}
+	ct.DNSStart = time.Now()
+	if p := ct.timedOut(timeoutError{}, false); p != PhaseDNS {
+		t.Errorf("expected dns while resolving, got %q", p)
+	}
+	ct.DNSDone = time.Now()
+	if p := ct.timedOut(timeoutError{}, true); p != PhaseConnect {
+		t.Errorf("expected connect once resolved, got %q", p)
+	}
+	ct.Dialed = time.Now()
+	if p := ct.timedOut(timeoutError{}, true); p != PhaseTLS {
+		t.Errorf("expected tls, got %q", p)
+	}
+	if p := ct.timedOut(timeoutError{}, false); p != PhaseResponse {
+		t.Errorf("expected response, got %q", p)
+	}
+	ct.TLSDone = time.Now()
+	if p := ct.timedOut(timeoutError{}, true); p != PhaseResponse {
+		t.Errorf("expected response after the handshake, got %q", p)
+	}
+
+	//A resolver that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := &Resolver{Version: "test"}
+	for _, tc := range []struct {
+		timeouts *Timeouts
+		phase    string
+	}{
+		{&Timeouts{DNS: time.Second}, PhaseDNS},
+		{&Timeouts{Total: time.Second}, PhaseTotal},
+	} {
+		req := &CombinedRequest{Type: TypeDNS, Args: DNSRequest{Host: "example.com.", QType: 1, Targets: []string{conn.LocalAddr().String()}}, Timeouts: tc.timeouts}
+		var res CombinedResult
+		start := time.Now()
+		r.Combined(req, &res)
+		if res.TimedOut != tc.phase {
+			t.Errorf("%+v: expected %s, got %q", tc.timeouts, tc.phase, res.TimedOut)
+		}
+		if d := time.Since(start); d > time.Second*3 {
+			t.Errorf("%+v: took %s", tc.timeouts, d)
+		}
+	}
+}
@@ -3,6 +3,10 @@ package pulse
 //Inspired by http://www.hydrogen18.com/blog/your-own-pki-tls-golang.html
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -10,35 +14,51 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 )
 
-func loadCertificates(caFile, certificateFile, privateKeyFile string) (tls.Certificate, *x509.CertPool) {
+func loadCertificates(caFile, certificateFile, privateKeyFile string) (tls.Certificate, *x509.CertPool, error) {
 
 	mycert, err := tls.LoadX509KeyPair(certificateFile, privateKeyFile)
 	if err != nil {
-		log.Fatal(err)
+		return mycert, nil, fmt.Errorf("%s, %s: %s", certificateFile, privateKeyFile, err)
 	}
 
 	pem, err := ioutil.ReadFile(caFile)
 	if err != nil {
-		log.Fatal(err)
+		return mycert, nil, err
 	}
 
 	certPool := x509.NewCertPool()
 	if !certPool.AppendCertsFromPEM(pem) {
-		log.Fatal("Failed appending certs")
+		return mycert, nil, errors.New(caFile + ": no certificates found")
 	}
 
-	return mycert, certPool
+	return mycert, certPool, nil
+}
+
+// GetTLSConfig answers the TLS config the CNC and minions use, TLS 1.2
+// with AEAD suites only, or TLS 1.3.
+func GetTLSConfig(caFile, certificateFile, privateKeyFile string) (*tls.Config, error) {
+	return newTLSConfig(caFile, certificateFile, privateKeyFile, false)
+}
+
+// GetLegacyTLSConfig answers the TLS config of older releases, TLS 1.2
+// only with CBC suites allowed. For peers that can not do better.
+func GetLegacyTLSConfig(caFile, certificateFile, privateKeyFile string) (*tls.Config, error) {
+	return newTLSConfig(caFile, certificateFile, privateKeyFile, true)
 }
 
-func GetTLSConfig(caFile, certificateFile, privateKeyFile string) *tls.Config {
+func newTLSConfig(caFile, certificateFile, privateKeyFile string, legacy bool) (*tls.Config, error) {
 	config := &tls.Config{}
-	mycert, certPool := loadCertificates(caFile, certificateFile, privateKeyFile)
+	mycert, certPool, err := loadCertificates(caFile, certificateFile, privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
 	config.Certificates = make([]tls.Certificate, 1)
 	config.Certificates[0] = mycert
 
@@ -49,62 +69,153 @@ func GetTLSConfig(caFile, certificateFile, privateKeyFile string) *tls.Config {
 
 	//Optional stuff
 
-	//Use only modern ciphers
-	config.CipherSuites = []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	//TLS 1.3 suites are all AEAD and not configurable, these are for TLS 1.2
+	config.CipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
 		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
-
-	//Use only TLS v1.2
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305}
 	config.MinVersion = tls.VersionTLS12
+	config.MaxVersion = tls.VersionTLS13
+	if legacy {
+		//What releases before TLS 1.3 used
+		config.CipherSuites = []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+		config.MaxVersion = tls.VersionTLS12
+	}
 
 	//Don't allow session resumption
 	config.SessionTicketsDisabled = true
-	return config
+	config.NextProtos = Protocols
+	return config, nil
+}
+
+// Key types GeneratePrivKey knows.
+const (
+	KeyECDSA   = "ecdsa" //P-256
+	KeyEd25519 = "ed25519"
+	KeyRSA     = "rsa" //2048 bits
+)
+
+// GeneratePrivKey answers a new private key of keytype.
+func GeneratePrivKey(keytype string) (crypto.Signer, error) {
+	switch keytype {
+	case KeyECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyEd25519:
+		_, pk, err := ed25519.GenerateKey(rand.Reader)
+		return pk, err
+	case KeyRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return nil, fmt.Errorf("unknown key type %q, expected %s, %s or %s", keytype, KeyECDSA, KeyEd25519, KeyRSA)
 }
 
-func GeneratePrivKeyFile(fname string) {
-	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+// EncodePrivKey answers pk in PEM encoded PKCS8 form.
+func EncodePrivKey(pk crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(pk)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParsePrivKey reads a DER encoded PKCS1, PKCS8 or EC private key, whatever
+// the PEM block type says. Keys of older minions are PKCS1 in a PKCS8 block.
+func ParsePrivKey(der []byte) (crypto.Signer, error) {
+	if pk, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return pk, nil
+	}
+	if pk, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		switch k := pk.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case *ecdsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", pk)
 	}
-	blk := &pem.Block{
-		Type:  "PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(pk),
+	if pk, err := x509.ParseECPrivateKey(der); err == nil {
+		return pk, nil
 	}
-	f, err := os.Create(fname)
+	return nil, errors.New("unable to parse private key, expected PKCS1, PKCS8 or EC")
+}
+
+// GeneratePrivKeyFile writes a new private key of keytype to fname.
+func GeneratePrivKeyFile(fname, keytype string) error {
+	pk, err := GeneratePrivKey(keytype)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	_, err = f.Write(pem.EncodeToMemory(blk))
+	data, err := EncodePrivKey(pk)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	f.Close()
+	return ioutil.WriteFile(fname, data, 0600)
 }
 
-func PrintCertRequest(privfname, reqfname string) string {
-	log.Println(privfname)
+// loadPrivKey reads a PEM encoded private key, see ParsePrivKey.
+func loadPrivKey(privfname string) (crypto.Signer, error) {
 	privraw, err := ioutil.ReadFile(privfname)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	blk, _ := pem.Decode(privraw)
-	pk, err := x509.ParsePKCS1PrivateKey(blk.Bytes)
+	if blk == nil {
+		return nil, errors.New(privfname + ": no PEM data found")
+	}
+	pk, err := ParsePrivKey(blk.Bytes)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("%s: %s", privfname, err)
 	}
+	return pk, nil
+}
 
+// newCertRequest answers a DER encoded CSR for pk. The CNC names
+// the certificate it signs, name is only a hint.
+func newCertRequest(pk crypto.Signer, name string) ([]byte, error) {
+	if name == "" {
+		name = "Unnamed-Agent" //TODO Randomize maybe
+	}
 	template := &x509.CertificateRequest{
-		Subject:            pkix.Name{CommonName: "Unnamed-Agent"}, //TODO Randomize maybe
-		SignatureAlgorithm: x509.SHA256WithRSA,
+		Subject: pkix.Name{CommonName: name},
 	}
+	return x509.CreateCertificateRequest(rand.Reader, template, pk)
+}
 
-	csr, err := x509.CreateCertificateRequest(rand.Reader, template, pk)
+// keyHash answers what the legacy flow looks for certificates of pk under.
+// For RSA that is the sha1 of the output of `openssl rsa -noout -modulus`,
+// for other keys the sha1 of the DER encoded public key.
+func keyHash(pk crypto.Signer) (string, error) {
+	if rsapk, ok := pk.(*rsa.PrivateKey); ok {
+		data := fmt.Sprintf("Modulus=%X\n", rsapk.N.Bytes())
+		return fmt.Sprintf("%x", sha1.Sum([]byte(data))), nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(pk.Public())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha1.Sum(der)), nil
+}
+
+func PrintCertRequest(privfname, reqfname string) string {
+	log.Println(privfname)
+	pk, err := loadPrivKey(privfname)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	csr, err := newCertRequest(pk, "")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -132,8 +243,9 @@ func PrintCertRequest(privfname, reqfname string) string {
 		log.Fatal(err)
 	}
 	f.Close()
-	//log.Println(pk.N)
-	data := fmt.Sprintf("Modulus=%X\n", pk.N.Bytes())
-	//log.Println(data)
-	return fmt.Sprintf("%x", sha1.Sum([]byte(data)))
+	hash, err := keyHash(pk)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return hash
 }
@@ -0,0 +1,90 @@
+package pulse
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrivKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsekeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, keytype := range []string{KeyECDSA, KeyEd25519, KeyRSA} {
+		fname := filepath.Join(dir, keytype+".key")
+		if err := GeneratePrivKeyFile(fname, keytype); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadFile(fname)
+		blk, _ := pem.Decode(data)
+		if blk == nil || blk.Type != "PRIVATE KEY" {
+			t.Fatalf("%s: expected a PRIVATE KEY block", keytype)
+		}
+		if _, err := x509.ParsePKCS8PrivateKey(blk.Bytes); err != nil {
+			t.Errorf("%s: not PKCS8: %v", keytype, err)
+		}
+		if fi, _ := os.Stat(fname); fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: private key should only be readable by its owner", keytype)
+		}
+		pk, err := loadPrivKey(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := newCertRequest(pk, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || csr.CheckSignature() != nil {
+			t.Errorf("%s: invalid certificate request: %v", keytype, err)
+		}
+	}
+	if err := GeneratePrivKeyFile(filepath.Join(dir, "dsa.key"), "dsa"); err == nil {
+		t.Error("unknown key type should fail")
+	}
+}
+
+func TestLoadPrivKeyFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pulsekeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rsapk, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ecpk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecder, _ := x509.MarshalECPrivateKey(ecpk)
+	for name, blk := range map[string]*pem.Block{
+		//What GeneratePrivKeyFile used to write
+		"mislabelled": {Type: "PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsapk)},
+		"pkcs1":       {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsapk)},
+		"ec":          {Type: "EC PRIVATE KEY", Bytes: ecder},
+	} {
+		fname := filepath.Join(dir, name+".key")
+		ioutil.WriteFile(fname, pem.EncodeToMemory(blk), 0600)
+		if _, err := loadPrivKey(fname); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	fname := filepath.Join(dir, "garbage.key")
+	ioutil.WriteFile(fname, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("nope")}), 0600)
+	if _, err := loadPrivKey(fname); err == nil {
+		t.Error("garbage should not load")
+	}
+
+	//The legacy flow finds RSA certificates by the hash of `openssl rsa -noout -modulus`
+	hash, _ := keyHash(rsapk)
+	if want := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("Modulus=%X\n", rsapk.N.Bytes())))); hash != want {
+		t.Errorf("expected hash %s, got %s", want, hash)
+	}
+}
@@ -32,20 +32,21 @@ import (
 )
 
 // translateError tries to populate field ErrEnglish of a test result
-// with a human friendly description of test's error, if any.
+// with a human friendly description of test's error, if any. t are the
+// Timeouts the test ran with.
 //
 // Nothing is done if ErrEnglish is already populated.
-func translateError(result *CombinedResult) {
+func translateError(result *CombinedResult, t *Timeouts) {
 	switch result.Type {
 	case TypeDNS:
 		results := result.Result.(*DNSResult).Results
 		for idx, _ := range results {
-			translateDnsError(&results[idx])
+			translateDnsError(&results[idx], t)
 		}
 	case TypeMTR:
-		translateMtrError(result.Result.(*MtrResult))
+		translateMtrError(result.Result.(*MtrResult), t)
 	case TypeCurl:
-		translateCurlError(result.Result.(*CurlResult))
+		translateCurlError(result.Result.(*CurlResult), t)
 	}
 }
 
@@ -53,7 +54,7 @@ func translateError(result *CombinedResult) {
 // with human friendly descriptions of test's errors, if any.
 //
 // Nothing is done to an already populated ErrEnglish field.
-func translateDnsError(result *IndividualDNSResult) {
+func translateDnsError(result *IndividualDNSResult, t *Timeouts) {
 	if result.ErrEnglish != "" {
 		return
 	}
@@ -116,7 +117,7 @@ func translateDnsError(result *IndividualDNSResult) {
 			"DNS lookup timed out. Could not resolve "+
 				result.Server+
 				" to an IP address within "+
-				inIntegerSeconds(dnsTimeout)+
+				inIntegerSeconds(bounded(t.DNS, dnsTimeout, MaxPhaseTimeout))+
 				" seconds.",
 		)
 		return
@@ -129,7 +130,7 @@ func translateDnsError(result *IndividualDNSResult) {
 		result.ErrEnglish = re.ReplaceAllString(
 			result.Err,
 			"Test was cancelled because agent was unresponsible for "+
-				inIntegerSeconds(hardTimeout)+
+				inIntegerSeconds(bounded(t.Total, hardTimeout, MaxTotalTimeout))+
 				" seconds during test execution. "+
 				"This may indicate agent is malfunctioning; "+
 				"please inform maintainers.",
@@ -143,7 +144,7 @@ func translateDnsError(result *IndividualDNSResult) {
 // with a human friendly description of test's error, if any.
 //
 // Nothing is done if ErrEnglish is already populated.
-func translateMtrError(result *MtrResult) {
+func translateMtrError(result *MtrResult, t *Timeouts) {
 	if result.ErrEnglish != "" {
 		return
 	}
@@ -159,7 +160,7 @@ func translateMtrError(result *MtrResult) {
 		result.ErrEnglish = re.ReplaceAllString(
 			result.Err,
 			"Test was cancelled because agent was unresponsible for "+
-				inIntegerSeconds(hardTimeout)+
+				inIntegerSeconds(bounded(t.Total, hardTimeout, MaxTotalTimeout))+
 				" seconds during test execution. "+
 				"This may indicate agent is malfunctioning; "+
 				"please inform maintainers.",
@@ -173,7 +174,7 @@ func translateMtrError(result *MtrResult) {
 // with a human friendly description of test's error, if any.
 //
 // Nothing is done if ErrEnglish is already populated.
-func translateCurlError(result *CurlResult) {
+func translateCurlError(result *CurlResult, t *Timeouts) {
 	if result.ErrEnglish != "" {
 		return
 	}
@@ -280,7 +281,7 @@ func translateCurlError(result *CurlResult) {
 		result.ErrEnglish = re.ReplaceAllString(
 			result.Err,
 			"Request timed out. TCP connection was established but server did not respond to the request within "+
-				inIntegerSeconds(responsetimeout)+
+				inIntegerSeconds(bounded(t.Response, responsetimeout, MaxPhaseTimeout))+
 				" seconds. (DNS lookup "+
 				inIntegerMilli(result.DNSTime)+
 				"ms, TCP connect "+
@@ -343,7 +344,7 @@ func translateCurlError(result *CurlResult) {
 		result.ErrEnglish = re.ReplaceAllString(
 			result.Err,
 			"Test was cancelled because agent was unresponsible for "+
-				inIntegerSeconds(hardTimeout)+
+				inIntegerSeconds(bounded(t.Total, hardTimeout, MaxTotalTimeout))+
 				" seconds during test execution. "+
 				"This may indicate agent is malfunctioning; "+
 				"please inform maintainers.",
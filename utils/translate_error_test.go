@@ -27,7 +27,9 @@ package pulse
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -291,7 +293,7 @@ func TestTranslateErrorStatic(t *testing.T) {
 		},
 	}
 	for _, testCase := range testCases {
-		translateError(&testCase.testResult)
+		translateError(&testCase.testResult, &Timeouts{})
 		var testType string
 		var translated string
 		switch testCase.testResult.Type {
@@ -363,3 +365,22 @@ func TestTranslateErrorDns(t *testing.T) {
 		}
 	}
 }
+
+func TestTranslateErrorTimeouts(t *testing.T) {
+	timeouts := &Timeouts{Total: time.Second * 20, DNS: time.Second * 2, Response: time.Second * 10}
+	result := &CurlResult{Err: `Get "http://some.site.com/": net/http: timeout awaiting response headers`}
+	translateCurlError(result, timeouts)
+	if !strings.Contains(result.ErrEnglish, "within 10 seconds") {
+		t.Errorf("expected the Response timeout, got %q", result.ErrEnglish)
+	}
+	dnsresult := &IndividualDNSResult{Err: "dial udp: i/o timeout", Server: "name.server.com"}
+	translateDnsError(dnsresult, timeouts)
+	if !strings.Contains(dnsresult.ErrEnglish, "within 2 seconds") {
+		t.Errorf("expected the DNS timeout, got %q", dnsresult.ErrEnglish)
+	}
+	mtrresult := &MtrResult{Err: "context deadline exceeded"}
+	translateMtrError(mtrresult, timeouts)
+	if !strings.Contains(mtrresult.ErrEnglish, "for 20 seconds") {
+		t.Errorf("expected the Total timeout, got %q", mtrresult.ErrEnglish)
+	}
+}
@@ -0,0 +1,132 @@
+package pulse
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+)
+
+// Wire protocols between CNC and minions, negotiated with ALPN during the
+// TLS handshake.
+const (
+	ProtoGob  = ""                //net/rpc with gob, spoken by releases from before negotiation
+	ProtoJSON = "pulse-jsonrpc/1" //net/rpc with JSON-RPC 1.0, fields and test types unknown to one side are ignored
+)
+
+// Protocols lists the protocols offered, most preferred first. A peer that
+// offers none of them, or nothing at all, is spoken to in ProtoGob.
+var Protocols = []string{ProtoJSON}
+
+// NegotiatedProtocol answers the protocol agreed on over conn, after its
+// handshake.
+func NegotiatedProtocol(conn net.Conn) string {
+	if tlsconn, ok := conn.(*tls.Conn); ok {
+		return tlsconn.ConnectionState().NegotiatedProtocol
+	}
+	return ProtoGob
+}
+
+// NewRPCClient answers a client calling the other end of conn in the
+// negotiated protocol.
+func NewRPCClient(conn net.Conn) *rpc.Client {
+	if NegotiatedProtocol(conn) == ProtoJSON {
+		return jsonrpc.NewClient(conn)
+	}
+	return rpc.NewClient(conn)
+}
+
+// ServeRPC serves the registered rpc services on conn in the negotiated
+// protocol, until the connection closes.
+func ServeRPC(conn net.Conn) {
+	if NegotiatedProtocol(conn) == ProtoJSON {
+		rpc.ServeCodec(jsonrpc.NewServerCodec(conn))
+		return
+	}
+	rpc.ServeConn(conn)
+}
+
+// UnmarshalJSON decodes Args into the request type of Type. Args of test
+// types this release does not know stay json.RawMessage.
+func (req *CombinedRequest) UnmarshalJSON(data []byte) error {
+	type plain CombinedRequest
+	var raw struct {
+		plain
+		Args json.RawMessage
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*req = CombinedRequest(raw.plain)
+	var err error
+	switch req.Type {
+	case TypeDNS:
+		var args DNSRequest
+		err = unmarshalRaw(raw.Args, &args)
+		req.Args = args
+	case TypeMTR:
+		var args MtrRequest
+		err = unmarshalRaw(raw.Args, &args)
+		req.Args = args
+	case TypeCurl:
+		var args CurlRequest
+		err = unmarshalRaw(raw.Args, &args)
+		req.Args = args
+	default:
+		req.Args = rawOrNil(raw.Args)
+	}
+	return err
+}
+
+// UnmarshalJSON decodes Result into the result type of Type. Results of
+// test types this release does not know stay json.RawMessage.
+func (res *CombinedResult) UnmarshalJSON(data []byte) error {
+	type plain CombinedResult
+	var raw struct {
+		plain
+		Result json.RawMessage
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*res = CombinedResult(raw.plain)
+	if rawOrNil(raw.Result) == nil {
+		//Failed before running, Err says why
+		return nil
+	}
+	var err error
+	switch res.Type {
+	case TypeDNS:
+		var result DNSResult
+		err = unmarshalRaw(raw.Result, &result)
+		res.Result = result
+	case TypeMTR:
+		var result MtrResult
+		err = unmarshalRaw(raw.Result, &result)
+		res.Result = result
+	case TypeCurl:
+		var result CurlResult
+		err = unmarshalRaw(raw.Result, &result)
+		res.Result = result
+	default:
+		res.Result = raw.Result
+	}
+	return err
+}
+
+// unmarshalRaw is json.Unmarshal, leaving v alone when raw is missing.
+func unmarshalRaw(raw json.RawMessage, v interface{}) error {
+	if rawOrNil(raw) == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// rawOrNil answers nil for a missing or null raw.
+func rawOrNil(raw json.RawMessage) interface{} {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	return raw
+}
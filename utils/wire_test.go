@@ -0,0 +1,66 @@
+package pulse
+
+import (
+	"encoding/json"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCombinedJSON(t *testing.T) {
+	req := &CombinedRequest{Type: TypeDNS, Args: DNSRequest{Host: "example.com", QType: 1, Targets: []string{"192.0.2.53:53"}}, RequestedAt: time.Now().UTC()}
+	data, _ := json.Marshal(req)
+	var got CombinedRequest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Args, req.Args) || !got.RequestedAt.Equal(req.RequestedAt) {
+		t.Errorf("expected %+v, got %+v", req, got)
+	}
+
+	//A newer CNC may send fields and test types this release does not know
+	if err := json.Unmarshal([]byte(`{"Type":42,"Args":{"Hops":3},"Priority":1}`), &got); err != nil {
+		t.Fatal(err)
+	}
+	if raw, ok := got.Args.(json.RawMessage); !ok || string(raw) != `{"Hops":3}` {
+		t.Errorf("unknown args should stay raw, got %#v", got.Args)
+	}
+
+	res := &CombinedResult{Type: TypeMTR, Result: &MtrResult{Err: "exit status 1"}, Version: "v1"}
+	data, _ = json.Marshal(res)
+	var gotres CombinedResult
+	if err := json.Unmarshal(data, &gotres); err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := gotres.Result.(MtrResult); !ok || r.Err != "exit status 1" || gotres.Version != "v1" {
+		t.Errorf("expected an MtrResult, got %#v", gotres)
+	}
+	if err := json.Unmarshal([]byte(`{"Type":1,"Result":null,"Err":"timeout"}`), &gotres); err != nil || gotres.Result != nil {
+		t.Errorf("failed result should have no Result, got %#v %v", gotres.Result, err)
+	}
+}
+
+func TestJSONRPC(t *testing.T) {
+	server := rpc.NewServer()
+	server.Register(&Resolver{Version: "test"})
+	c, s := net.Pipe()
+	go server.ServeCodec(jsonrpc.NewServerCodec(s))
+	client := jsonrpc.NewClient(c)
+	defer client.Close()
+
+	var res CombinedResult
+	if err := client.Call("Resolver.Combined", &CombinedRequest{Type: 42, Args: map[string]int{"Hops": 3}}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(res.Err, "Unknown test type") || res.Version != "test" {
+		t.Errorf("expected an unknown test type from version test, got %+v", res)
+	}
+	//Not gob, so plain net.Conn peers fall back to it
+	if p := NegotiatedProtocol(c); p != ProtoGob {
+		t.Errorf("expected gob on a plain connection, got %q", p)
+	}
+}